@@ -1,43 +1,201 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-	"gitlab.com/digineat/go-broker-test/internal/db"
+	"gitlab.com/digineat/go-broker-test/internal/logging"
+	"gitlab.com/digineat/go-broker-test/internal/metrics"
 	"gitlab.com/digineat/go-broker-test/internal/services"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reprocess" {
+		runReprocess(os.Args[2:])
+		return
+	}
+
 	// Command line flags
-	dbPath := flag.String("db", "data.db", "path to SQLite database")
+	driver := flag.String("driver", "sqlite", "storage driver: sqlite or postgres")
+	dbPath := flag.String("db", "data.db", "path to SQLite database, PostgreSQL connection string or memory: for in-memory storage")
 	listenAddr := flag.String("listen", "8080", "HTTP server listen address")
+	instrumentsPath := flag.String("instruments", "", "path to JSON/CSV instrument registry to import on startup")
+	ratesPath := flag.String("rates", "", "path to JSON/CSV FX rates to import on startup")
+	notifyURLs := flag.String("notify-url", "", "comma-separated worker wakeup addresses (http://host:port/wakeup or unix:/path)")
+	queryTimeout := flag.Duration("query-timeout", 5*time.Second, "maximum time a request may spend in the database (0 disables)")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Second, "time given to in-flight requests to finish on shutdown")
+	readyMaxQueueAge := flag.Duration("ready-max-queue-age", services.DefaultReadinessThresholds.MaxQueueAge, "/readyz fails when the oldest unprocessed trade is older (0 disables)")
+	readyMaxQueueDepth := flag.Int64("ready-max-queue-depth", services.DefaultReadinessThresholds.MaxQueueDepth, "/readyz fails when more trades are unprocessed (0 disables)")
+	readyMaxHeartbeatAge := flag.Duration("ready-max-heartbeat-age", services.DefaultReadinessThresholds.MaxHeartbeatAge, "/readyz fails when no worker has run for longer (0 disables)")
+	workerStaleAfter := flag.Duration("worker-stale-after", time.Minute, "GET /workers flags workers without a heartbeat for longer as stale")
+	logFormat := flag.String("log-format", logging.FormatText, "log format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
 	flag.Parse()
 
-	// Initialize database connection with concurrent access parameters
-	dbConn, err := sql.Open("sqlite3", *dbPath+"?_journal=WAL&_timeout=5000&_busy_timeout=5000")
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	// Initialize storage and check database schema version
+	store, err := storage.Open(*driver, *dbPath)
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		logging.Fatal("failed to open storage", "err", err)
 	}
-	defer dbConn.Close()
+	defer store.Close()
 
-	db.InitDB(dbConn)
+	report := store.SelfCheck(context.Background())
+	for _, check := range report.Checks {
+		level := slog.LevelInfo
+		if !check.OK {
+			level = slog.LevelError
+		}
+		slog.Log(context.Background(), level, "storage self-check", "check", check.Name, "ok", check.OK, "detail", check.Detail)
+	}
+	if err := report.Err(); err != nil {
+		logging.Fatal("startup self-check failed", "err", err)
+	}
+
+	if *instrumentsPath != "" {
+		n, err := services.ImportInstrumentsFile(context.Background(), store, *instrumentsPath)
+		if err != nil {
+			logging.Fatal("failed to import instruments", "err", err)
+		}
+		slog.Info("imported instruments", "count", n, "path", *instrumentsPath)
+	}
+
+	if *ratesPath != "" {
+		n, err := services.ImportRatesFile(context.Background(), store, *ratesPath)
+		if err != nil {
+			logging.Fatal("failed to import rates", "err", err)
+		}
+		slog.Info("imported rates", "count", n, "path", *ratesPath)
+	}
 
-	repository := services.NewSqliteRepository(dbConn)
+	registry := metrics.NewRegistry()
+	serverMetrics := services.NewServerMetrics(registry)
+
+	serviceOpts := []services.ServerServiceOption{
+		services.WithServerMetrics(serverMetrics),
+		services.WithQueryTimeout(*queryTimeout),
+		services.WithWorkerStaleAfter(*workerStaleAfter),
+		services.WithReadinessThresholds(services.ReadinessThresholds{
+			MaxQueueDepth:   *readyMaxQueueDepth,
+			MaxQueueAge:     *readyMaxQueueAge,
+			MaxHeartbeatAge: *readyMaxHeartbeatAge,
+		}),
+	}
+	// Уведомления об обработанных сделках для запросов с ?wait=
+	processed := services.NewBroadcaster()
+	serviceOpts = append(serviceOpts, services.WithProcessedEvents(processed))
+	// Хранилище в памяти недоступно отдельному воркеру, поэтому сделки обрабатываются в этом процессе
+	var (
+		embedded *services.TradeService
+		wake     services.ChannelNotifier
+	)
+	switch {
+	case *dbPath == storage.MemoryDSN:
+		embedded = services.NewTradeService(store,
+			services.WithDrainTimeout(*drainTimeout),
+			services.WithWorkerMetrics(services.NewWorkerMetrics(registry, store)),
+			services.WithProcessedNotifier(processed),
+		)
+		wake = make(services.ChannelNotifier, 1)
+		serviceOpts = append(serviceOpts, services.WithEnqueueNotifier(wake))
+		if *notifyURLs != "" {
+			slog.Warn("ignoring -notify-url: trades are processed by the embedded worker")
+		}
+	case *notifyURLs != "":
+		serviceOpts = append(serviceOpts, services.WithEnqueueNotifier(services.NewHTTPNotifier(strings.Split(*notifyURLs, ","))))
+	}
+	// POST /admin/reprocess считает прибыль одним сервисом на весь процесс: встроенным воркером,
+	// если он есть. Инструменты и курсы, импортированные выше, воркеры читают из той же базы.
+	rebuilder := embedded
+	if rebuilder == nil {
+		rebuilder = services.NewTradeService(store)
+	}
+	serviceOpts = append(serviceOpts, services.WithRebuildService(rebuilder))
+	service := services.NewServerService(store, serviceOpts...)
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/trades", repository.PostServerTrades())
-	mux.HandleFunc("/healthz", repository.GetServerHealthz())
-	mux.HandleFunc("/stats/{acc}", repository.GetServerStats())
+	mux.HandleFunc("GET /trades", service.GetServerTrades())
+	mux.HandleFunc("POST /trades", service.PostServerTrades())
+	mux.HandleFunc("/trades/batch", service.PostServerTradesBatch())
+	mux.HandleFunc("/trades/{id}", service.ServerTrade())
+	mux.HandleFunc("/trades/{id}/amendments", service.GetServerTradeAmendments())
+	mux.HandleFunc("/internal/processed", service.PostServerProcessed())
+	mux.HandleFunc("/healthz", service.GetServerHealthz())
+	mux.HandleFunc("/livez", service.GetServerLivez())
+	mux.HandleFunc("/readyz", service.GetServerReadyz())
+	mux.HandleFunc("/workers", service.GetServerWorkers())
+	mux.HandleFunc("/accounts/{acc}/trades", service.GetServerAccountTrades())
+	mux.HandleFunc("/stats/{acc}", service.GetServerStats())
+	mux.HandleFunc("/stats/{acc}/symbols", service.GetServerSymbolStats())
+	mux.HandleFunc("/stats/{acc}/history", service.GetServerHistory())
+	mux.HandleFunc("GET /admin/rates", service.GetAdminRates())
+	mux.HandleFunc("POST /admin/rates", service.PostAdminRates())
+	mux.HandleFunc("/admin/accounts/{acc}", service.PutAdminAccount())
+	mux.HandleFunc("/admin/dead-letters", service.GetAdminDeadLetters())
+	mux.HandleFunc("/admin/dead-letters/{id}/retry", service.PostAdminDeadLetterRetry())
+	mux.HandleFunc("/admin/dead-letters/{id}", service.DeleteAdminDeadLetter())
+	mux.HandleFunc("/admin/reprocess", service.PostAdminReprocess())
+	mux.Handle("/metrics", registry.Handler())
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", *listenAddr),
+		Handler: services.RequestIDHandler(serverMetrics.Handler(mux)),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	workerDone := make(chan struct{})
+	if embedded != nil {
+		slog.Info("using in-memory storage, starting embedded worker", "worker_id", embedded.WorkerID())
+		go func() {
+			defer close(workerDone)
+			embedded.Run(ctx, wake, services.Backoff{Min: 100 * time.Millisecond, Max: 5 * time.Second})
+		}()
+	} else {
+		close(workerDone)
+	}
 
 	// Start server
-	log.Printf("Starting server on %s", *listenAddr)
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", *listenAddr), mux); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "addr", *listenAddr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("server failed", "err", err)
+		}
+	case <-ctx.Done():
+		slog.Info("shutting down server, waiting for in-flight requests", "drain_timeout", drainTimeout.String())
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("server shutdown", "err", err)
+		}
 	}
+	stop()
+	<-workerDone
+	slog.Info("server stopped")
 }
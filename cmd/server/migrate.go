@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/db"
+	"gitlab.com/digineat/go-broker-test/internal/logging"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+const migrateUsage = "usage: server migrate [-driver sqlite|postgres] [-db dsn] up|down|status"
+
+// runMigrate выполняет команду "server migrate": up применяет недостающие миграции,
+// down откатывает последнюю, status печатает состояние всех миграций
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), migrateUsage)
+		fs.PrintDefaults()
+	}
+	driver := fs.String("driver", "sqlite", "storage driver: sqlite or postgres")
+	dbPath := fs.String("db", "data.db", "path to SQLite database or PostgreSQL connection string")
+	logFormat := fs.String("log-format", logging.FormatText, "log format: text or json")
+	logLevel := fs.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	conn, schema, err := storage.Connect(*driver, *dbPath)
+	if err != nil {
+		logging.Fatal("failed to open storage", "err", err)
+	}
+	defer conn.Close()
+	migrator := db.NewMigrator(conn, schema)
+	ctx := context.Background()
+
+	switch fs.Arg(0) {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			slog.Info("applied migration", "version", migration.Version, "name", migration.Name)
+		}
+		if err != nil {
+			logging.Fatal("migration failed", "err", err)
+		}
+		if len(applied) == 0 {
+			slog.Info("schema is up to date", "version", migrator.Latest())
+		}
+	case "down":
+		migration, err := migrator.Down(ctx)
+		if err != nil {
+			logging.Fatal("rollback failed", "err", err)
+		}
+		slog.Info("rolled back migration", "version", migration.Version, "name", migration.Name)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			logging.Fatal("failed to read migration status", "err", err)
+		}
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			logging.Fatal("failed to read schema version", "err", err)
+		}
+		fmt.Printf("schema version %d, latest %d\n", version, migrator.Latest())
+		for _, status := range statuses {
+			state := "pending"
+			switch {
+			case status.Applied && status.AppliedAt == 0:
+				state = "applied (untracked)"
+			case status.Applied:
+				state = "applied " + time.Unix(status.AppliedAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-28s %s\n", status.Version, status.Name, state)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gitlab.com/digineat/go-broker-test/internal/logging"
+	"gitlab.com/digineat/go-broker-test/internal/services"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+const reprocessUsage = "usage: server reprocess [-driver sqlite|postgres] [-db dsn] [-account acc] [-from time] [-to time] [-dry-run]\n\n" +
+	"On SQLite the rebuild blocks all database writes until it finishes: pause ingestion\n" +
+	"or use POST /admin/reprocess, which answers all writes with 503 while it runs."
+
+// runReprocess выполняет команду "server reprocess": пересобирает статистику из истории
+// сделок, печатает отчет с расхождениями и, если не задан -dry-run, заменяет рабочую статистику
+func runReprocess(args []string) {
+	fs := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), reprocessUsage)
+		fs.PrintDefaults()
+	}
+	driver := fs.String("driver", "sqlite", "storage driver: sqlite or postgres")
+	dbPath := fs.String("db", "data.db", "path to SQLite database or PostgreSQL connection string")
+	account := fs.String("account", "", "rebuild stats of this account only (default: all accounts)")
+	from := fs.String("from", "", "recalculate profit of trades closed at or after this time (RFC 3339 or YYYY-MM-DD)")
+	to := fs.String("to", "", "recalculate profit of trades closed before this time (RFC 3339 or YYYY-MM-DD)")
+	dryRun := fs.Bool("dry-run", false, "only report differences, keep the live stats")
+	instrumentsPath := fs.String("instruments", "", "path to JSON/CSV instrument registry to import before rebuilding")
+	ratesPath := fs.String("rates", "", "path to JSON/CSV FX rates to import before rebuilding")
+	batchSize := fs.Int("batch", 100, "number of trades read from the database at once")
+	logFormat := fs.String("log-format", logging.FormatText, "log format: text or json")
+	logLevel := fs.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if *dbPath == storage.MemoryDSN {
+		logging.Fatal("in-memory storage is private to the server process, use POST /admin/reprocess")
+	}
+
+	scope, err := services.ParseRebuildScope(*account, *from, *to)
+	if err != nil {
+		logging.Fatal("invalid scope", "err", err)
+	}
+
+	store, err := storage.Open(*driver, *dbPath)
+	if err != nil {
+		logging.Fatal("failed to open storage", "err", err)
+	}
+	defer store.Close()
+	if err := store.SelfCheck(context.Background()).Err(); err != nil {
+		logging.Fatal("storage self-check failed", "err", err)
+	}
+
+	// SIGINT/SIGTERM откатывают незавершенную пересборку
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *instrumentsPath != "" {
+		n, err := services.ImportInstrumentsFile(ctx, store, *instrumentsPath)
+		if err != nil {
+			logging.Fatal("failed to import instruments", "err", err)
+		}
+		slog.Info("imported instruments", "count", n, "path", *instrumentsPath)
+	}
+	if *ratesPath != "" {
+		n, err := services.ImportRatesFile(ctx, store, *ratesPath)
+		if err != nil {
+			logging.Fatal("failed to import rates", "err", err)
+		}
+		slog.Info("imported rates", "count", n, "path", *ratesPath)
+	}
+
+	if store.RebuildBlocksWrites() {
+		slog.Warn("database writes are blocked until the rebuild finishes, POST /trades of a running server fails after busy_timeout")
+	}
+	tradeService := services.NewTradeService(store, services.WithBatchSize(*batchSize))
+	report, err := tradeService.Reprocess(ctx, services.ReprocessOptions{Scope: scope, DryRun: *dryRun})
+	if errors.Is(err, storage.ErrRebuildAmendmentsPending) {
+		logging.Fatal("trade amendments are pending, retry after the worker applies them")
+	}
+	if err != nil {
+		logging.Fatal("stats rebuild failed", "err", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if !*dryRun && !report.Applied {
+		logging.Fatal("stats rebuild not applied", "failures", len(report.Failures))
+	}
+}
@@ -1,46 +1,133 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-	"gitlab.com/digineat/go-broker-test/internal/db"
+	"gitlab.com/digineat/go-broker-test/internal/logging"
+	"gitlab.com/digineat/go-broker-test/internal/metrics"
 	"gitlab.com/digineat/go-broker-test/internal/services"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
 )
 
 func main() {
 	// Command line flags
-	dbPath := flag.String("db", "data.db", "path to SQLite database")
-	pollInterval := flag.Duration("poll", 100*time.Millisecond, "polling interval")
+	driver := flag.String("driver", "sqlite", "storage driver: sqlite or postgres")
+	dbPath := flag.String("db", "data.db", "path to SQLite database, PostgreSQL connection string or memory: for in-memory storage")
+	pollInterval := flag.Duration("poll", 100*time.Millisecond, "polling interval after a pass that processed trades")
+	maxPollInterval := flag.Duration("max-poll", 5*time.Second, "maximum polling interval while the queue stays empty")
+	notifyListen := flag.String("notify-listen", "", "address for wakeup notifications from the server (host:port or unix:/path)")
+	notifyServerURLs := flag.String("notify-server-url", "", "comma-separated server addresses notified after trades are processed (http://host:port/internal/processed or unix:/path:/internal/processed)")
+	instrumentsPath := flag.String("instruments", "", "path to JSON/CSV instrument registry to import on startup")
+	ratesPath := flag.String("rates", "", "path to JSON/CSV FX rates to import on startup")
+	maxAttempts := flag.Int("max-attempts", 5, "attempts before a failing trade is moved to dead-letter")
+	batchSize := flag.Int("batch", 100, "maximum number of trades processed in one transaction")
+	workerID := flag.String("worker-id", "", "worker identifier used for trade leases (default: host-pid-random)")
+	leaseDuration := flag.Duration("lease", 30*time.Second, "how long claimed trades stay leased to this worker")
+	drainTimeout := flag.Duration("drain-timeout", 5*time.Second, "time given to the in-flight batch to finish on shutdown")
+	metricsListen := flag.String("metrics-listen", "", "address for the Prometheus /metrics endpoint (host:port, empty disables)")
+	logFormat := flag.String("log-format", logging.FormatText, "log format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
 	flag.Parse()
 
-	// Initialize database connection with concurrent access parameters
-	dbConn, err := sql.Open("sqlite3", *dbPath+"?_journal=WAL&_timeout=5000&_busy_timeout=5000")
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	// Initialize storage and check database schema version
+	store, err := storage.Open(*driver, *dbPath)
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		logging.Fatal("failed to open storage", "err", err)
+	}
+	defer store.Close()
+
+	report := store.SelfCheck(context.Background())
+	for _, check := range report.Checks {
+		level := slog.LevelInfo
+		if !check.OK {
+			level = slog.LevelError
+		}
+		slog.Log(context.Background(), level, "storage self-check", "check", check.Name, "ok", check.OK, "detail", check.Detail)
+	}
+	if err := report.Err(); err != nil {
+		logging.Fatal("startup self-check failed", "err", err)
+	}
+	if *dbPath == storage.MemoryDSN {
+		slog.Warn("in-memory storage is private to this process, trades posted to the server are not visible here")
 	}
-	defer dbConn.Close()
 
-	// Test database connection
-	if err := dbConn.Ping(); err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
+	if *instrumentsPath != "" {
+		n, err := services.ImportInstrumentsFile(context.Background(), store, *instrumentsPath)
+		if err != nil {
+			logging.Fatal("failed to import instruments", "err", err)
+		}
+		slog.Info("imported instruments", "count", n, "path", *instrumentsPath)
 	}
 
-	// Initialize database schema
-	db.InitDB(dbConn)
+	if *ratesPath != "" {
+		n, err := services.ImportRatesFile(context.Background(), store, *ratesPath)
+		if err != nil {
+			logging.Fatal("failed to import rates", "err", err)
+		}
+		slog.Info("imported rates", "count", n, "path", *ratesPath)
+	}
 
-	log.Printf("Worker started with polling interval: %v", *pollInterval)
+	registry := metrics.NewRegistry()
+	tradeOpts := []services.TradeServiceOption{
+		services.WithWorkerMetrics(services.NewWorkerMetrics(registry, store)),
+		services.WithMaxAttempts(*maxAttempts),
+		services.WithBatchSize(*batchSize),
+		services.WithWorkerID(*workerID),
+		services.WithLeaseDuration(*leaseDuration),
+		services.WithDrainTimeout(*drainTimeout),
+	}
+	if *notifyServerURLs != "" {
+		tradeOpts = append(tradeOpts, services.WithProcessedNotifier(services.NewHTTPNotifier(strings.Split(*notifyServerURLs, ","))))
+	}
+	tradeService := services.NewTradeService(store, tradeOpts...)
 
-	tradeService := services.NewTradeService(dbConn)
+	// SIGINT/SIGTERM останавливают выбор новых порций
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Main worker loop
-	for {
-		if err := tradeService.ProcessTrades(); err != nil {
-			log.Printf("Ошибка при обработке записей: %v", err)
+	var wake <-chan struct{}
+	if *notifyListen != "" {
+		wake, err = services.ListenWakeup(ctx, *notifyListen)
+		if err != nil {
+			logging.Fatal("failed to listen for wakeup notifications", "err", err)
 		}
-		time.Sleep(*pollInterval)
+		slog.Info("listening for wakeup notifications", "addr", *notifyListen)
+	}
+
+	if *metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		metricsServer := &http.Server{Addr: *metricsListen, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logging.Fatal("metrics server failed", "err", err)
+			}
+		}()
+		defer metricsServer.Close()
+		slog.Info("serving metrics", "addr", *metricsListen, "path", "/metrics")
 	}
+
+	if *maxPollInterval < *pollInterval {
+		*maxPollInterval = *pollInterval
+	}
+
+	slog.Info("worker started", "worker_id", tradeService.WorkerID(), "poll", pollInterval.String(), "max_poll", maxPollInterval.String())
+
+	// Main worker loop
+	tradeService.Run(ctx, wake, services.Backoff{Min: *pollInterval, Max: *maxPollInterval})
+	slog.Info("worker stopped", "worker_id", tradeService.WorkerID())
 }
@@ -2,4 +2,7 @@ module gitlab.com/digineat/go-broker-test
 
 go 1.24.2
 
-require github.com/mattn/go-sqlite3 v1.14.28
+require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.28
+)
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// InitError - ошибка шага инициализации базы
+type InitError struct {
+	// Step - шаг инициализации: "pragma" или "migrate"
+	Step string
+	Err  error
+}
+
+func (e *InitError) Error() string {
+	return fmt.Sprintf("database init failed at %s: %v", e.Step, e.Err)
+}
+
+func (e *InitError) Unwrap() error {
+	return e.Err
+}
+
+// PragmaError - PRAGMA выполнилась, но база вернула другое значение.
+// Например, journal_mode=WAL недоступен на сетевых файловых системах.
+type PragmaError struct {
+	Pragma string
+	Want   string
+	Got    string
+}
+
+func (e *PragmaError) Error() string {
+	return fmt.Sprintf("PRAGMA %s is %q, expected %q", e.Pragma, e.Got, e.Want)
+}
+
+// pragma - параметр подключения SQLite и значение, которое PRAGMA возвращает после установки
+type pragma struct {
+	name  string
+	value string
+	want  string
+}
+
+// Включаем WAL режим и устанавливаем параметры для конкурентного доступа
+var sqlitePragmas = []pragma{
+	{name: "journal_mode", value: "WAL", want: "wal"},
+	{name: "busy_timeout", value: "5000", want: "5000"},
+	{name: "synchronous", value: "NORMAL", want: "1"},
+}
+
+// ConfigureSQLite устанавливает PRAGMA подключения без изменения схемы и проверяет,
+// что они применились. Возвращает *InitError, причина - *PragmaError или ошибка базы.
+func ConfigureSQLite(db *sql.DB) error {
+	ctx := context.Background()
+	for _, p := range sqlitePragmas {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("PRAGMA %s=%s", p.name, p.value)); err != nil {
+			return &InitError{Step: "pragma", Err: fmt.Errorf("failed to set %s: %v", p.name, err)}
+		}
+	}
+	var errs []error
+	for _, p := range sqlitePragmas {
+		if err := verifyPragma(ctx, db, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return &InitError{Step: "pragma", Err: errors.Join(errs...)}
+	}
+	return nil
+}
+
+// verifyPragma сравнивает текущее значение PRAGMA с ожидаемым. База в памяти
+// не поддерживает WAL и всегда сообщает journal_mode=memory.
+func verifyPragma(ctx context.Context, db *sql.DB, p pragma) error {
+	var got string
+	if err := db.QueryRowContext(ctx, "PRAGMA "+p.name).Scan(&got); err != nil {
+		return fmt.Errorf("failed to read %s: %v", p.name, err)
+	}
+	got = strings.ToLower(got)
+	want := p.want
+	if p.name == "journal_mode" && got == "memory" {
+		var file string
+		if err := db.QueryRowContext(ctx, "SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&file); err != nil {
+			return fmt.Errorf("failed to read database file: %v", err)
+		}
+		if file == "" {
+			want = "memory"
+		}
+	}
+	if got != want {
+		return &PragmaError{Pragma: p.name, Want: want, Got: got}
+	}
+	return nil
+}
+
+// Check - результат одной проверки самодиагностики
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report - отчет самодиагностики хранилища. Печатается сервером и воркером
+// при запуске и возвращается /healthz.
+type Report struct {
+	Checks []Check `json:"checks"`
+	// SchemaVersion - версия схемы базы, 0 для хранилища без схемы
+	SchemaVersion int `json:"schema_version,omitempty"`
+}
+
+// Add добавляет проверку: при err != nil проверка не пройдена и detail заменяется текстом ошибки
+func (r *Report) Add(name string, err error, detail string) {
+	if err != nil {
+		r.Checks = append(r.Checks, Check{Name: name, Detail: err.Error()})
+		return
+	}
+	r.Checks = append(r.Checks, Check{Name: name, OK: true, Detail: detail})
+}
+
+// OK сообщает, пройдены ли все проверки
+func (r Report) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Err возвращает ошибку с перечнем непройденных проверок или nil
+func (r Report) Err() error {
+	var failed []string
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, c.Name+": "+c.Detail)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("self-check failed: %s", strings.Join(failed, "; "))
+}
+
+// String возвращает отчет по строке на проверку
+func (r Report) String() string {
+	var b strings.Builder
+	for i, c := range r.Checks {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		state := "ok"
+		if !c.OK {
+			state = "FAIL"
+		}
+		fmt.Fprintf(&b, "%-14s %-4s %s", c.Name, state, c.Detail)
+	}
+	return b.String()
+}
+
+// SelfCheck проверяет подключение, PRAGMA SQLite и версию схемы
+func SelfCheck(ctx context.Context, db *sql.DB, schema Schema) Report {
+	var report Report
+	report.Add("driver", nil, schema.Name)
+	if err := db.PingContext(ctx); err != nil {
+		report.Add("connection", err, "")
+		return report
+	}
+	report.Add("connection", nil, "reachable")
+
+	if schema.Name == SQLite.Name {
+		for _, p := range sqlitePragmas {
+			report.Add(p.name, verifyPragma(ctx, db, p), p.value)
+		}
+	}
+
+	m := NewMigrator(db, schema)
+	version, err := m.Version(ctx)
+	if err == nil {
+		err = m.Check(ctx)
+	}
+	report.SchemaVersion = version
+	report.Add("schema", err, fmt.Sprintf("version %d", version))
+	return report
+}
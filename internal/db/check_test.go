@@ -0,0 +1,108 @@
+//go:build cgo
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestInitDB_Errors(t *testing.T) {
+	t.Run("pragma mismatch", func(t *testing.T) {
+		db := openTestDB(t)
+		err := verifyPragma(context.Background(), db, pragma{name: "synchronous", value: "FULL", want: "2"})
+		var pragmaErr *PragmaError
+		if !errors.As(err, &pragmaErr) {
+			t.Fatalf("Ожидалась *PragmaError, получено %v", err)
+		}
+		if pragmaErr.Pragma != "synchronous" || pragmaErr.Want != "2" {
+			t.Errorf("Неожиданная ошибка: %+v", pragmaErr)
+		}
+	})
+
+	t.Run("migration failure", func(t *testing.T) {
+		db := openTestDB(t)
+		if _, err := db.Exec("CREATE TABLE account_stats (account TEXT)"); err != nil {
+			t.Fatalf("Ошибка при создании таблицы: %v", err)
+		}
+		err := InitDB(db)
+		var initErr *InitError
+		if !errors.As(err, &initErr) {
+			t.Fatalf("Ожидалась *InitError, получено %v", err)
+		}
+		if initErr.Step != "migrate" {
+			t.Errorf("Ожидался шаг migrate, получено %s", initErr.Step)
+		}
+	})
+
+	t.Run("closed database", func(t *testing.T) {
+		db := openTestDB(t)
+		db.Close()
+		var initErr *InitError
+		if err := InitDB(db); !errors.As(err, &initErr) || initErr.Step != "pragma" {
+			t.Errorf("Ожидалась ошибка шага pragma, получено %v", err)
+		}
+	})
+}
+
+func TestSelfCheck(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("file database", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "broker.db"))
+		if err != nil {
+			t.Fatalf("Не удалось открыть базу данных: %v", err)
+		}
+		db.SetMaxOpenConns(1)
+		defer db.Close()
+		if err := InitDB(db); err != nil {
+			t.Fatalf("Не удалось создать схему: %v", err)
+		}
+
+		report := SelfCheck(ctx, db, SQLite)
+		if !report.OK() || report.Err() != nil {
+			t.Fatalf("Ожидался успешный отчет, получено:\n%s", report)
+		}
+		for _, name := range []string{"connection", "journal_mode", "busy_timeout", "synchronous", "schema"} {
+			if !strings.Contains(report.String(), name) {
+				t.Errorf("В отчете нет проверки %s:\n%s", name, report)
+			}
+		}
+	})
+
+	t.Run("outdated schema", func(t *testing.T) {
+		db := openTestDB(t)
+		if err := InitDB(db); err != nil {
+			t.Fatalf("Не удалось создать схему: %v", err)
+		}
+		if _, err := NewMigrator(db, SQLite).Down(ctx); err != nil {
+			t.Fatalf("Не удалось откатить миграцию: %v", err)
+		}
+
+		report := SelfCheck(ctx, db, SQLite)
+		if report.OK() {
+			t.Fatalf("Ожидалась ошибка проверки схемы:\n%s", report)
+		}
+		if err := report.Err(); err == nil || !strings.Contains(err.Error(), "schema") {
+			t.Errorf("Ожидалась ошибка проверки schema, получено %v", err)
+		}
+	})
+
+	t.Run("closed database", func(t *testing.T) {
+		db := openTestDB(t)
+		db.Close()
+		report := SelfCheck(ctx, db, SQLite)
+		if report.OK() {
+			t.Fatalf("Ожидалась ошибка подключения:\n%s", report)
+		}
+		if last := report.Checks[len(report.Checks)-1]; last.Name != "connection" || last.OK {
+			t.Errorf("Ожидалась непройденная проверка connection, получено %+v", last)
+		}
+	})
+}
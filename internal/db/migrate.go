@@ -0,0 +1,322 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration - пронумерованное изменение схемы. Up переводит схему из версии Version-1
+// в Version, Down - обратно. Запросы миграции выполняются в одной транзакции
+// вместе с записью в schema_migrations.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Schema - миграции и служебные запросы одной базы
+type Schema struct {
+	Name       string
+	Migrations []Migration
+	// tableExists и columnExists возвращают число найденных таблиц или колонок
+	tableExists  string
+	columnExists string
+	// insertVersion и deleteVersion добавляют и удаляют запись schema_migrations
+	insertVersion string
+	deleteVersion string
+	createTable   string
+	// lock блокирует schema_migrations до конца транзакции, чтобы сервер и воркер,
+	// запущенные одновременно, не применили одну миграцию дважды
+	lock string
+}
+
+// legacyVersions - версии, которым соответствуют базы, созданные до появления миграций.
+// База определяется по наличию колонки status в trades_q.
+const (
+	legacyBaselineVersion = 1
+	legacyCurrentVersion  = 3
+)
+
+// MigrationStatus - состояние одной миграции в базе
+type MigrationStatus struct {
+	Migration
+	Applied bool
+	// AppliedAt - время применения в секундах Unix, 0 если миграция не применена
+	AppliedAt int64
+}
+
+// Migrator применяет миграции схемы к базе
+type Migrator struct {
+	db     *sql.DB
+	schema Schema
+}
+
+func NewMigrator(db *sql.DB, schema Schema) *Migrator {
+	return &Migrator{db: db, schema: schema}
+}
+
+// Latest возвращает версию схемы, которую ожидает этот код
+func (m *Migrator) Latest() int {
+	if len(m.schema.Migrations) == 0 {
+		return 0
+	}
+	return m.schema.Migrations[len(m.schema.Migrations)-1].Version
+}
+
+// Version возвращает текущую версию схемы базы. Для базы без schema_migrations
+// версия определяется по существующим таблицам; 0 означает пустую базу.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	tracked, err := m.exists(ctx, m.schema.tableExists, "schema_migrations")
+	if err != nil {
+		return 0, err
+	}
+	if !tracked {
+		return m.legacyVersion(ctx)
+	}
+
+	var version sql.NullInt64
+	if err := m.db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to query schema version: %v", err)
+	}
+	return int(version.Int64), nil
+}
+
+// legacyVersion определяет версию схемы, созданной InitDB до появления миграций
+func (m *Migrator) legacyVersion(ctx context.Context) (int, error) {
+	found, err := m.exists(ctx, m.schema.tableExists, "trades_q")
+	if err != nil || !found {
+		return 0, err
+	}
+	current, err := m.exists(ctx, m.schema.columnExists, "trades_q", "status")
+	if err != nil {
+		return 0, err
+	}
+	if current {
+		return legacyCurrentVersion, nil
+	}
+	return legacyBaselineVersion, nil
+}
+
+func (m *Migrator) exists(ctx context.Context, query string, args ...any) (bool, error) {
+	var count int
+	if err := m.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to inspect schema: %v", err)
+	}
+	return count > 0, nil
+}
+
+// Status возвращает все миграции с отметкой о применении
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, len(m.schema.Migrations))
+	for i, migration := range m.schema.Migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses[i] = MigrationStatus{Migration: migration, Applied: ok, AppliedAt: appliedAt}
+	}
+	return statuses, nil
+}
+
+// applied возвращает время применения по версиям. Для базы без schema_migrations
+// миграции до версии legacyVersion считаются примененными без времени.
+func (m *Migrator) applied(ctx context.Context) (map[int]int64, error) {
+	applied := make(map[int]int64)
+	tracked, err := m.exists(ctx, m.schema.tableExists, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if !tracked {
+		version, err := m.legacyVersion(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for v := 1; v <= version; v++ {
+			applied[v] = 0
+		}
+		return applied, nil
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema migrations: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema migration: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating schema migrations: %v", err)
+	}
+	return applied, nil
+}
+
+// Up применяет все недостающие миграции по порядку и возвращает примененные
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	version, err := m.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version > m.Latest() {
+		return nil, fmt.Errorf("database schema version %d is newer than the latest known version %d", version, m.Latest())
+	}
+
+	var done []Migration
+	for _, migration := range m.schema.Migrations {
+		if migration.Version <= version {
+			continue
+		}
+		ok, err := m.apply(ctx, migration, true)
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s failed: %v", migration.Version, migration.Name, err)
+		}
+		if ok {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+// Down откатывает последнюю примененную миграцию
+func (m *Migrator) Down(ctx context.Context) (Migration, error) {
+	version, err := m.track(ctx)
+	if err != nil {
+		return Migration{}, err
+	}
+	if version == 0 {
+		return Migration{}, fmt.Errorf("no migrations to roll back")
+	}
+	for _, migration := range m.schema.Migrations {
+		if migration.Version != version {
+			continue
+		}
+		ok, err := m.apply(ctx, migration, false)
+		if err != nil {
+			return Migration{}, fmt.Errorf("rollback of migration %d_%s failed: %v", migration.Version, migration.Name, err)
+		}
+		if !ok {
+			return Migration{}, fmt.Errorf("schema version changed concurrently, expected %d", version)
+		}
+		return migration, nil
+	}
+	return Migration{}, fmt.Errorf("unknown schema version %d", version)
+}
+
+// Check возвращает ошибку, если версия схемы базы отличается от ожидаемой кодом
+func (m *Migrator) Check(ctx context.Context) error {
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version > m.Latest():
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d: upgrade the binary", version, m.Latest())
+	case version < m.Latest():
+		return fmt.Errorf("database schema version %d, expected %d: run \"migrate up\"", version, m.Latest())
+	}
+	return nil
+}
+
+// track создает schema_migrations и возвращает текущую версию. Для базы, созданной
+// до появления миграций, уже существующие версии записываются как примененные.
+func (m *Migrator) track(ctx context.Context) (int, error) {
+	tracked, err := m.exists(ctx, m.schema.tableExists, "schema_migrations")
+	if err != nil {
+		return 0, err
+	}
+	if tracked {
+		return m.Version(ctx)
+	}
+
+	legacy, err := m.legacyVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.schema.createTable); err != nil {
+		return 0, fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	version, err := m.lockVersion(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	// Другой процесс мог успеть записать версии, пока таблица создавалась
+	if version == 0 {
+		for _, migration := range m.schema.Migrations {
+			if migration.Version > legacy {
+				break
+			}
+			if _, err := tx.ExecContext(ctx, m.schema.insertVersion, migration.Version, migration.Name, time.Now().Unix()); err != nil {
+				return 0, fmt.Errorf("failed to record migration %d: %v", migration.Version, err)
+			}
+		}
+		version = legacy
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return version, nil
+}
+
+// lockVersion блокирует schema_migrations и возвращает версию схемы внутри транзакции
+func (m *Migrator) lockVersion(ctx context.Context, tx *sql.Tx) (int, error) {
+	if m.schema.lock != "" {
+		if _, err := tx.ExecContext(ctx, m.schema.lock); err != nil {
+			return 0, fmt.Errorf("failed to lock schema_migrations: %v", err)
+		}
+	}
+	var version sql.NullInt64
+	if err := tx.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to query schema version: %v", err)
+	}
+	return int(version.Int64), nil
+}
+
+// apply выполняет запросы миграции и обновляет schema_migrations в одной транзакции.
+// Возвращает false, если версия схемы уже изменена другим процессом.
+func (m *Migrator) apply(ctx context.Context, migration Migration, up bool) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	version, err := m.lockVersion(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	statements, record, args := migration.Up, m.schema.insertVersion, []any{migration.Version, migration.Name, time.Now().Unix()}
+	if !up {
+		statements, record, args = migration.Down, m.schema.deleteVersion, []any{migration.Version}
+	}
+	if (up && version >= migration.Version) || (!up && version != migration.Version) {
+		return false, nil
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return false, fmt.Errorf("failed to update schema_migrations: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return true, nil
+}
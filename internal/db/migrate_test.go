@@ -0,0 +1,246 @@
+//go:build cgo
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Не удалось открыть базу данных: %v", err)
+	}
+	// Каждое соединение к :memory: открывает отдельную базу
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func schemaVersion(t *testing.T, m *Migrator) int {
+	t.Helper()
+	version, err := m.Version(context.Background())
+	if err != nil {
+		t.Fatalf("Ошибка при чтении версии схемы: %v", err)
+	}
+	return version
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("up, down and status", func(t *testing.T) {
+		db := openTestDB(t)
+		m := NewMigrator(db, SQLite)
+
+		if v := schemaVersion(t, m); v != 0 {
+			t.Errorf("Ожидалась версия 0 для пустой базы, получено %d", v)
+		}
+		if err := m.Check(ctx); err == nil {
+			t.Error("Ожидалась ошибка проверки пустой базы")
+		}
+
+		applied, err := m.Up(ctx)
+		if err != nil {
+			t.Fatalf("Ошибка при применении миграций: %v", err)
+		}
+		if len(applied) != len(sqliteMigrations) {
+			t.Errorf("Ожидалось %d примененных миграций, получено %d", len(sqliteMigrations), len(applied))
+		}
+		if err := m.Check(ctx); err != nil {
+			t.Errorf("Неожиданная ошибка проверки: %v", err)
+		}
+		if applied, err := m.Up(ctx); err != nil || len(applied) != 0 {
+			t.Errorf("Повторный up: применено %d, ошибка %v", len(applied), err)
+		}
+
+		rolledBack, err := m.Down(ctx)
+		if err != nil {
+			t.Fatalf("Ошибка при откате миграции: %v", err)
+		}
+		if rolledBack.Version != m.Latest() {
+			t.Errorf("Ожидался откат версии %d, получено %d", m.Latest(), rolledBack.Version)
+		}
+		if v := schemaVersion(t, m); v != m.Latest()-1 {
+			t.Errorf("Ожидалась версия %d, получено %d", m.Latest()-1, v)
+		}
+		if err := m.Check(ctx); err == nil {
+			t.Error("Ожидалась ошибка проверки после отката")
+		}
+
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			t.Fatalf("Ошибка при чтении статуса: %v", err)
+		}
+		for _, status := range statuses {
+			if want := status.Version < m.Latest(); status.Applied != want {
+				t.Errorf("Миграция %d: applied = %v, ожидалось %v", status.Version, status.Applied, want)
+			}
+			if status.Applied && status.AppliedAt == 0 {
+				t.Errorf("Миграция %d: не указано время применения", status.Version)
+			}
+		}
+
+		for range sqliteMigrations[:len(sqliteMigrations)-1] {
+			if _, err := m.Down(ctx); err != nil {
+				t.Fatalf("Ошибка при откате миграции: %v", err)
+			}
+		}
+		if v := schemaVersion(t, m); v != 0 {
+			t.Errorf("Ожидалась версия 0 после отката всех миграций, получено %d", v)
+		}
+		if _, err := m.Down(ctx); err == nil {
+			t.Error("Ожидалась ошибка отката без примененных миграций")
+		}
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatalf("Ошибка при повторном применении миграций: %v", err)
+		}
+	})
+
+	t.Run("trade status round trip", func(t *testing.T) {
+		db := openTestDB(t)
+		m := NewMigrator(db, SQLite)
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatalf("Ошибка при применении миграций: %v", err)
+		}
+		if _, err := db.Exec(`INSERT INTO trades_q (account, symbol, volume, open, close, side, status)
+			VALUES ('acc', 'EURUSD', 1, 1.1, 1.2, 'buy', 'processed'), ('acc', 'EURUSD', 1, 1.1, 1.2, 'buy', 'pending')`); err != nil {
+			t.Fatalf("Ошибка при добавлении сделок: %v", err)
+		}
+
+		for schemaVersion(t, m) > legacyBaselineVersion {
+			if _, err := m.Down(ctx); err != nil {
+				t.Fatalf("Ошибка при откате миграции: %v", err)
+			}
+		}
+		var processed int
+		if err := db.QueryRow("SELECT SUM(processed) FROM trades_q").Scan(&processed); err != nil {
+			t.Fatalf("Ошибка при чтении processed: %v", err)
+		}
+		if processed != 1 {
+			t.Errorf("Ожидалась 1 обработанная сделка, получено %d", processed)
+		}
+
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatalf("Ошибка при применении миграций: %v", err)
+		}
+		var statuses string
+		if err := db.QueryRow("SELECT GROUP_CONCAT(status, ',') FROM (SELECT status FROM trades_q ORDER BY id)").Scan(&statuses); err != nil {
+			t.Fatalf("Ошибка при чтении статусов: %v", err)
+		}
+		if statuses != "processed,pending" {
+			t.Errorf("Ожидались статусы processed,pending, получено %s", statuses)
+		}
+	})
+
+	t.Run("legacy baseline database", func(t *testing.T) {
+		db := openTestDB(t)
+		for _, statement := range sqliteMigrations[0].Up {
+			if _, err := db.Exec(statement); err != nil {
+				t.Fatalf("Ошибка при создании исходной схемы: %v", err)
+			}
+		}
+		if _, err := db.Exec(`INSERT INTO trades_q (account, symbol, volume, open, close, side, processed)
+			VALUES ('acc', 'EURUSD', 1, 1.1, 1.2, 'buy', 1), ('acc', 'EURUSD', 1, 1.1, 1.2, 'buy', 0)`); err != nil {
+			t.Fatalf("Ошибка при добавлении сделок: %v", err)
+		}
+
+		m := NewMigrator(db, SQLite)
+		if v := schemaVersion(t, m); v != legacyBaselineVersion {
+			t.Errorf("Ожидалась версия %d, получено %d", legacyBaselineVersion, v)
+		}
+		applied, err := m.Up(ctx)
+		if err != nil {
+			t.Fatalf("Ошибка при применении миграций: %v", err)
+		}
+		if len(applied) != m.Latest()-legacyBaselineVersion {
+			t.Errorf("Ожидалось %d примененных миграций, получено %d", m.Latest()-legacyBaselineVersion, len(applied))
+		}
+
+		var pending int
+		if err := db.QueryRow("SELECT COUNT(*) FROM trades_q WHERE status = 'pending'").Scan(&pending); err != nil {
+			t.Fatalf("Ошибка при чтении сделок: %v", err)
+		}
+		if pending != 1 {
+			t.Errorf("Ожидалась 1 необработанная сделка, получено %d", pending)
+		}
+	})
+
+	t.Run("legacy current database", func(t *testing.T) {
+		db := openTestDB(t)
+		for _, migration := range sqliteMigrations[:legacyCurrentVersion] {
+			for _, statement := range migration.Up {
+				if _, err := db.Exec(statement); err != nil {
+					t.Fatalf("Ошибка при создании схемы: %v", err)
+				}
+			}
+		}
+
+		m := NewMigrator(db, SQLite)
+		if v := schemaVersion(t, m); v != legacyCurrentVersion {
+			t.Errorf("Ожидалась версия %d, получено %d", legacyCurrentVersion, v)
+		}
+		applied, err := m.Up(ctx)
+		if err != nil || len(applied) != m.Latest()-legacyCurrentVersion {
+			t.Fatalf("Up: применено %d, ошибка %v", len(applied), err)
+		}
+		if err := m.Check(ctx); err != nil {
+			t.Errorf("Неожиданная ошибка проверки: %v", err)
+		}
+		var recorded int
+		if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&recorded); err != nil {
+			t.Fatalf("Ошибка при чтении schema_migrations: %v", err)
+		}
+		if recorded != len(sqliteMigrations) {
+			t.Errorf("Ожидалось %d записей schema_migrations, получено %d", len(sqliteMigrations), recorded)
+		}
+	})
+
+	t.Run("newer database", func(t *testing.T) {
+		db := openTestDB(t)
+		m := NewMigrator(db, SQLite)
+		if _, err := m.Up(ctx); err != nil {
+			t.Fatalf("Ошибка при применении миграций: %v", err)
+		}
+		if _, err := db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'future', 0)", m.Latest()+1); err != nil {
+			t.Fatalf("Ошибка при добавлении версии: %v", err)
+		}
+		if err := m.Check(ctx); err == nil {
+			t.Error("Ожидалась ошибка проверки для более новой схемы")
+		}
+		if _, err := m.Up(ctx); err == nil || !strings.Contains(err.Error(), "newer") {
+			t.Errorf("Ожидалась ошибка о более новой схеме, получено %v", err)
+		}
+	})
+
+	t.Run("failed migration is rolled back", func(t *testing.T) {
+		db := openTestDB(t)
+		schema := SQLite
+		schema.Migrations = append(slices.Clone(sqliteMigrations), Migration{
+			Version: len(sqliteMigrations) + 1,
+			Name:    "broken",
+			Up:      []string{"CREATE TABLE broken (id INTEGER)", "INSERT INTO missing VALUES (1)"},
+		})
+		m := NewMigrator(db, schema)
+		if _, err := m.Up(ctx); err == nil {
+			t.Fatal("Ожидалась ошибка миграции")
+		}
+		if v := schemaVersion(t, m); v != len(sqliteMigrations) {
+			t.Errorf("Ожидалась версия %d, получено %d", len(sqliteMigrations), v)
+		}
+		var tables int
+		if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'broken'").Scan(&tables); err != nil {
+			t.Fatalf("Ошибка при чтении таблиц: %v", err)
+		}
+		if tables != 0 {
+			t.Error("Таблица неудачной миграции не должна остаться в базе")
+		}
+	})
+}
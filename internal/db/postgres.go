@@ -0,0 +1,272 @@
+package db
+
+// Миграции PostgreSQL повторяют миграции SQLite с теми же версиями. Время хранится
+// в секундах Unix (BIGINT), суммы - в DOUBLE PRECISION, так как REAL в PostgreSQL
+// имеет одинарную точность. Колонки trades_q добавляются через ALTER TABLE.
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial",
+		Up: []string{`
+CREATE TABLE trades_q (
+	id BIGSERIAL PRIMARY KEY,
+	account TEXT NOT NULL,
+	symbol TEXT NOT NULL,
+	volume DOUBLE PRECISION NOT NULL,
+	open DOUBLE PRECISION NOT NULL,
+	close DOUBLE PRECISION NOT NULL,
+	side TEXT NOT NULL,
+	processed INTEGER DEFAULT 0
+);
+`, `
+CREATE TABLE account_stats (
+	account TEXT PRIMARY KEY,
+	trades INTEGER DEFAULT 0,
+	profit DOUBLE PRECISION DEFAULT 0.0
+);
+`},
+		Down: []string{"DROP TABLE account_stats", "DROP TABLE trades_q"},
+	},
+	{
+		Version: 2,
+		Name:    "trade_status",
+		Up: []string{
+			"ALTER TABLE trades_q ADD COLUMN client_trade_id TEXT UNIQUE",
+			"ALTER TABLE trades_q ADD COLUMN open_time BIGINT",
+			"ALTER TABLE trades_q ADD COLUMN close_time BIGINT",
+			"ALTER TABLE trades_q ADD COLUMN created_at BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM now())::BIGINT)",
+			"ALTER TABLE trades_q ADD COLUMN status TEXT NOT NULL DEFAULT 'pending'",
+			"ALTER TABLE trades_q ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE trades_q ADD COLUMN failed_reason TEXT",
+			"ALTER TABLE trades_q ADD COLUMN worker_id TEXT",
+			"ALTER TABLE trades_q ADD COLUMN lease_expires_at BIGINT",
+			"ALTER TABLE trades_q ADD COLUMN profit DOUBLE PRECISION",
+			"ALTER TABLE trades_q ADD COLUMN quote_currency TEXT",
+			"ALTER TABLE trades_q ADD COLUMN converted_profit DOUBLE PRECISION",
+			"ALTER TABLE trades_q ADD COLUMN account_currency TEXT",
+			"UPDATE trades_q SET status = 'processed' WHERE processed = 1",
+			"ALTER TABLE trades_q DROP COLUMN processed",
+		},
+		Down: []string{
+			"ALTER TABLE trades_q ADD COLUMN processed INTEGER DEFAULT 0",
+			"UPDATE trades_q SET processed = 1 WHERE status <> 'pending'",
+			"ALTER TABLE trades_q DROP COLUMN account_currency",
+			"ALTER TABLE trades_q DROP COLUMN converted_profit",
+			"ALTER TABLE trades_q DROP COLUMN quote_currency",
+			"ALTER TABLE trades_q DROP COLUMN profit",
+			"ALTER TABLE trades_q DROP COLUMN lease_expires_at",
+			"ALTER TABLE trades_q DROP COLUMN worker_id",
+			"ALTER TABLE trades_q DROP COLUMN failed_reason",
+			"ALTER TABLE trades_q DROP COLUMN attempts",
+			"ALTER TABLE trades_q DROP COLUMN status",
+			"ALTER TABLE trades_q DROP COLUMN created_at",
+			"ALTER TABLE trades_q DROP COLUMN close_time",
+			"ALTER TABLE trades_q DROP COLUMN open_time",
+			"ALTER TABLE trades_q DROP COLUMN client_trade_id",
+		},
+	},
+	{
+		Version: 3,
+		Name:    "analytics_and_currencies",
+		Up: []string{`
+CREATE TABLE account_symbol_stats (
+	account TEXT NOT NULL,
+	symbol TEXT NOT NULL,
+	side TEXT NOT NULL,
+	trades INTEGER DEFAULT 0,
+	volume DOUBLE PRECISION DEFAULT 0.0,
+	gross_profit DOUBLE PRECISION DEFAULT 0.0,
+	gross_loss DOUBLE PRECISION DEFAULT 0.0,
+	wins INTEGER DEFAULT 0,
+	PRIMARY KEY (account, symbol, side)
+);
+`, `
+CREATE TABLE account_pnl_history (
+	account TEXT NOT NULL,
+	period TEXT NOT NULL,
+	bucket BIGINT NOT NULL,
+	trades INTEGER DEFAULT 0,
+	profit DOUBLE PRECISION DEFAULT 0.0,
+	PRIMARY KEY (account, period, bucket)
+);
+`, `
+CREATE TABLE instruments (
+	symbol TEXT PRIMARY KEY,
+	contract_size DOUBLE PRECISION NOT NULL,
+	pip_size DOUBLE PRECISION NOT NULL,
+	quote_currency TEXT NOT NULL,
+	precision INTEGER NOT NULL
+);
+`, `
+CREATE TABLE accounts (
+	account TEXT PRIMARY KEY,
+	currency TEXT NOT NULL DEFAULT 'USD'
+);
+`, `
+CREATE TABLE fx_rates (
+	base TEXT NOT NULL,
+	quote TEXT NOT NULL,
+	rate DOUBLE PRECISION NOT NULL,
+	PRIMARY KEY (base, quote)
+);
+`},
+		Down: []string{
+			"DROP TABLE fx_rates",
+			"DROP TABLE accounts",
+			"DROP TABLE instruments",
+			"DROP TABLE account_pnl_history",
+			"DROP TABLE account_symbol_stats",
+		},
+	},
+	{
+		Version: 4,
+		Name:    "readiness",
+		Up: []string{`
+CREATE TABLE worker_heartbeats (
+	worker_id TEXT PRIMARY KEY,
+	last_run_at BIGINT NOT NULL
+);
+`, createTradesQStatusIndex},
+		Down: []string{"DROP INDEX trades_q_status_created_at", "DROP TABLE worker_heartbeats"},
+	},
+	{
+		Version: 5,
+		Name:    "worker_status",
+		Up: []string{
+			"ALTER TABLE worker_heartbeats ADD COLUMN host TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE worker_heartbeats ADD COLUMN pid INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE worker_heartbeats ADD COLUMN started_at BIGINT NOT NULL DEFAULT 0",
+			"ALTER TABLE worker_heartbeats ADD COLUMN last_batch_size INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE worker_heartbeats ADD COLUMN last_error TEXT",
+		},
+		Down: []string{
+			"ALTER TABLE worker_heartbeats DROP COLUMN last_error",
+			"ALTER TABLE worker_heartbeats DROP COLUMN last_batch_size",
+			"ALTER TABLE worker_heartbeats DROP COLUMN started_at",
+			"ALTER TABLE worker_heartbeats DROP COLUMN pid",
+			"ALTER TABLE worker_heartbeats DROP COLUMN host",
+		},
+	},
+	{
+		Version: 6,
+		Name:    "request_id",
+		Up: []string{
+			"ALTER TABLE trades_q ADD COLUMN request_id TEXT NOT NULL DEFAULT ''",
+		},
+		Down: []string{
+			"ALTER TABLE trades_q DROP COLUMN request_id",
+		},
+	},
+	{
+		Version: 7,
+		Name:    "trade_listing_indexes",
+		Up: []string{
+			"CREATE INDEX trades_q_account_id ON trades_q (account, id)",
+			"CREATE INDEX trades_q_symbol_id ON trades_q (symbol, id)",
+			"CREATE INDEX trades_q_status_id ON trades_q (status, id)",
+			"CREATE INDEX trades_q_created_at ON trades_q (created_at)",
+		},
+		Down: []string{
+			"DROP INDEX trades_q_created_at",
+			"DROP INDEX trades_q_status_id",
+			"DROP INDEX trades_q_symbol_id",
+			"DROP INDEX trades_q_account_id",
+		},
+	},
+	{
+		Version: 8,
+		Name:    "trade_amendments",
+		Up: []string{`
+CREATE TABLE trade_amendments (
+	id BIGSERIAL PRIMARY KEY,
+	trade_id BIGINT NOT NULL REFERENCES trades_q (id),
+	action TEXT NOT NULL,
+	prev_status TEXT NOT NULL,
+	prev_volume DOUBLE PRECISION NOT NULL,
+	prev_open DOUBLE PRECISION NOT NULL,
+	prev_close DOUBLE PRECISION NOT NULL,
+	prev_side TEXT NOT NULL,
+	volume DOUBLE PRECISION NOT NULL,
+	open DOUBLE PRECISION NOT NULL,
+	close DOUBLE PRECISION NOT NULL,
+	side TEXT NOT NULL,
+	prev_profit DOUBLE PRECISION,
+	profit DOUBLE PRECISION,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	failed_reason TEXT,
+	request_id TEXT NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL,
+	applied_at BIGINT
+);
+`,
+			"CREATE INDEX trade_amendments_trade_id ON trade_amendments (trade_id, id)",
+			"CREATE INDEX trade_amendments_status_id ON trade_amendments (status, id)",
+		},
+		Down: []string{"DROP TABLE trade_amendments"},
+	},
+	{
+		Version: 9,
+		Name:    "stats_rebuild",
+		Up: []string{`
+CREATE TABLE account_stats_shadow (
+	account TEXT PRIMARY KEY,
+	trades INTEGER DEFAULT 0,
+	profit DOUBLE PRECISION DEFAULT 0.0
+);
+`, `
+CREATE TABLE account_symbol_stats_shadow (
+	account TEXT NOT NULL,
+	symbol TEXT NOT NULL,
+	side TEXT NOT NULL,
+	trades INTEGER DEFAULT 0,
+	volume DOUBLE PRECISION DEFAULT 0.0,
+	gross_profit DOUBLE PRECISION DEFAULT 0.0,
+	gross_loss DOUBLE PRECISION DEFAULT 0.0,
+	wins INTEGER DEFAULT 0,
+	PRIMARY KEY (account, symbol, side)
+);
+`, `
+CREATE TABLE account_pnl_history_shadow (
+	account TEXT NOT NULL,
+	period TEXT NOT NULL,
+	bucket BIGINT NOT NULL,
+	trades INTEGER DEFAULT 0,
+	profit DOUBLE PRECISION DEFAULT 0.0,
+	PRIMARY KEY (account, period, bucket)
+);
+`, `
+CREATE TABLE trade_profits_shadow (
+	trade_id BIGINT PRIMARY KEY,
+	profit DOUBLE PRECISION NOT NULL,
+	quote_currency TEXT,
+	converted_profit DOUBLE PRECISION NOT NULL,
+	account_currency TEXT NOT NULL
+);
+`},
+		Down: []string{
+			"DROP TABLE trade_profits_shadow",
+			"DROP TABLE account_pnl_history_shadow",
+			"DROP TABLE account_symbol_stats_shadow",
+			"DROP TABLE account_stats_shadow",
+		},
+	},
+}
+
+// Postgres - миграции схемы PostgreSQL
+var Postgres = Schema{
+	Name:          "postgres",
+	Migrations:    postgresMigrations,
+	tableExists:   "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1",
+	columnExists:  "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2",
+	insertVersion: "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+	deleteVersion: "DELETE FROM schema_migrations WHERE version = $1",
+	createTable: `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at BIGINT NOT NULL
+);
+`,
+	lock: "LOCK TABLE schema_migrations IN EXCLUSIVE MODE",
+}
@@ -0,0 +1,111 @@
+//go:build cgo
+
+package db
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// postgresColumns воспроизводит миграции PostgreSQL и возвращает колонки таблиц
+func postgresColumns(t *testing.T) map[string][]string {
+	t.Helper()
+	tables := make(map[string][]string)
+	for _, migration := range postgresMigrations {
+		for _, statement := range migration.Up {
+			fields := strings.Fields(statement)
+			switch {
+			case strings.HasPrefix(statement, "ALTER TABLE") && fields[3] == "ADD":
+				tables[fields[2]] = append(tables[fields[2]], fields[5])
+			case strings.HasPrefix(statement, "ALTER TABLE") && fields[3] == "DROP":
+				tables[fields[2]] = slices.DeleteFunc(tables[fields[2]], func(c string) bool { return c == fields[5] })
+			case strings.HasPrefix(statement, "DROP TABLE"):
+				delete(tables, fields[2])
+			case strings.HasPrefix(strings.TrimSpace(statement), "CREATE TABLE"):
+				lines := strings.Split(strings.TrimSpace(statement), "\n")
+				name := strings.Fields(lines[0])[2]
+				tables[name] = nil
+				for _, line := range lines[1:] {
+					line = strings.TrimSpace(line)
+					if line == "" || strings.HasPrefix(line, "PRIMARY KEY") || line == ");" {
+						continue
+					}
+					tables[name] = append(tables[name], strings.Fields(line)[0])
+				}
+			case strings.HasPrefix(statement, "UPDATE"), strings.HasPrefix(statement, "CREATE INDEX"):
+			default:
+				t.Fatalf("Миграция %d: неизвестный запрос %q", migration.Version, statement)
+			}
+		}
+	}
+	return tables
+}
+
+// Схема PostgreSQL после всех миграций должна содержать те же таблицы и колонки,
+// что и схема SQLite, а версии миграций должны совпадать
+func TestPostgresSchemaMatchesSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Не удалось открыть базу данных: %v", err)
+	}
+	defer db.Close()
+	if err := InitDB(db); err != nil {
+		t.Fatalf("Не удалось создать схему: %v", err)
+	}
+
+	if len(postgresMigrations) != len(sqliteMigrations) {
+		t.Fatalf("Ожидалось %d миграций PostgreSQL, получено %d", len(sqliteMigrations), len(postgresMigrations))
+	}
+	for i, migration := range postgresMigrations {
+		if migration.Version != sqliteMigrations[i].Version || migration.Name != sqliteMigrations[i].Name {
+			t.Errorf("Миграция PostgreSQL %d_%s не совпадает с миграцией SQLite %d_%s",
+				migration.Version, migration.Name, sqliteMigrations[i].Version, sqliteMigrations[i].Name)
+		}
+	}
+
+	postgres := postgresColumns(t)
+	postgres["schema_migrations"] = []string{"version", "name", "applied_at"}
+
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		t.Fatalf("Ошибка при чтении таблиц: %v", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatalf("Ошибка при чтении таблицы: %v", err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	if len(tables) != len(postgres) {
+		t.Errorf("Ожидалось %d таблиц в схеме PostgreSQL, получено %d", len(tables), len(postgres))
+	}
+	for _, table := range tables {
+		columns, err := db.Query("SELECT name FROM pragma_table_info(?) ORDER BY name", table)
+		if err != nil {
+			t.Fatalf("Ошибка при чтении колонок %s: %v", table, err)
+		}
+		var names []string
+		for columns.Next() {
+			var name string
+			if err := columns.Scan(&name); err != nil {
+				t.Fatalf("Ошибка при чтении колонки: %v", err)
+			}
+			names = append(names, name)
+		}
+		columns.Close()
+
+		// ALTER TABLE в PostgreSQL добавляет колонки в конец, поэтому порядок не сравнивается
+		pgNames := slices.Sorted(slices.Values(postgres[table]))
+		if got, want := strings.Join(pgNames, ","), strings.Join(names, ","); got != want {
+			t.Errorf("Таблица %s: колонки PostgreSQL %s, SQLite %s", table, got, want)
+		}
+	}
+}
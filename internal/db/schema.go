@@ -1,52 +1,346 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"log/slog"
 )
 
 const createTradesQTable = `
-CREATE TABLE IF NOT EXISTS trades_q (
+CREATE TABLE trades_q (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	client_trade_id TEXT UNIQUE,
 	account TEXT NOT NULL,
 	symbol TEXT NOT NULL,
 	volume REAL NOT NULL,
 	open REAL NOT NULL,
 	close REAL NOT NULL,
 	side TEXT NOT NULL,
-	processed INTEGER DEFAULT 0
+	open_time INTEGER,
+	close_time INTEGER,
+	created_at INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	failed_reason TEXT,
+	worker_id TEXT,
+	lease_expires_at INTEGER,
+	profit REAL,
+	quote_currency TEXT,
+	converted_profit REAL,
+	account_currency TEXT
 );
 `
 
 const createAccountStatsTable = `
-CREATE TABLE IF NOT EXISTS account_stats (
+CREATE TABLE account_stats (
 	account TEXT PRIMARY KEY,
 	trades INTEGER DEFAULT 0,
 	profit REAL DEFAULT 0.0
 );
 `
 
-func InitDB(db *sql.DB) {
-	// Включаем WAL режим и устанавливаем параметры для конкурентного доступа
-	pragmas := []string{
-		"PRAGMA journal_mode=WAL",
-		"PRAGMA busy_timeout=5000",
-		"PRAGMA synchronous=NORMAL",
-	}
+const createAccountSymbolStatsTable = `
+CREATE TABLE account_symbol_stats (
+	account TEXT NOT NULL,
+	symbol TEXT NOT NULL,
+	side TEXT NOT NULL,
+	trades INTEGER DEFAULT 0,
+	volume REAL DEFAULT 0.0,
+	gross_profit REAL DEFAULT 0.0,
+	gross_loss REAL DEFAULT 0.0,
+	wins INTEGER DEFAULT 0,
+	PRIMARY KEY (account, symbol, side)
+);
+`
 
-	for _, pragma := range pragmas {
-		if _, err := db.Exec(pragma); err != nil {
-			log.Printf("Warning: Failed to set %s: %v", pragma, err)
-		}
-	}
+// Агрегаты прибыли по периодам: period = 'day' или 'hour',
+// bucket - начало периода в секундах Unix (UTC)
+const createAccountPnlHistoryTable = `
+CREATE TABLE account_pnl_history (
+	account TEXT NOT NULL,
+	period TEXT NOT NULL,
+	bucket INTEGER NOT NULL,
+	trades INTEGER DEFAULT 0,
+	profit REAL DEFAULT 0.0,
+	PRIMARY KEY (account, period, bucket)
+);
+`
+
+const createInstrumentsTable = `
+CREATE TABLE instruments (
+	symbol TEXT PRIMARY KEY,
+	contract_size REAL NOT NULL,
+	pip_size REAL NOT NULL,
+	quote_currency TEXT NOT NULL,
+	precision INTEGER NOT NULL
+);
+`
+
+const createAccountsTable = `
+CREATE TABLE accounts (
+	account TEXT PRIMARY KEY,
+	currency TEXT NOT NULL DEFAULT 'USD'
+);
+`
+
+const createFxRatesTable = `
+CREATE TABLE fx_rates (
+	base TEXT NOT NULL,
+	quote TEXT NOT NULL,
+	rate REAL NOT NULL,
+	PRIMARY KEY (base, quote)
+);
+`
+
+// Отметки воркеров: время последнего прохода по очереди
+const createWorkerHeartbeatsTable = `
+CREATE TABLE worker_heartbeats (
+	worker_id TEXT PRIMARY KEY,
+	last_run_at INTEGER NOT NULL
+);
+`
 
-	if _, err := db.Exec(createTradesQTable); err != nil {
-		log.Fatalf("Failed to create trades_q table: %v", err)
+// Индекс для подсчета и возраста необработанных сделок в /readyz
+const createTradesQStatusIndex = "CREATE INDEX trades_q_status_created_at ON trades_q (status, created_at)"
+
+// Изменения сделок: отмены и исправления с значениями до и после изменения.
+// prev_profit и profit - прибыль в валюте аккаунта до и после изменения,
+// заполняются, если сделка уже была учтена в статистике.
+const createTradeAmendmentsTable = `
+CREATE TABLE trade_amendments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	trade_id INTEGER NOT NULL REFERENCES trades_q (id),
+	action TEXT NOT NULL,
+	prev_status TEXT NOT NULL,
+	prev_volume REAL NOT NULL,
+	prev_open REAL NOT NULL,
+	prev_close REAL NOT NULL,
+	prev_side TEXT NOT NULL,
+	volume REAL NOT NULL,
+	open REAL NOT NULL,
+	close REAL NOT NULL,
+	side TEXT NOT NULL,
+	prev_profit REAL,
+	profit REAL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	failed_reason TEXT,
+	request_id TEXT NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL,
+	applied_at INTEGER
+);
+`
+
+// Теневые таблицы пересборки статистики: агрегаты, собранные заново из trades_q,
+// и пересчитанная прибыль сделок. Заменяют рабочие данные только после сравнения с ними.
+var createShadowTables = []string{`
+CREATE TABLE account_stats_shadow (
+	account TEXT PRIMARY KEY,
+	trades INTEGER DEFAULT 0,
+	profit REAL DEFAULT 0.0
+);
+`, `
+CREATE TABLE account_symbol_stats_shadow (
+	account TEXT NOT NULL,
+	symbol TEXT NOT NULL,
+	side TEXT NOT NULL,
+	trades INTEGER DEFAULT 0,
+	volume REAL DEFAULT 0.0,
+	gross_profit REAL DEFAULT 0.0,
+	gross_loss REAL DEFAULT 0.0,
+	wins INTEGER DEFAULT 0,
+	PRIMARY KEY (account, symbol, side)
+);
+`, `
+CREATE TABLE account_pnl_history_shadow (
+	account TEXT NOT NULL,
+	period TEXT NOT NULL,
+	bucket INTEGER NOT NULL,
+	trades INTEGER DEFAULT 0,
+	profit REAL DEFAULT 0.0,
+	PRIMARY KEY (account, period, bucket)
+);
+`, `
+CREATE TABLE trade_profits_shadow (
+	trade_id INTEGER PRIMARY KEY,
+	profit REAL NOT NULL,
+	quote_currency TEXT,
+	converted_profit REAL NOT NULL,
+	account_currency TEXT NOT NULL
+);
+`}
+
+// Исходная очередь сделок: только флаг processed без статусов и результатов
+const createBaselineTradesQTable = `
+CREATE TABLE trades_q (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	account TEXT NOT NULL,
+	symbol TEXT NOT NULL,
+	volume REAL NOT NULL,
+	open REAL NOT NULL,
+	close REAL NOT NULL,
+	side TEXT NOT NULL,
+	processed INTEGER DEFAULT 0
+);
+`
+
+// SQLite не добавляет колонки NOT NULL без константного значения по умолчанию,
+// поэтому trades_q пересоздается с переносом строк. Обработанные сделки получают
+// статус processed, время создания - время миграции.
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial",
+		Up:      []string{createBaselineTradesQTable, createAccountStatsTable},
+		Down:    []string{"DROP TABLE account_stats", "DROP TABLE trades_q"},
+	},
+	{
+		Version: 2,
+		Name:    "trade_status",
+		Up: []string{
+			"ALTER TABLE trades_q RENAME TO trades_q_old",
+			createTradesQTable,
+			`INSERT INTO trades_q (id, account, symbol, volume, open, close, side, status)
+			SELECT id, account, symbol, volume, open, close, side,
+				CASE processed WHEN 1 THEN 'processed' ELSE 'pending' END
+			FROM trades_q_old`,
+			"DROP TABLE trades_q_old",
+		},
+		Down: []string{
+			"ALTER TABLE trades_q RENAME TO trades_q_new",
+			createBaselineTradesQTable,
+			`INSERT INTO trades_q (id, account, symbol, volume, open, close, side, processed)
+			SELECT id, account, symbol, volume, open, close, side,
+				CASE status WHEN 'pending' THEN 0 ELSE 1 END
+			FROM trades_q_new`,
+			"DROP TABLE trades_q_new",
+		},
+	},
+	{
+		Version: 3,
+		Name:    "analytics_and_currencies",
+		Up: []string{
+			createAccountSymbolStatsTable,
+			createAccountPnlHistoryTable,
+			createInstrumentsTable,
+			createAccountsTable,
+			createFxRatesTable,
+		},
+		Down: []string{
+			"DROP TABLE fx_rates",
+			"DROP TABLE accounts",
+			"DROP TABLE instruments",
+			"DROP TABLE account_pnl_history",
+			"DROP TABLE account_symbol_stats",
+		},
+	},
+	{
+		Version: 4,
+		Name:    "readiness",
+		Up:      []string{createWorkerHeartbeatsTable, createTradesQStatusIndex},
+		Down:    []string{"DROP INDEX trades_q_status_created_at", "DROP TABLE worker_heartbeats"},
+	},
+	{
+		Version: 5,
+		Name:    "worker_status",
+		Up: []string{
+			"ALTER TABLE worker_heartbeats ADD COLUMN host TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE worker_heartbeats ADD COLUMN pid INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE worker_heartbeats ADD COLUMN started_at INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE worker_heartbeats ADD COLUMN last_batch_size INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE worker_heartbeats ADD COLUMN last_error TEXT",
+		},
+		Down: []string{
+			"ALTER TABLE worker_heartbeats DROP COLUMN last_error",
+			"ALTER TABLE worker_heartbeats DROP COLUMN last_batch_size",
+			"ALTER TABLE worker_heartbeats DROP COLUMN started_at",
+			"ALTER TABLE worker_heartbeats DROP COLUMN pid",
+			"ALTER TABLE worker_heartbeats DROP COLUMN host",
+		},
+	},
+	{
+		Version: 6,
+		Name:    "request_id",
+		Up: []string{
+			"ALTER TABLE trades_q ADD COLUMN request_id TEXT NOT NULL DEFAULT ''",
+		},
+		Down: []string{
+			"ALTER TABLE trades_q DROP COLUMN request_id",
+		},
+	},
+	{
+		Version: 7,
+		Name:    "trade_listing_indexes",
+		Up: []string{
+			"CREATE INDEX trades_q_account_id ON trades_q (account, id)",
+			"CREATE INDEX trades_q_symbol_id ON trades_q (symbol, id)",
+			"CREATE INDEX trades_q_status_id ON trades_q (status, id)",
+			"CREATE INDEX trades_q_created_at ON trades_q (created_at)",
+		},
+		Down: []string{
+			"DROP INDEX trades_q_created_at",
+			"DROP INDEX trades_q_status_id",
+			"DROP INDEX trades_q_symbol_id",
+			"DROP INDEX trades_q_account_id",
+		},
+	},
+	{
+		Version: 8,
+		Name:    "trade_amendments",
+		Up: []string{
+			createTradeAmendmentsTable,
+			"CREATE INDEX trade_amendments_trade_id ON trade_amendments (trade_id, id)",
+			"CREATE INDEX trade_amendments_status_id ON trade_amendments (status, id)",
+		},
+		Down: []string{"DROP TABLE trade_amendments"},
+	},
+	{
+		Version: 9,
+		Name:    "stats_rebuild",
+		Up:      createShadowTables,
+		Down: []string{
+			"DROP TABLE trade_profits_shadow",
+			"DROP TABLE account_pnl_history_shadow",
+			"DROP TABLE account_symbol_stats_shadow",
+			"DROP TABLE account_stats_shadow",
+		},
+	},
+}
+
+// SQLite - миграции схемы SQLite
+var SQLite = Schema{
+	Name:          "sqlite",
+	Migrations:    sqliteMigrations,
+	tableExists:   "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+	columnExists:  "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?",
+	insertVersion: "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+	deleteVersion: "DELETE FROM schema_migrations WHERE version = ?",
+	createTable: `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at INTEGER NOT NULL
+);
+`,
+}
+
+// InitDB настраивает подключение и применяет все миграции схемы SQLite.
+// Ошибки возвращаются как *InitError.
+func InitDB(db *sql.DB) error {
+	if err := ConfigureSQLite(db); err != nil {
+		return err
 	}
-	log.Println("Table trades_q created or already exists")
+	return migrate(db, SQLite)
+}
 
-	if _, err := db.Exec(createAccountStatsTable); err != nil {
-		log.Fatalf("Failed to create account_stats table: %v", err)
+// migrate применяет недостающие миграции схемы
+func migrate(db *sql.DB, schema Schema) error {
+	applied, err := NewMigrator(db, schema).Up(context.Background())
+	for _, migration := range applied {
+		slog.Info("applied migration", "version", migration.Version, "name", migration.Name)
+	}
+	if err != nil {
+		return &InitError{Step: "migrate", Err: err}
 	}
-	log.Println("Table account_stats created or already exists")
+	return nil
 }
@@ -1,3 +1,5 @@
+//go:build cgo
+
 package db
 
 import (
@@ -20,7 +22,9 @@ func TestInitDB(t *testing.T) {
 	}
 	defer db.Close()
 
-	InitDB(db)
+	if err := InitDB(db); err != nil {
+		t.Fatalf("Не удалось создать схему: %v", err)
+	}
 
 	tests := []struct {
 		name      string
@@ -44,13 +48,25 @@ func TestInitDB(t *testing.T) {
 				sqlLower := strings.ToLower(sql)
 				expectedColumns := []string{
 					"id integer primary key autoincrement",
+					"client_trade_id text unique",
 					"account text not null",
 					"symbol text not null",
 					"volume real not null",
 					"open real not null",
 					"close real not null",
 					"side text not null",
-					"processed integer default 0",
+					"open_time integer",
+					"close_time integer",
+					"created_at integer not null default",
+					"status text not null default 'pending'",
+					"attempts integer not null default 0",
+					"failed_reason text",
+					"worker_id text",
+					"lease_expires_at integer",
+					"profit real",
+					"quote_currency text",
+					"converted_profit real",
+					"account_currency text",
 				}
 				for _, col := range expectedColumns {
 					if !containsIgnoreCase(sqlLower, col) {
@@ -86,6 +102,113 @@ func TestInitDB(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:  "проверка создания таблицы account_symbol_stats",
+			query: "SELECT name, sql FROM sqlite_master WHERE type='table' AND name='account_symbol_stats'",
+			checkFunc: func(t *testing.T, rows *sql.Rows) {
+				if !rows.Next() {
+					t.Fatal("Таблица account_symbol_stats не создана")
+				}
+				var name, sql string
+				if err := rows.Scan(&name, &sql); err != nil {
+					t.Fatalf("Ошибка при чтении результата: %v", err)
+				}
+				expectedColumns := []string{
+					"account text not null",
+					"symbol text not null",
+					"side text not null",
+					"trades integer default 0",
+					"volume real default 0.0",
+					"gross_profit real default 0.0",
+					"gross_loss real default 0.0",
+					"wins integer default 0",
+					"primary key (account, symbol, side)",
+				}
+				for _, col := range expectedColumns {
+					if !containsIgnoreCase(sql, col) {
+						t.Errorf("Ожидался столбец %s в определении таблицы, но не найден", col)
+					}
+				}
+			},
+		},
+		{
+			name:  "проверка создания таблицы account_pnl_history",
+			query: "SELECT name, sql FROM sqlite_master WHERE type='table' AND name='account_pnl_history'",
+			checkFunc: func(t *testing.T, rows *sql.Rows) {
+				if !rows.Next() {
+					t.Fatal("Таблица account_pnl_history не создана")
+				}
+				var name, sql string
+				if err := rows.Scan(&name, &sql); err != nil {
+					t.Fatalf("Ошибка при чтении результата: %v", err)
+				}
+				expectedColumns := []string{
+					"account text not null",
+					"period text not null",
+					"bucket integer not null",
+					"trades integer default 0",
+					"profit real default 0.0",
+					"primary key (account, period, bucket)",
+				}
+				for _, col := range expectedColumns {
+					if !containsIgnoreCase(sql, col) {
+						t.Errorf("Ожидался столбец %s в определении таблицы, но не найден", col)
+					}
+				}
+			},
+		},
+		{
+			name:  "проверка создания таблицы instruments",
+			query: "SELECT name, sql FROM sqlite_master WHERE type='table' AND name='instruments'",
+			checkFunc: func(t *testing.T, rows *sql.Rows) {
+				if !rows.Next() {
+					t.Fatal("Таблица instruments не создана")
+				}
+				var name, sql string
+				if err := rows.Scan(&name, &sql); err != nil {
+					t.Fatalf("Ошибка при чтении результата: %v", err)
+				}
+				sqlLower := strings.ToLower(sql)
+				expectedColumns := []string{
+					"symbol text primary key",
+					"contract_size real not null",
+					"pip_size real not null",
+					"quote_currency text not null",
+					"precision integer not null",
+				}
+				for _, col := range expectedColumns {
+					if !containsIgnoreCase(sqlLower, col) {
+						t.Errorf("Ожидался столбец %s в определении таблицы, но не найден", col)
+					}
+				}
+			},
+		},
+		{
+			name:  "проверка создания таблиц accounts и fx_rates",
+			query: "SELECT name, sql FROM sqlite_master WHERE type='table' AND name IN ('accounts', 'fx_rates') ORDER BY name",
+			checkFunc: func(t *testing.T, rows *sql.Rows) {
+				expected := map[string][]string{
+					"accounts": {"account text primary key", "currency text not null default 'usd'"},
+					"fx_rates": {"base text not null", "quote text not null", "rate real not null", "primary key (base, quote)"},
+				}
+				found := 0
+				for rows.Next() {
+					var name, sql string
+					if err := rows.Scan(&name, &sql); err != nil {
+						t.Fatalf("Ошибка при чтении результата: %v", err)
+					}
+					found++
+					for _, col := range expected[name] {
+						if !containsIgnoreCase(sql, col) {
+							t.Errorf("Ожидался столбец %s в определении таблицы %s, но не найден", col, name)
+						}
+					}
+				}
+				if found != len(expected) {
+					t.Errorf("Ожидалось %d таблиц, найдено %d", len(expected), found)
+				}
+			},
+		},
 		{
 			name:  "проверка PRAGMA journal_mode",
 			query: "PRAGMA journal_mode",
@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("json with request id", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := New(&buf, FormatJSON, "info")
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		ctx := WithRequestID(context.Background(), "req-1")
+		logger.With("component", "test").InfoContext(ctx, "trade enqueued", "trade_id", 7)
+		logger.DebugContext(ctx, "hidden")
+
+		var entry map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("Expected one JSON line, got %q: %v", buf.String(), err)
+		}
+		if entry["msg"] != "trade enqueued" || entry["request_id"] != "req-1" || entry["trade_id"] != float64(7) ||
+			entry["component"] != "test" || entry["level"] != "INFO" {
+			t.Errorf("Unexpected entry %v", entry)
+		}
+	})
+
+	t.Run("text without request id", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger, err := New(&buf, FormatText, "debug")
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		logger.Debug("worker started", "worker_id", "w1")
+		out := buf.String()
+		if !strings.Contains(out, `msg="worker started" worker_id=w1`) || strings.Contains(out, "request_id") {
+			t.Errorf("Unexpected output %q", out)
+		}
+	})
+
+	t.Run("invalid flags", func(t *testing.T) {
+		if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+			t.Error("Expected error for unknown format")
+		}
+		if _, err := New(&bytes.Buffer{}, FormatText, "verbose"); err == nil {
+			t.Error("Expected error for unknown level")
+		}
+	})
+}
@@ -0,0 +1,359 @@
+// Package metrics - минимальная реализация метрик в текстовом формате Prometheus
+// (https://prometheus.io/docs/instrumenting/exposition_formats/) без внешних зависимостей.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets - границы гистограмм длительности в секундах
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry хранит метрики и выводит их в текстовом формате
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// metric - семейство метрик с общим именем
+type metric interface {
+	header() (name, help, kind string)
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	name, _, _ := m.header()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo выводит все метрики в порядке регистрации
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		name, help, kind := m.header()
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, kind)
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler отдает метрики по HTTP
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// vec - значения метрики по наборам меток
+type vec[T any] struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*series[T]
+}
+
+type series[T any] struct {
+	labelValues []string
+	value       T
+}
+
+func newVec[T any](name, help string, labels []string) vec[T] {
+	return vec[T]{name: name, help: help, labels: labels, values: make(map[string]*series[T])}
+}
+
+// with возвращает значение для набора меток, создавая его при первом обращении.
+// Ряд метрики без меток создается при регистрации, чтобы она выводилась с нулем.
+// Вызывающий держит v.mu.
+func (v *vec[T]) with(labelValues []string, init func() T) *series[T] {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &series[T]{labelValues: append([]string(nil), labelValues...), value: init()}
+		v.values[key] = s
+	}
+	return s
+}
+
+// sorted возвращает значения в порядке меток, чтобы вывод был стабильным. Вызывающий держит v.mu.
+func (v *vec[T]) sorted() []*series[T] {
+	list := make([]*series[T], 0, len(v.values))
+	for _, s := range v.values {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].labelValues, "\xff") < strings.Join(list[j].labelValues, "\xff")
+	})
+	return list
+}
+
+// Counter - монотонно растущий счетчик
+type Counter struct {
+	vec[float64]
+}
+
+// NewCounter регистрирует счетчик с метками labels
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec[float64](name, help, labels)}
+	if len(labels) == 0 {
+		c.with(nil, func() float64 { return 0 })
+	}
+	r.register(c)
+	return c
+}
+
+// Inc увеличивает счетчик на 1
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add увеличивает счетчик на v >= 0
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.name))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.with(labelValues, func() float64 { return 0 }).value += v
+}
+
+// Value возвращает текущее значение счетчика
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *Counter) header() (string, string, string) {
+	return c.name, c.help, "counter"
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.sorted() {
+		writeSample(w, c.name, c.labels, s.labelValues, "", "", s.value)
+	}
+}
+
+// Gauge - значение, которое может расти и уменьшаться
+type Gauge struct {
+	vec[float64]
+}
+
+// NewGauge регистрирует индикатор с метками labels
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec[float64](name, help, labels)}
+	if len(labels) == 0 {
+		g.with(nil, func() float64 { return 0 })
+	}
+	r.register(g)
+	return g
+}
+
+// Set задает значение индикатора
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.with(labelValues, func() float64 { return 0 }).value = v
+}
+
+func (g *Gauge) header() (string, string, string) {
+	return g.name, g.help, "gauge"
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, s := range g.sorted() {
+		writeSample(w, g.name, g.labels, s.labelValues, "", "", s.value)
+	}
+}
+
+// gaugeFunc - индикатор без меток, значение которого вычисляется при каждом выводе
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc регистрирует индикатор, значение которого возвращает fn при каждом выводе
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) header() (string, string, string) {
+	return g.name, g.help, "gauge"
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	writeSample(w, g.name, nil, nil, "", "", g.fn())
+}
+
+// Histogram - распределение наблюдений по корзинам
+type Histogram struct {
+	vec[*histogramValue]
+	buckets []float64
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram регистрирует гистограмму с возрастающими границами корзин buckets
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: %s buckets must be sorted", name))
+	}
+	h := &Histogram{vec: newVec[*histogramValue](name, help, labels), buckets: buckets}
+	if len(labels) == 0 {
+		h.with(nil, h.newValue)
+	}
+	r.register(h)
+	return h
+}
+
+// Observe добавляет наблюдение v
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value := h.with(labelValues, h.newValue).value
+	for i, upper := range h.buckets {
+		if v <= upper {
+			value.counts[i]++
+		}
+	}
+	value.sum += v
+	value.count++
+}
+
+func (h *Histogram) newValue() *histogramValue {
+	return &histogramValue{counts: make([]uint64, len(h.buckets))}
+}
+
+// Count возвращает количество наблюдений
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[strings.Join(labelValues, "\xff")]
+	if !ok {
+		return 0
+	}
+	return s.value.count
+}
+
+func (h *Histogram) header() (string, string, string) {
+	return h.name, h.help, "histogram"
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.sorted() {
+		for i, upper := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", formatFloat(upper), float64(s.value.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", "+Inf", float64(s.value.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, "", "", s.value.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, "", "", float64(s.value.count))
+	}
+}
+
+// writeSample выводит строку "name{labels} value"; extraName/extraValue - дополнительная метка (le)
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(values[i]))
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounter("requests_total", "Requests by route.", "route", "status")
+	requests.Inc("/b", "200")
+	requests.Inc("/a", "200")
+	requests.Add(2, "/a", "200")
+	requests.Inc("/a", `5"0\0`)
+	depth := reg.NewGauge("queue_depth", "Queue depth.")
+	depth.Set(7)
+	reg.NewGaugeFunc("up", "Computed\nvalue.", func() float64 { return math.NaN() })
+	latency := reg.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.5, "/a")
+	latency.Observe(3, "/a")
+	reg.NewCounter("errors_total", "Never incremented.")
+
+	var b strings.Builder
+	n, err := reg.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if int(n) != b.Len() {
+		t.Errorf("Expected %d bytes written, got %d", b.Len(), n)
+	}
+
+	expected := `# HELP requests_total Requests by route.
+# TYPE requests_total counter
+requests_total{route="/a",status="200"} 3
+requests_total{route="/a",status="5\"0\\0"} 1
+requests_total{route="/b",status="200"} 1
+# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth 7
+# HELP up Computed\nvalue.
+# TYPE up gauge
+up NaN
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 1
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 3.55
+latency_seconds_count{route="/a"} 3
+# HELP errors_total Never incremented.
+# TYPE errors_total counter
+errors_total 0
+`
+	if got := b.String(); got != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", got, expected)
+	}
+	if v := requests.Value("/a", "200"); v != 3 {
+		t.Errorf("Expected counter value 3, got %v", v)
+	}
+	if c := latency.Count("/a"); c != 3 {
+		t.Errorf("Expected 3 observations, got %d", c)
+	}
+}
+
+func TestRegistry_Panics(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(reg *Registry)
+	}{
+		{"duplicate name", func(reg *Registry) {
+			reg.NewCounter("x_total", "")
+			reg.NewGauge("x_total", "")
+		}},
+		{"wrong label count", func(reg *Registry) {
+			reg.NewCounter("x_total", "", "a").Inc()
+		}},
+		{"negative counter", func(reg *Registry) {
+			reg.NewCounter("x_total", "").Add(-1)
+		}},
+		{"unsorted buckets", func(reg *Registry) {
+			reg.NewHistogram("x_seconds", "", []float64{1, 0.5})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected panic")
+				}
+			}()
+			tt.fn(NewRegistry())
+		})
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("hits_total", "Hits.").Inc()
+
+	rr := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+	if !strings.Contains(rr.Body.String(), "hits_total 1\n") {
+		t.Errorf("Expected hits_total in body, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,169 @@
+package model
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultAccountCurrency - валюта аккаунта, для которого она не задана явно
+const DefaultAccountCurrency = "USD"
+
+// crossCurrency используется для кросс-курса, если прямого курса нет
+const crossCurrency = "USD"
+
+// Rate - курс обмена: 1 единица Base стоит Rate единиц Quote
+type Rate struct {
+	Base  string  `json:"base"`
+	Quote string  `json:"quote"`
+	Rate  float64 `json:"rate"`
+}
+
+func ValidateCurrency(currency string) error {
+	if !currencyRegex.MatchString(currency) {
+		return fmt.Errorf("currency must match ^[A-Z]{3}$")
+	}
+	return nil
+}
+
+func ValidateRate(rate Rate) error {
+	if !currencyRegex.MatchString(rate.Base) {
+		return fmt.Errorf("base must match ^[A-Z]{3}$")
+	}
+	if !currencyRegex.MatchString(rate.Quote) {
+		return fmt.Errorf("quote must match ^[A-Z]{3}$")
+	}
+	if rate.Base == rate.Quote {
+		return fmt.Errorf("base and quote must differ")
+	}
+	if rate.Rate <= 0 {
+		return fmt.Errorf("rate must be greater than 0")
+	}
+	return nil
+}
+
+// Rates - таблица курсов по паре валют
+type Rates map[[2]string]float64
+
+func NewRates(list []Rate) Rates {
+	rates := make(Rates, len(list))
+	for _, r := range list {
+		rates[[2]string{r.Base, r.Quote}] = r.Rate
+	}
+	return rates
+}
+
+// Convert переводит сумму из одной валюты в другую по прямому, обратному
+// или кросс-курсу через USD
+func (r Rates) Convert(amount float64, from, to string) (float64, error) {
+	rate, ok := r.rate(from, to)
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s/%s", from, to)
+	}
+	return amount * rate, nil
+}
+
+func (r Rates) rate(from, to string) (float64, bool) {
+	if direct, ok := r.direct(from, to); ok {
+		return direct, true
+	}
+	fromCross, ok := r.direct(from, crossCurrency)
+	if !ok {
+		return 0, false
+	}
+	crossTo, ok := r.direct(crossCurrency, to)
+	if !ok {
+		return 0, false
+	}
+	return fromCross * crossTo, true
+}
+
+func (r Rates) direct(from, to string) (float64, bool) {
+	if from == to {
+		return 1, true
+	}
+	if rate, ok := r[[2]string{from, to}]; ok {
+		return rate, true
+	}
+	if rate, ok := r[[2]string{to, from}]; ok {
+		return 1 / rate, true
+	}
+	return 0, false
+}
+
+// LoadRatesFile читает курсы из JSON (массив объектов) или CSV-файла
+// (с заголовком base,quote,rate). Формат определяется по расширению файла.
+func LoadRatesFile(path string) ([]Rate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rates file: %v", err)
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return LoadRatesJSON(f)
+	case ".csv":
+		return LoadRatesCSV(f)
+	default:
+		return nil, fmt.Errorf("unsupported rates file format %q", filepath.Ext(path))
+	}
+}
+
+func LoadRatesJSON(r io.Reader) ([]Rate, error) {
+	var rates []Rate
+	if err := json.NewDecoder(r).Decode(&rates); err != nil {
+		return nil, fmt.Errorf("failed to decode rates: %v", err)
+	}
+	for i, rate := range rates {
+		if err := ValidateRate(rate); err != nil {
+			return nil, fmt.Errorf("rate %d: %v", i, err)
+		}
+	}
+	return rates, nil
+}
+
+var rateCSVHeader = []string{"base", "quote", "rate"}
+
+func LoadRatesCSV(r io.Reader) ([]Rate, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = len(rateCSVHeader)
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rates header: %v", err)
+	}
+	for i, name := range rateCSVHeader {
+		if strings.ToLower(strings.TrimSpace(header[i])) != name {
+			return nil, fmt.Errorf("unexpected rates header, want %s", strings.Join(rateCSVHeader, ","))
+		}
+	}
+
+	var rates []Rate
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rates: %v", err)
+		}
+
+		value, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid rate %q", line, record[2])
+		}
+		rate := Rate{Base: record[0], Quote: record[1], Rate: value}
+		if err := ValidateRate(rate); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRatesConvert(t *testing.T) {
+	rates := NewRates([]Rate{
+		{Base: "USD", Quote: "JPY", Rate: 150},
+		{Base: "EUR", Quote: "USD", Rate: 1.1},
+	})
+
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		want    float64
+		wantErr bool
+	}{
+		{name: "same currency", from: "USD", to: "USD", want: 300},
+		{name: "direct", from: "USD", to: "JPY", want: 45000},
+		{name: "inverse", from: "JPY", to: "USD", want: 2},
+		{name: "cross via USD", from: "JPY", to: "EUR", want: 300.0 / 150 / 1.1},
+		{name: "missing rate", from: "GBP", to: "USD", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rates.Convert(300, tt.from, tt.to)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Convert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Convert() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   Rate
+		errMsg string
+	}{
+		{name: "valid", rate: Rate{Base: "EUR", Quote: "USD", Rate: 1.1}},
+		{name: "invalid base", rate: Rate{Base: "eur", Quote: "USD", Rate: 1.1}, errMsg: "base must match ^[A-Z]{3}$"},
+		{name: "same currencies", rate: Rate{Base: "USD", Quote: "USD", Rate: 1}, errMsg: "base and quote must differ"},
+		{name: "zero rate", rate: Rate{Base: "EUR", Quote: "USD"}, errMsg: "rate must be greater than 0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRate(tt.rate)
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Errorf("ValidateRate() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.errMsg {
+				t.Errorf("ValidateRate() error = %v, want %q", err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestLoadRatesFile(t *testing.T) {
+	dir := t.TempDir()
+
+	csvPath := filepath.Join(dir, "rates.csv")
+	os.WriteFile(csvPath, []byte("base,quote,rate\nUSD,JPY,150.5\nEUR,USD,1.08\n"), 0o644)
+	rates, err := LoadRatesFile(csvPath)
+	if err != nil {
+		t.Fatalf("LoadRatesFile(csv) error: %v", err)
+	}
+	if len(rates) != 2 || rates[0] != (Rate{Base: "USD", Quote: "JPY", Rate: 150.5}) {
+		t.Errorf("Unexpected rates: %+v", rates)
+	}
+
+	jsonPath := filepath.Join(dir, "rates.json")
+	os.WriteFile(jsonPath, []byte(`[{"base":"GBP","quote":"USD","rate":0}]`), 0o644)
+	if _, err := LoadRatesFile(jsonPath); err == nil {
+		t.Error("Expected error for zero rate")
+	}
+}
@@ -0,0 +1,210 @@
+package model
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultContractSize - размер контракта для инструментов, отсутствующих в реестре
+const DefaultContractSize = 100000.0
+
+// Instrument описывает параметры торгового инструмента. PipSize - справочный
+// размер пипса для клиентов реестра, необязателен (0 - не задан).
+type Instrument struct {
+	Symbol        string  `json:"symbol"`
+	ContractSize  float64 `json:"contract_size"`
+	PipSize       float64 `json:"pip_size"`
+	QuoteCurrency string  `json:"quote_currency"`
+	// Precision - количество знаков после запятой в цене (размер тика)
+	Precision int `json:"precision"`
+}
+
+var currencyRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+func ValidateInstrument(ins Instrument) error {
+	if !symbolRegex.MatchString(ins.Symbol) {
+		return fmt.Errorf("symbol must match ^[A-Za-z0-9._]{1,16}$")
+	}
+	if ins.ContractSize <= 0 {
+		return fmt.Errorf("contract_size must be greater than 0")
+	}
+	if ins.PipSize < 0 {
+		return fmt.Errorf("pip_size must not be negative")
+	}
+	if !currencyRegex.MatchString(ins.QuoteCurrency) {
+		return fmt.Errorf("quote_currency must match ^[A-Z]{3}$")
+	}
+	if ins.Precision < 0 || ins.Precision > 10 {
+		return fmt.Errorf("precision must be between 0 and 10")
+	}
+	return nil
+}
+
+// Instruments - реестр инструментов по символу.
+// Пустой реестр означает, что реестр не настроен: допускаются любые валютные пары
+// (^[A-Z]{6}$), а размер контракта равен DefaultContractSize.
+type Instruments map[string]Instrument
+
+// ContractSize возвращает размер контракта для символа
+func (ins Instruments) ContractSize(symbol string) float64 {
+	if instrument, ok := ins[symbol]; ok {
+		return instrument.ContractSize
+	}
+	return DefaultContractSize
+}
+
+// QuoteCurrency возвращает валюту котировки символа. Для символов вне реестра
+// валютой котировки считаются последние три буквы валютной пары.
+func (ins Instruments) QuoteCurrency(symbol string) string {
+	if instrument, ok := ins[symbol]; ok {
+		return instrument.QuoteCurrency
+	}
+	if currencyPairRegex.MatchString(symbol) {
+		return symbol[3:]
+	}
+	return ""
+}
+
+// Known сообщает, можно ли торговать символом с этим реестром
+func (ins Instruments) Known(symbol string) bool {
+	if len(ins) == 0 {
+		return true
+	}
+	_, ok := ins[symbol]
+	return ok
+}
+
+// ValidateTrade дополняет model.ValidateTrade проверками по реестру:
+// символ должен быть известен, а цены - кратны размеру тика инструмента.
+// Пока реестр пуст, символ должен быть валютной парой.
+func (ins Instruments) ValidateTrade(trade Trade) error {
+	if err := ValidateTrade(trade); err != nil {
+		return err
+	}
+	if len(ins) == 0 && !currencyPairRegex.MatchString(trade.Symbol) {
+		return invalid("symbol", "symbol must match ^[A-Z]{6}$ while the instrument registry is empty")
+	}
+	if !ins.Known(trade.Symbol) {
+		return invalid("unknown_symbol", "unknown symbol %s", trade.Symbol)
+	}
+	instrument, ok := ins[trade.Symbol]
+	if !ok {
+		return nil
+	}
+	if !hasPrecision(trade.Open, instrument.Precision) {
+		return invalid("open_precision", "open must have at most %d decimal places", instrument.Precision)
+	}
+	if !hasPrecision(trade.Close, instrument.Precision) {
+		return invalid("close_precision", "close must have at most %d decimal places", instrument.Precision)
+	}
+	return nil
+}
+
+func hasPrecision(price float64, precision int) bool {
+	scaled := price * math.Pow(10, float64(precision))
+	return math.Abs(scaled-math.Round(scaled)) < 1e-6
+}
+
+// LoadInstrumentsFile читает реестр инструментов из JSON (массив объектов)
+// или CSV-файла (с заголовком symbol,contract_size,pip_size,quote_currency,precision).
+// Формат определяется по расширению файла.
+func LoadInstrumentsFile(path string) ([]Instrument, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open instruments file: %v", err)
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return LoadInstrumentsJSON(f)
+	case ".csv":
+		return LoadInstrumentsCSV(f)
+	default:
+		return nil, fmt.Errorf("unsupported instruments file format %q", filepath.Ext(path))
+	}
+}
+
+func LoadInstrumentsJSON(r io.Reader) ([]Instrument, error) {
+	var instruments []Instrument
+	if err := json.NewDecoder(r).Decode(&instruments); err != nil {
+		return nil, fmt.Errorf("failed to decode instruments: %v", err)
+	}
+	for i, instrument := range instruments {
+		if err := ValidateInstrument(instrument); err != nil {
+			return nil, fmt.Errorf("instrument %d: %v", i, err)
+		}
+	}
+	return instruments, nil
+}
+
+var instrumentCSVHeader = []string{"symbol", "contract_size", "pip_size", "quote_currency", "precision"}
+
+func LoadInstrumentsCSV(r io.Reader) ([]Instrument, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = len(instrumentCSVHeader)
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read instruments header: %v", err)
+	}
+	for i, name := range instrumentCSVHeader {
+		if strings.ToLower(strings.TrimSpace(header[i])) != name {
+			return nil, fmt.Errorf("unexpected instruments header, want %s", strings.Join(instrumentCSVHeader, ","))
+		}
+	}
+
+	var instruments []Instrument
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read instruments: %v", err)
+		}
+
+		instrument, err := parseInstrumentRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := ValidateInstrument(instrument); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		instruments = append(instruments, instrument)
+	}
+	return instruments, nil
+}
+
+func parseInstrumentRecord(record []string) (Instrument, error) {
+	contractSize, err := strconv.ParseFloat(record[1], 64)
+	if err != nil {
+		return Instrument{}, fmt.Errorf("invalid contract_size %q", record[1])
+	}
+	var pipSize float64
+	if record[2] != "" {
+		if pipSize, err = strconv.ParseFloat(record[2], 64); err != nil {
+			return Instrument{}, fmt.Errorf("invalid pip_size %q", record[2])
+		}
+	}
+	precision, err := strconv.Atoi(record[4])
+	if err != nil {
+		return Instrument{}, fmt.Errorf("invalid precision %q", record[4])
+	}
+	return Instrument{
+		Symbol:        record[0],
+		ContractSize:  contractSize,
+		PipSize:       pipSize,
+		QuoteCurrency: record[3],
+		Precision:     precision,
+	}, nil
+}
@@ -0,0 +1,126 @@
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstrumentsValidateTrade(t *testing.T) {
+	registry := Instruments{
+		"XAUUSD": {Symbol: "XAUUSD", ContractSize: 100, PipSize: 0.01, QuoteCurrency: "USD", Precision: 2},
+	}
+	trade := Trade{Account: "ACC1", Symbol: "XAUUSD", Volume: 1, Open: 2300.15, Close: 2310.5, Side: "buy"}
+
+	tests := []struct {
+		name     string
+		registry Instruments
+		trade    func(Trade) Trade
+		errMsg   string
+		reason   string
+	}{
+		{name: "known symbol", registry: registry, trade: func(tr Trade) Trade { return tr }},
+		{name: "empty registry allows currency pairs", registry: Instruments{}, trade: func(tr Trade) Trade { tr.Symbol = "EURUSD"; return tr }},
+		{name: "empty registry rejects other symbols", registry: Instruments{}, trade: func(tr Trade) Trade { tr.Symbol = "US30"; return tr }, errMsg: "symbol must match ^[A-Z]{6}$ while the instrument registry is empty", reason: "symbol"},
+		{name: "registry decides symbols", registry: Instruments{"US30": {Symbol: "US30", ContractSize: 1, QuoteCurrency: "USD", Precision: 1}}, trade: func(tr Trade) Trade { tr.Symbol = "US30"; tr.Open = 39000.5; tr.Close = 39100; return tr }},
+		{name: "unknown symbol", registry: registry, trade: func(tr Trade) Trade { tr.Symbol = "EURUSD"; return tr }, errMsg: "unknown symbol EURUSD", reason: "unknown_symbol"},
+		{name: "open too precise", registry: registry, trade: func(tr Trade) Trade { tr.Open = 2300.155; return tr }, errMsg: "open must have at most 2 decimal places", reason: "open_precision"},
+		{name: "close too precise", registry: registry, trade: func(tr Trade) Trade { tr.Close = 2310.501; return tr }, errMsg: "close must have at most 2 decimal places", reason: "close_precision"},
+		{name: "base validation first", registry: registry, trade: func(tr Trade) Trade { tr.Side = "hold"; return tr }, errMsg: "side must be either 'buy' or 'sell'", reason: "side"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.registry.ValidateTrade(tt.trade(trade))
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Errorf("ValidateTrade() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.errMsg {
+				t.Errorf("ValidateTrade() error = %v, want %q", err, tt.errMsg)
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) || verr.Reason != tt.reason {
+				t.Errorf("ValidateTrade() reason = %v, want %q", verr, tt.reason)
+			}
+		})
+	}
+}
+
+func TestInstrumentsContractSize(t *testing.T) {
+	registry := Instruments{"XAUUSD": {Symbol: "XAUUSD", ContractSize: 100}}
+	if got := registry.ContractSize("XAUUSD"); got != 100 {
+		t.Errorf("ContractSize(XAUUSD) = %v, want 100", got)
+	}
+	if got := registry.ContractSize("EURUSD"); got != DefaultContractSize {
+		t.Errorf("ContractSize(EURUSD) = %v, want %v", got, DefaultContractSize)
+	}
+}
+
+func TestLoadInstrumentsFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	t.Run("json", func(t *testing.T) {
+		path := write("instruments.json", `[
+			{"symbol":"USDJPY","contract_size":100000,"pip_size":0.01,"quote_currency":"JPY","precision":3},
+			{"symbol":"XAUUSD","contract_size":100,"pip_size":0.01,"quote_currency":"USD","precision":2}
+		]`)
+		instruments, err := LoadInstrumentsFile(path)
+		if err != nil {
+			t.Fatalf("LoadInstrumentsFile() error: %v", err)
+		}
+		if len(instruments) != 2 || instruments[0].QuoteCurrency != "JPY" || instruments[1].ContractSize != 100 {
+			t.Errorf("Unexpected instruments: %+v", instruments)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		path := write("instruments.csv", "symbol,contract_size,pip_size,quote_currency,precision\nEURUSD,100000,0.0001,USD,5\n")
+		instruments, err := LoadInstrumentsFile(path)
+		if err != nil {
+			t.Fatalf("LoadInstrumentsFile() error: %v", err)
+		}
+		want := Instrument{Symbol: "EURUSD", ContractSize: 100000, PipSize: 0.0001, QuoteCurrency: "USD", Precision: 5}
+		if len(instruments) != 1 || instruments[0] != want {
+			t.Errorf("Unexpected instruments: %+v", instruments)
+		}
+	})
+
+	t.Run("csv index without pip size", func(t *testing.T) {
+		path := write("indices.csv", "symbol,contract_size,pip_size,quote_currency,precision\nGER40,1,,EUR,1\nEURUSDm,100000,0.0001,USD,5\n")
+		instruments, err := LoadInstrumentsFile(path)
+		if err != nil {
+			t.Fatalf("LoadInstrumentsFile() error: %v", err)
+		}
+		want := Instrument{Symbol: "GER40", ContractSize: 1, QuoteCurrency: "EUR", Precision: 1}
+		if len(instruments) != 2 || instruments[0] != want || instruments[1].Symbol != "EURUSDm" {
+			t.Errorf("Unexpected instruments: %+v", instruments)
+		}
+	})
+
+	t.Run("csv invalid instrument", func(t *testing.T) {
+		path := write("bad.csv", "symbol,contract_size,pip_size,quote_currency,precision\nEURUSD,0,0.0001,USD,5\n")
+		_, err := LoadInstrumentsFile(path)
+		if err == nil || !strings.Contains(err.Error(), "line 2: contract_size must be greater than 0") {
+			t.Errorf("Expected contract_size error, got %v", err)
+		}
+	})
+
+	t.Run("unsupported format", func(t *testing.T) {
+		path := write("instruments.txt", "")
+		if _, err := LoadInstrumentsFile(path); err == nil {
+			t.Error("Expected error for unsupported format")
+		}
+	})
+}
@@ -3,37 +3,117 @@ package model
 import (
 	"fmt"
 	"regexp"
+	"time"
 )
 
 type Trade struct {
-	Account string  `json:"account"`
-	Symbol  string  `json:"symbol"`
-	Volume  float64 `json:"volume"`
-	Open    float64 `json:"open"`
-	Close   float64 `json:"close"`
-	Side    string  `json:"side"`
+	// ClientTradeID - необязательный идентификатор сделки на стороне клиента,
+	// используется для идемпотентной постановки в очередь
+	ClientTradeID string  `json:"client_trade_id,omitempty"`
+	Account       string  `json:"account"`
+	Symbol        string  `json:"symbol"`
+	Volume        float64 `json:"volume"`
+	Open          float64 `json:"open"`
+	Close         float64 `json:"close"`
+	Side          string  `json:"side"`
+	// Необязательное время открытия и закрытия сделки
+	OpenTime  *time.Time `json:"open_time,omitempty"`
+	CloseTime *time.Time `json:"close_time,omitempty"`
+	// RequestID - идентификатор HTTP-запроса, поставившего сделку в очередь,
+	// по нему сделку можно найти в логах сервера и воркера
+	RequestID string `json:"-"`
 }
 
-var symbolRegex = regexp.MustCompile(`^[A-Z]{6}$`)
+// Статусы сделки в очереди trades_q
+const (
+	StatusPending   = "pending"
+	StatusProcessed = "processed"
+	// Сделка не может быть обработана и ожидает решения администратора
+	StatusFailed = "failed"
+	// Сделка из dead-letter, отброшенная администратором
+	StatusDiscarded = "discarded"
+	// Сделка отменена клиентом (DELETE /trades/{id})
+	StatusCancelled = "cancelled"
+)
+
+// Изменения поставленной сделки в trade_amendments
+const (
+	AmendmentCancel  = "cancel"
+	AmendmentCorrect = "correct"
+	// Статус изменения, учтенного в статистике; до этого изменение в статусе pending,
+	// а после исчерпания попыток - failed
+	AmendmentApplied = "applied"
+)
+
+// MaxClientTradeIDLength - максимальная длина client_trade_id и заголовка Idempotency-Key
+const MaxClientTradeIDLength = 64
+
+// symbolRegex - допустимый синтаксис символа (US30, GER40, EURUSDm, BRK.B). Какие символы
+// торгуются, решает реестр инструментов, а без него - currencyPairRegex.
+var symbolRegex = regexp.MustCompile(`^[A-Za-z0-9._]{1,16}$`)
+
+// currencyPairRegex - символ валютной пары, допустимый, пока реестр инструментов пуст
+var currencyPairRegex = regexp.MustCompile(`^[A-Z]{6}$`)
+
+// SameOrder сообщает, описывают ли две сделки одну и ту же заявку (без учета ClientTradeID)
+func (t Trade) SameOrder(other Trade) bool {
+	return t.Account == other.Account &&
+		t.Symbol == other.Symbol &&
+		t.Volume == other.Volume &&
+		t.Open == other.Open &&
+		t.Close == other.Close &&
+		t.Side == other.Side &&
+		sameTime(t.OpenTime, other.OpenTime) &&
+		sameTime(t.CloseTime, other.CloseTime)
+}
+
+// sameTime сравнивает время с точностью до секунды, с которой оно хранится в очереди
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Unix() == b.Unix()
+}
+
+// ValidationError - ошибка проверки сделки. Reason - короткая причина для метрик,
+// Error возвращает сообщение для клиента.
+type ValidationError struct {
+	Reason  string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func invalid(reason, format string, args ...any) error {
+	return &ValidationError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
 
 func ValidateTrade(trade Trade) error {
+	if len(trade.ClientTradeID) > MaxClientTradeIDLength {
+		return invalid("client_trade_id", "client_trade_id must not exceed %d characters", MaxClientTradeIDLength)
+	}
 	if trade.Account == "" {
-		return fmt.Errorf("account must not be empty")
+		return invalid("account", "account must not be empty")
 	}
 	if !symbolRegex.MatchString(trade.Symbol) {
-		return fmt.Errorf("symbol must match ^[A-Z]{6}$")
+		return invalid("symbol", "symbol must match ^[A-Za-z0-9._]{1,16}$")
 	}
 	if trade.Volume <= 0 {
-		return fmt.Errorf("volume must be greater than 0")
+		return invalid("volume", "volume must be greater than 0")
 	}
 	if trade.Open <= 0 {
-		return fmt.Errorf("open must be greater than 0")
+		return invalid("open", "open must be greater than 0")
 	}
 	if trade.Close <= 0 {
-		return fmt.Errorf("close must be greater than 0")
+		return invalid("close", "close must be greater than 0")
 	}
 	if trade.Side != "buy" && trade.Side != "sell" {
-		return fmt.Errorf("side must be either 'buy' or 'sell'")
+		return invalid("side", "side must be either 'buy' or 'sell'")
+	}
+	if trade.OpenTime != nil && trade.CloseTime != nil && trade.CloseTime.Before(*trade.OpenTime) {
+		return invalid("close_time", "close_time must not be before open_time")
 	}
 	return nil
 }
@@ -1,10 +1,15 @@
 package model
 
 import (
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestValidateTrade(t *testing.T) {
+	openTime := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC)
+	closeTime := openTime.Add(time.Hour)
+
 	tests := []struct {
 		name    string
 		trade   Trade
@@ -41,14 +46,14 @@ func TestValidateTrade(t *testing.T) {
 			name: "invalid symbol",
 			trade: Trade{
 				Account: "ACC123",
-				Symbol:  "EUR123",
+				Symbol:  "EUR/USD",
 				Volume:  1.5,
 				Open:    1.2345,
 				Close:   1.2350,
 				Side:    "buy",
 			},
 			wantErr: true,
-			errMsg:  "symbol must match ^[A-Z]{6}$",
+			errMsg:  "symbol must match ^[A-Za-z0-9._]{1,16}$",
 		},
 		{
 			name: "negative volume",
@@ -128,6 +133,64 @@ func TestValidateTrade(t *testing.T) {
 			wantErr: true,
 			errMsg:  "close must be greater than 0",
 		},
+		{
+			name: "valid trade with client trade id",
+			trade: Trade{
+				ClientTradeID: "fill-0001",
+				Account:       "ACC123",
+				Symbol:        "EURUSD",
+				Volume:        1.5,
+				Open:          1.2345,
+				Close:         1.2350,
+				Side:          "sell",
+			},
+			wantErr: false,
+			errMsg:  "",
+		},
+		{
+			name: "too long client trade id",
+			trade: Trade{
+				ClientTradeID: strings.Repeat("x", MaxClientTradeIDLength+1),
+				Account:       "ACC123",
+				Symbol:        "EURUSD",
+				Volume:        1.5,
+				Open:          1.2345,
+				Close:         1.2350,
+				Side:          "buy",
+			},
+			wantErr: true,
+			errMsg:  "client_trade_id must not exceed 64 characters",
+		},
+		{
+			name: "valid trade with times",
+			trade: Trade{
+				Account:   "ACC123",
+				Symbol:    "EURUSD",
+				Volume:    1.5,
+				Open:      1.2345,
+				Close:     1.2350,
+				Side:      "buy",
+				OpenTime:  &openTime,
+				CloseTime: &closeTime,
+			},
+			wantErr: false,
+			errMsg:  "",
+		},
+		{
+			name: "close time before open time",
+			trade: Trade{
+				Account:   "ACC123",
+				Symbol:    "EURUSD",
+				Volume:    1.5,
+				Open:      1.2345,
+				Close:     1.2350,
+				Side:      "buy",
+				OpenTime:  &closeTime,
+				CloseTime: &openTime,
+			},
+			wantErr: true,
+			errMsg:  "close_time must not be before open_time",
+		},
 		{
 			name: "invalid side",
 			trade: Trade{
@@ -155,3 +218,32 @@ func TestValidateTrade(t *testing.T) {
 		})
 	}
 }
+
+func TestTradeSameOrder(t *testing.T) {
+	base := Trade{ClientTradeID: "a", Account: "ACC1", Symbol: "EURUSD", Volume: 1, Open: 1.1, Close: 1.2, Side: "buy"}
+
+	same := base
+	same.ClientTradeID = "b"
+	if !base.SameOrder(same) {
+		t.Errorf("SameOrder() = false for trades differing only in client_trade_id")
+	}
+
+	other := base
+	other.Volume = 2
+	if base.SameOrder(other) {
+		t.Errorf("SameOrder() = true for trades with different volume")
+	}
+
+	closeTime := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC)
+	withTime := base
+	withTime.CloseTime = &closeTime
+	if base.SameOrder(withTime) {
+		t.Errorf("SameOrder() = true for trades with different close_time")
+	}
+	truncated := closeTime.Add(300 * time.Millisecond)
+	withTruncated := base
+	withTruncated.CloseTime = &truncated
+	if !withTime.SameOrder(withTruncated) {
+		t.Errorf("SameOrder() = false for close_time differing below a second")
+	}
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+// POST /admin/rates endpoint
+func (s *ServerService) PostAdminRates() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.rejectDuringRebuild(w) {
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		var rates []model.Rate
+		if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		for i, rate := range rates {
+			if err := model.ValidateRate(rate); err != nil {
+				http.Error(w, fmt.Sprintf("rate %d: %s", i, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := s.store.StoreRates(ctx, rates); err != nil {
+			dbError(ctx, w, "Failed to store rates", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /admin/rates endpoint
+func (s *ServerService) GetAdminRates() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		rates, err := s.store.Rates(ctx)
+		if err != nil {
+			dbError(ctx, w, "Failed to fetch rates", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rates)
+	}
+}
+
+// PUT /admin/accounts/{acc} endpoint
+func (s *ServerService) PutAdminAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.rejectDuringRebuild(w) {
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		account := strings.TrimPrefix(r.URL.Path, "/admin/accounts/")
+		if account == "" {
+			http.Error(w, "Account is required", http.StatusBadRequest)
+			return
+		}
+
+		var body struct {
+			Currency string `json:"currency"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+		if err := model.ValidateCurrency(body.Currency); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Накопленная прибыль уже пересчитана в текущую валюту аккаунта
+		err := s.store.SetAccountCurrency(ctx, account, body.Currency)
+		if errors.Is(err, storage.ErrAccountHasTrades) {
+			current, err := s.store.AccountCurrency(ctx, account)
+			if err != nil {
+				dbError(ctx, w, "Failed to fetch account", err)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Account already has trades in %s", current), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			dbError(ctx, w, "Failed to store account", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"account":  account,
+			"currency": body.Currency,
+		})
+	}
+}
+
+// Ограничения на размер списка GET /admin/dead-letters
+const (
+	defaultDeadLettersLimit = 100
+	maxDeadLettersLimit     = 1000
+)
+
+// DeadLetter - сделка, которую воркер не смог обработать
+type DeadLetter struct {
+	ID           int64     `json:"id"`
+	Account      string    `json:"account"`
+	Symbol       string    `json:"symbol"`
+	Volume       float64   `json:"volume"`
+	Open         float64   `json:"open"`
+	Close        float64   `json:"close"`
+	Side         string    `json:"side"`
+	Attempts     int       `json:"attempts"`
+	FailedReason string    `json:"failed_reason"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// GET /admin/dead-letters endpoint
+func (s *ServerService) GetAdminDeadLetters() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		limit := defaultDeadLettersLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > maxDeadLettersLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxDeadLettersLimit), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		rows, err := s.store.DeadLetters(ctx, limit)
+		if err != nil {
+			dbError(ctx, w, "Failed to fetch dead letters", err)
+			return
+		}
+
+		letters := make([]DeadLetter, 0, len(rows))
+		for _, row := range rows {
+			letters = append(letters, DeadLetter{
+				ID:           row.ID,
+				Account:      row.Account,
+				Symbol:       row.Symbol,
+				Volume:       row.Volume,
+				Open:         row.Open,
+				Close:        row.Close,
+				Side:         row.Side,
+				Attempts:     row.Attempts,
+				FailedReason: row.FailedReason,
+				CreatedAt:    time.Unix(row.CreatedAt, 0).UTC(),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(letters)
+	}
+}
+
+// POST /admin/dead-letters/{id}/retry endpoint
+func (s *ServerService) PostAdminDeadLetterRetry() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.rejectDuringRebuild(w) {
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		id, err := deadLetterID(r.URL.Path, "/retry")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Сделка возвращается в очередь с обнуленным счетчиком попыток
+		s.updateDeadLetter(ctx, w, id, s.store.RetryDeadLetter)
+	}
+}
+
+// DELETE /admin/dead-letters/{id} endpoint
+func (s *ServerService) DeleteAdminDeadLetter() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.rejectDuringRebuild(w) {
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		id, err := deadLetterID(r.URL.Path, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Запись остается в trades_q для аудита, но больше не обрабатывается
+		s.updateDeadLetter(ctx, w, id, s.store.DiscardDeadLetter)
+	}
+}
+
+func (s *ServerService) updateDeadLetter(ctx context.Context, w http.ResponseWriter, id int64, update func(context.Context, int64) error) {
+	err := update(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("Dead letter %d not found", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dbError(ctx, w, "Failed to update dead letter", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deadLetterID(path, suffix string) (int64, error) {
+	raw := strings.TrimSuffix(strings.TrimPrefix(path, "/admin/dead-letters/"), suffix)
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("Invalid trade id")
+	}
+	return id, nil
+}
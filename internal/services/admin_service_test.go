@@ -0,0 +1,232 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+func TestAdminRates(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	repo := NewServerService(store)
+
+	t.Run("post rates", func(t *testing.T) {
+		body := `[{"base":"USD","quote":"JPY","rate":150},{"base":"EUR","quote":"USD","rate":1.1}]`
+		req := httptest.NewRequest(http.MethodPost, "/admin/rates", bytes.NewReader([]byte(body)))
+		rr := httptest.NewRecorder()
+		repo.PostAdminRates().ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("update existing rate", func(t *testing.T) {
+		body := `[{"base":"USD","quote":"JPY","rate":155}]`
+		req := httptest.NewRequest(http.MethodPost, "/admin/rates", bytes.NewReader([]byte(body)))
+		rr := httptest.NewRecorder()
+		repo.PostAdminRates().ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", rr.Code)
+		}
+	})
+
+	t.Run("invalid rate", func(t *testing.T) {
+		body := `[{"base":"USD","quote":"JPY","rate":-1}]`
+		req := httptest.NewRequest(http.MethodPost, "/admin/rates", bytes.NewReader([]byte(body)))
+		rr := httptest.NewRecorder()
+		repo.PostAdminRates().ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("get rates", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/rates", nil)
+		rr := httptest.NewRecorder()
+		repo.GetAdminRates().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		var rates []model.Rate
+		json.NewDecoder(rr.Body).Decode(&rates)
+		want := []model.Rate{{Base: "EUR", Quote: "USD", Rate: 1.1}, {Base: "USD", Quote: "JPY", Rate: 155}}
+		if len(rates) != len(want) || rates[0] != want[0] || rates[1] != want[1] {
+			t.Errorf("Unexpected rates: %+v", rates)
+		}
+	})
+}
+
+func TestPutAdminAccount(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	repo := NewServerService(store)
+	handler := repo.PutAdminAccount()
+
+	put := func(account, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/admin/accounts/"+account, bytes.NewReader([]byte(body)))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("set currency", func(t *testing.T) {
+		if rr := put("ACC1", `{"currency":"EUR"}`); rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		currency, err := store.AccountCurrency(context.Background(), "ACC1")
+		if err != nil || currency != "EUR" {
+			t.Errorf("Expected EUR, got %q (err %v)", currency, err)
+		}
+	})
+
+	t.Run("invalid currency", func(t *testing.T) {
+		if rr := put("ACC1", `{"currency":"euro"}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("account with trades", func(t *testing.T) {
+		applyTestTrades(t, store, storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1, ConvertedProfit: 10})
+		if rr := put("ACC1", `{"currency":"GBP"}`); rr.Code != http.StatusConflict {
+			t.Errorf("Expected 409, got %d", rr.Code)
+		}
+		// Повторная установка той же валюты допустима
+		if rr := put("ACC1", `{"currency":"EUR"}`); rr.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", rr.Code)
+		}
+	})
+
+	t.Run("empty account", func(t *testing.T) {
+		if rr := put("", `{"currency":"EUR"}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("invalid method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/accounts/ACC1", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+}
+
+func TestAdminDeadLetters(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	repo := NewServerService(store)
+
+	ctx := context.Background()
+	enqueueTestTrades(t, store,
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("ACC1", "USDCHF", 1, 0.9, 0.91, "buy"),
+		testTrade("ACC2", "EURUSD", 1, 1.1, 1.2, "hold"))
+	claimTestTrades(t, store, "seed", 0, 3, time.Now().Add(time.Minute))
+	err := store.ProcessBatch(ctx, func(tx storage.BatchTx) error {
+		err := tx.ApplyTrade(ctx, storage.AppliedTrade{ID: 1, WorkerID: "seed", Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1})
+		if err != nil {
+			return err
+		}
+		err = tx.RecordFailure(ctx, storage.Failure{ID: 2, WorkerID: "seed", Status: model.StatusFailed, Attempts: 5,
+			Reason: "failed to convert profit: no exchange rate for CHF/USD"})
+		if err != nil {
+			return err
+		}
+		return tx.RecordFailure(ctx, storage.Failure{ID: 3, WorkerID: "seed", Status: model.StatusFailed, Attempts: 1,
+			Reason: `invalid side "hold"`})
+	})
+	if err != nil {
+		t.Fatalf("Failed to prepare trades: %v", err)
+	}
+
+	status := func(id int64) string {
+		return queuedTrade(t, store, id).Status
+	}
+
+	t.Run("list", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/dead-letters", nil)
+		rr := httptest.NewRecorder()
+		repo.GetAdminDeadLetters().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		var letters []DeadLetter
+		json.NewDecoder(rr.Body).Decode(&letters)
+		if len(letters) != 2 || letters[0].ID != 2 || letters[0].Attempts != 5 || letters[1].FailedReason != `invalid side "hold"` {
+			t.Errorf("Unexpected dead letters: %+v", letters)
+		}
+	})
+
+	t.Run("list with invalid limit", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/dead-letters?limit=0", nil)
+		rr := httptest.NewRecorder()
+		repo.GetAdminDeadLetters().ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/dead-letters/2/retry", nil)
+		rr := httptest.NewRecorder()
+		repo.PostAdminDeadLetterRetry().ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+		attempts := queuedTrade(t, store, 2).Attempts
+		if status(2) != "pending" || attempts != 0 {
+			t.Errorf("Expected pending with 0 attempts, got %s with %d", status(2), attempts)
+		}
+	})
+
+	t.Run("retry not failed trade", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/dead-letters/1/retry", nil)
+		rr := httptest.NewRecorder()
+		repo.PostAdminDeadLetterRetry().ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", rr.Code)
+		}
+		if status(1) != "processed" {
+			t.Errorf("Processed trade must not be changed, got %s", status(1))
+		}
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/dead-letters/3", nil)
+		rr := httptest.NewRecorder()
+		repo.DeleteAdminDeadLetter().ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", rr.Code)
+		}
+		if status(3) != "discarded" {
+			t.Errorf("Expected discarded, got %s", status(3))
+		}
+	})
+
+	t.Run("invalid id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/dead-letters/abc", nil)
+		rr := httptest.NewRecorder()
+		repo.DeleteAdminDeadLetter().ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("invalid method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/dead-letters/2/retry", nil)
+		rr := httptest.NewRecorder()
+		repo.PostAdminDeadLetterRetry().ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/logging"
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+// TradeCorrection - тело PATCH /trades/{id}; поля, не переданные в запросе, не меняются
+type TradeCorrection struct {
+	Volume *float64 `json:"volume"`
+	Open   *float64 `json:"open"`
+	Close  *float64 `json:"close"`
+	Side   *string  `json:"side"`
+}
+
+// AmendedValues - значения сделки до или после изменения
+type AmendedValues struct {
+	Volume float64 `json:"volume"`
+	Open   float64 `json:"open"`
+	Close  float64 `json:"close"`
+	Side   string  `json:"side"`
+}
+
+// AmendmentResponse - изменение сделки в ответах DELETE и PATCH /trades/{id}
+// и GET /trades/{id}/amendments
+type AmendmentResponse struct {
+	ID      int64  `json:"id"`
+	TradeID int64  `json:"trade_id"`
+	Action  string `json:"action"`
+	// Status - pending, пока изменение обработанной сделки не учтено в статистике,
+	// applied после этого и failed, если воркер не смог его применить
+	Status     string        `json:"status"`
+	PrevStatus string        `json:"prev_status"`
+	Before     AmendedValues `json:"before"`
+	After      AmendedValues `json:"after"`
+	// Прибыль в валюте аккаунта до и после изменения, если сделка учтена в статистике
+	PrevProfit   *float64   `json:"prev_profit,omitempty"`
+	Profit       *float64   `json:"profit,omitempty"`
+	Attempts     int        `json:"attempts"`
+	FailedReason string     `json:"failed_reason,omitempty"`
+	RequestID    string     `json:"request_id,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	AppliedAt    *time.Time `json:"applied_at,omitempty"`
+}
+
+// /trades/{id} endpoint: GET - состояние сделки, DELETE - отмена, PATCH - исправление
+func (s *ServerService) ServerTrade() http.HandlerFunc {
+	get, cancel, correct := s.GetServerTrade(), s.DeleteServerTrade(), s.PatchServerTrade()
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			get(w, r)
+		case http.MethodDelete:
+			cancel(w, r)
+		case http.MethodPatch:
+			correct(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// DELETE /trades/{id} endpoint
+func (s *ServerService) DeleteServerTrade() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.rejectDuringRebuild(w) {
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		id, err := tradeID(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		record, err := s.store.AmendTrade(ctx, storage.Amendment{
+			TradeID:   id,
+			Action:    model.AmendmentCancel,
+			RequestID: logging.RequestID(r.Context()),
+		})
+		s.writeAmendment(ctx, w, id, record, err)
+	}
+}
+
+// PATCH /trades/{id} endpoint
+func (s *ServerService) PatchServerTrade() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.rejectDuringRebuild(w) {
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		id, err := tradeID(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var correction TradeCorrection
+		decoder := json.NewDecoder(r.Body)
+		// Счет, символ и время сделки не исправляются - такую сделку нужно отменить и поставить заново
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&correction); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid correction: %v", err), http.StatusBadRequest)
+			return
+		}
+		if correction.Volume == nil && correction.Open == nil && correction.Close == nil && correction.Side == nil {
+			http.Error(w, "Correction must change volume, open, close or side", http.StatusBadRequest)
+			return
+		}
+
+		instruments, err := s.store.Instruments(ctx)
+		if err != nil {
+			dbError(ctx, w, "Failed to load instruments", err)
+			return
+		}
+
+		record, err := s.store.AmendTrade(ctx, storage.Amendment{
+			TradeID: id,
+			Action:  model.AmendmentCorrect,
+			// Исправление накладывается на сделку, прочитанную под блокировкой, чтобы
+			// параллельные частичные исправления не отменяли друг друга. Исправленная
+			// сделка проходит ту же проверку, что и новая.
+			Correct: func(current storage.TradeRecord) (storage.TradeValues, error) {
+				trade := correctedTrade(current, correction)
+				if err := instruments.ValidateTrade(trade); err != nil {
+					return storage.TradeValues{}, err
+				}
+				return storage.TradeValues{Volume: trade.Volume, Open: trade.Open, Close: trade.Close, Side: trade.Side}, nil
+			},
+			RequestID: logging.RequestID(r.Context()),
+		})
+		s.writeAmendment(ctx, w, id, record, err)
+	}
+}
+
+// GET /trades/{id}/amendments endpoint
+func (s *ServerService) GetServerTradeAmendments() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		id, err := tradeID(strings.TrimSuffix(r.URL.Path, "/amendments"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := s.store.Trade(ctx, id); errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("Trade %d not found", id), http.StatusNotFound)
+			return
+		} else if err != nil {
+			dbError(ctx, w, "Failed to fetch trade", err)
+			return
+		}
+
+		records, err := s.store.Amendments(ctx, id)
+		if err != nil {
+			dbError(ctx, w, "Failed to fetch amendments", err)
+			return
+		}
+		amendments := make([]AmendmentResponse, 0, len(records))
+		for _, record := range records {
+			amendments = append(amendments, newAmendmentResponse(record))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(amendments)
+	}
+}
+
+// writeAmendment отвечает на отмену или исправление сделки id: 200, если сделка
+// изменена сразу, и 202, если изменение ждет воркера
+func (s *ServerService) writeAmendment(ctx context.Context, w http.ResponseWriter, id int64, record storage.AmendmentRecord, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, fmt.Sprintf("Trade %d not found", id), http.StatusNotFound)
+		return
+	case errors.Is(err, storage.ErrTradeCancelled):
+		http.Error(w, "Trade is already cancelled", http.StatusConflict)
+		return
+	case errors.Is(err, storage.ErrAmendmentPending):
+		http.Error(w, "Previous amendment of the trade is not applied yet", http.StatusConflict)
+		return
+	case errors.As(err, new(*model.ValidationError)):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		dbError(ctx, w, "Failed to amend trade", err)
+		return
+	}
+
+	slog.DebugContext(ctx, "trade amendment accepted", "amendment_id", record.ID, "trade_id", id, "action", record.Action, "status", record.Status)
+	status := http.StatusOK
+	if record.Status == model.StatusPending {
+		status = http.StatusAccepted
+		s.notifyEnqueued()
+	}
+	w.Header().Set("Location", tradeLocation(id)+"/amendments")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newAmendmentResponse(record))
+}
+
+// correctedTrade - сделка current с полями из correction
+func correctedTrade(current storage.TradeRecord, correction TradeCorrection) model.Trade {
+	trade := model.Trade{
+		ClientTradeID: current.ClientTradeID,
+		Account:       current.Account,
+		Symbol:        current.Symbol,
+		Volume:        current.Volume,
+		Open:          current.Open,
+		Close:         current.Close,
+		Side:          current.Side,
+		OpenTime:      unixTime(current.OpenTime),
+		CloseTime:     unixTime(current.CloseTime),
+	}
+	if correction.Volume != nil {
+		trade.Volume = *correction.Volume
+	}
+	if correction.Open != nil {
+		trade.Open = *correction.Open
+	}
+	if correction.Close != nil {
+		trade.Close = *correction.Close
+	}
+	if correction.Side != nil {
+		trade.Side = *correction.Side
+	}
+	return trade
+}
+
+func newAmendmentResponse(record storage.AmendmentRecord) AmendmentResponse {
+	return AmendmentResponse{
+		ID:           record.ID,
+		TradeID:      record.TradeID,
+		Action:       record.Action,
+		Status:       record.Status,
+		PrevStatus:   record.PrevStatus,
+		Before:       AmendedValues(record.Prev),
+		After:        AmendedValues(record.Values),
+		PrevProfit:   record.PrevProfit,
+		Profit:       record.Profit,
+		Attempts:     record.Attempts,
+		FailedReason: record.FailedReason,
+		RequestID:    record.RequestID,
+		CreatedAt:    time.Unix(record.CreatedAt, 0).UTC(),
+		AppliedAt:    unixTime(record.AppliedAt),
+	}
+}
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+func TestTradeAmendments(t *testing.T) {
+	ctx := context.Background()
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	service := NewServerService(store)
+	handler := service.ServerTrade()
+	worker := NewTradeService(store)
+
+	amend := func(t *testing.T, method, path, body string) (int, AmendmentResponse) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var response AmendmentResponse
+		if rr.Code == http.StatusOK || rr.Code == http.StatusAccepted {
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return rr.Code, response
+	}
+	process := func(t *testing.T) {
+		t.Helper()
+		if err := worker.ProcessTrades(ctx); err != nil {
+			t.Fatalf("ProcessTrades failed: %v", err)
+		}
+	}
+	stats := func(t *testing.T) storage.AccountStats {
+		t.Helper()
+		stats, err := store.AccountStats(ctx, "ACC1")
+		if err != nil {
+			t.Fatalf("Failed to get stats: %v", err)
+		}
+		return stats
+	}
+
+	enqueueTestTrades(t, store,
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"),
+	)
+	process(t)
+	if s := stats(t); s.Trades != 2 || s.Profit != 20000 {
+		t.Fatalf("Expected 2 trades with profit 20000, got %+v", s)
+	}
+
+	t.Run("correct processed trade", func(t *testing.T) {
+		code, amendment := amend(t, http.MethodPatch, "/trades/1", `{"volume":2,"side":"sell"}`)
+		if code != http.StatusAccepted || amendment.Status != model.StatusPending || amendment.PrevProfit == nil || *amendment.PrevProfit != 10000 {
+			t.Fatalf("Expected pending correction, got %d %+v", code, amendment)
+		}
+		if amendment.Before != (AmendedValues{Volume: 1, Open: 1.1, Close: 1.2, Side: "buy"}) ||
+			amendment.After != (AmendedValues{Volume: 2, Open: 1.1, Close: 1.2, Side: "sell"}) {
+			t.Errorf("Unexpected values %+v -> %+v", amendment.Before, amendment.After)
+		}
+		// Пока воркер не применил изменение, статистика и сделка прежние
+		if code, _ := amend(t, http.MethodDelete, "/trades/1", ""); code != http.StatusConflict {
+			t.Errorf("Expected 409 while amendment is pending, got %d", code)
+		}
+		if s := stats(t); s.Trades != 2 || s.Profit != 20000 {
+			t.Errorf("Expected unchanged stats, got %+v", s)
+		}
+
+		process(t)
+		if s := stats(t); s.Trades != 2 || s.Profit != -10000 {
+			t.Errorf("Expected 2 trades with profit -10000, got %+v", s)
+		}
+		symbols, err := store.SymbolStats(ctx, "ACC1")
+		if err != nil {
+			t.Fatalf("Failed to get symbol stats: %v", err)
+		}
+		for _, sym := range symbols {
+			if sym.Side == "buy" && (sym.Trades != 1 || sym.Volume != 1 || sym.Wins != 1) ||
+				sym.Side == "sell" && (sym.Trades != 1 || sym.Volume != 2 || sym.GrossLoss != 20000) {
+				t.Errorf("Unexpected symbol stats %+v", sym)
+			}
+		}
+		trade, err := store.Trade(ctx, 1)
+		if err != nil || trade.Volume != 2 || trade.Side != "sell" || trade.ConvertedProfit != -20000 || trade.Status != model.StatusProcessed {
+			t.Errorf("Expected corrected trade, got %+v (%v)", trade, err)
+		}
+	})
+
+	t.Run("cancel processed trade", func(t *testing.T) {
+		if code, amendment := amend(t, http.MethodDelete, "/trades/2", ""); code != http.StatusAccepted || amendment.Action != model.AmendmentCancel {
+			t.Fatalf("Expected pending cancellation, got %d %+v", code, amendment)
+		}
+		process(t)
+		if s := stats(t); s.Trades != 1 || s.Profit != -20000 {
+			t.Errorf("Expected 1 trade with profit -20000, got %+v", s)
+		}
+		if trade, _ := store.Trade(ctx, 2); trade.Status != model.StatusCancelled {
+			t.Errorf("Expected cancelled trade, got %+v", trade)
+		}
+		if code, _ := amend(t, http.MethodPatch, "/trades/2", `{"volume":3}`); code != http.StatusConflict {
+			t.Errorf("Expected 409 for cancelled trade, got %d", code)
+		}
+	})
+
+	t.Run("cancel pending trade", func(t *testing.T) {
+		enqueueTestTrades(t, store, testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"))
+		code, amendment := amend(t, http.MethodDelete, "/trades/3", "")
+		if code != http.StatusOK || amendment.Status != model.AmendmentApplied || amendment.PrevStatus != model.StatusPending || amendment.AppliedAt == nil {
+			t.Fatalf("Expected applied cancellation, got %d %+v", code, amendment)
+		}
+		process(t)
+		if s := stats(t); s.Trades != 1 {
+			t.Errorf("Expected cancelled trade to be skipped, got %+v", s)
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		service.GetServerTradeAmendments().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/trades/1/amendments", nil))
+		var history []AmendmentResponse
+		if err := json.NewDecoder(rr.Body).Decode(&history); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(history) != 1 || history[0].Status != model.AmendmentApplied || history[0].Profit == nil || *history[0].Profit != -20000 {
+			t.Errorf("Unexpected history %+v", history)
+		}
+
+		rr = httptest.NewRecorder()
+		service.GetServerTradeAmendments().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/trades/99/amendments", nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", rr.Code)
+		}
+	})
+
+	t.Run("retry original POST after correction", func(t *testing.T) {
+		body := `{"client_trade_id":"fill-1","account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`
+		post := func() *httptest.ResponseRecorder {
+			rr := httptest.NewRecorder()
+			service.PostServerTrades().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/trades", strings.NewReader(body)))
+			return rr
+		}
+		rr := post()
+		location := rr.Header().Get("Location")
+		if rr.Code != http.StatusAccepted || location == "" {
+			t.Fatalf("Expected 202 with Location, got %d %q", rr.Code, location)
+		}
+		if code, _ := amend(t, http.MethodPatch, location, `{"volume":2}`); code != http.StatusOK {
+			t.Fatalf("Expected applied correction, got %d", code)
+		}
+		if rr := post(); rr.Code != http.StatusAccepted || rr.Header().Get("Location") != location {
+			t.Errorf("Expected original result %s, got %d %q", location, rr.Code, rr.Header().Get("Location"))
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, c := range []struct {
+			method, path, body string
+			code               int
+		}{
+			{http.MethodDelete, "/trades/99", "", http.StatusNotFound},
+			{http.MethodPatch, "/trades/99", `{"volume":2}`, http.StatusNotFound},
+			{http.MethodDelete, "/trades/abc", "", http.StatusBadRequest},
+			{http.MethodPatch, "/trades/1", `{}`, http.StatusBadRequest},
+			{http.MethodPatch, "/trades/1", `{"symbol":"GBPUSD"}`, http.StatusBadRequest},
+			{http.MethodPatch, "/trades/1", `{"volume":-1}`, http.StatusBadRequest},
+			{http.MethodPatch, "/trades/1", `{"side":"long"}`, http.StatusBadRequest},
+			{http.MethodPut, "/trades/1", "", http.StatusMethodNotAllowed},
+		} {
+			if code, _ := amend(t, c.method, c.path, c.body); code != c.code {
+				t.Errorf("%s %s %s: expected %d, got %d", c.method, c.path, c.body, c.code, code)
+			}
+		}
+	})
+}
+
+// interleavingStore выполняет перед изменением сделки другой запрос, как если бы
+// он пришел параллельно и успел раньше
+type interleavingStore struct {
+	storage.Store
+	before func()
+}
+
+func (s *interleavingStore) AmendTrade(ctx context.Context, amendment storage.Amendment) (storage.AmendmentRecord, error) {
+	if before := s.before; before != nil {
+		s.before = nil
+		before()
+	}
+	return s.Store.AmendTrade(ctx, amendment)
+}
+
+func TestPatchServerTrade_ConcurrentCorrections(t *testing.T) {
+	memory, cleanup := SetupTestStore(t)
+	defer cleanup()
+	enqueueTestTrades(t, memory, testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"))
+
+	patch := func(t *testing.T, service *ServerService, body string) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		service.ServerTrade().ServeHTTP(rr, httptest.NewRequest(http.MethodPatch, "/trades/1", strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("PATCH %s: expected 200, got %d: %s", body, rr.Code, rr.Body)
+		}
+	}
+
+	// Исправление объема фиксируется между разбором запроса и изменением цены открытия
+	store := &interleavingStore{Store: memory}
+	store.before = func() { patch(t, NewServerService(memory), `{"volume":2}`) }
+	patch(t, NewServerService(store), `{"open":1.15}`)
+
+	trade := queuedTrade(t, memory, 1)
+	if trade.Volume != 2 || trade.Open != 1.15 {
+		t.Errorf("Expected both corrections to be kept, got volume=%v open=%v", trade.Volume, trade.Open)
+	}
+}
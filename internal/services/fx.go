@@ -0,0 +1,20 @@
+package services
+
+import (
+	"context"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+// ImportRatesFile загружает курсы из JSON/CSV-файла в хранилище
+func ImportRatesFile(ctx context.Context, store storage.Store, path string) (int, error) {
+	rates, err := model.LoadRatesFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := store.StoreRates(ctx, rates); err != nil {
+		return 0, err
+	}
+	return len(rates), nil
+}
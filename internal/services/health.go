@@ -0,0 +1,228 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/db"
+)
+
+// ReadinessThresholds - пороги, при превышении которых /readyz отвечает 503.
+// Нулевое значение отключает соответствующую проверку.
+type ReadinessThresholds struct {
+	// MaxQueueDepth - допустимое количество необработанных сделок
+	MaxQueueDepth int64
+	// MaxQueueAge - допустимый возраст самой старой необработанной сделки
+	MaxQueueAge time.Duration
+	// MaxHeartbeatAge - допустимое время с последнего прохода любого воркера
+	MaxHeartbeatAge time.Duration
+}
+
+// DefaultReadinessThresholds - очередь считается зависшей, если сделка ждет дольше 5 минут.
+// Остановленный воркер обнаруживается по возрасту очереди, как только в нее приходят сделки.
+var DefaultReadinessThresholds = ReadinessThresholds{MaxQueueAge: 5 * time.Minute}
+
+// WithReadinessThresholds задает пороги готовности для /readyz
+func WithReadinessThresholds(t ReadinessThresholds) ServerServiceOption {
+	return func(s *ServerService) {
+		s.readiness = t
+	}
+}
+
+// QueueHealth - состояние очереди в ответе /readyz
+type QueueHealth struct {
+	Pending int64 `json:"pending"`
+	// OldestAgeSeconds - возраст самой старой необработанной сделки, 0 если очередь пуста
+	OldestAgeSeconds int64 `json:"oldest_age_seconds"`
+}
+
+// WorkerHealth - последняя отметка воркера в ответе /readyz
+type WorkerHealth struct {
+	WorkerID      string    `json:"worker_id"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	AgeSeconds    int64     `json:"age_seconds"`
+}
+
+// ReadinessResponse - ответ /readyz
+type ReadinessResponse struct {
+	Ready         bool          `json:"ready"`
+	SchemaVersion int           `json:"schema_version,omitempty"`
+	Queue         *QueueHealth  `json:"queue,omitempty"`
+	Worker        *WorkerHealth `json:"worker"`
+	Checks        []db.Check    `json:"checks"`
+}
+
+// GET /livez endpoint: процесс жив и обслуживает запросы. База не проверяется,
+// чтобы оркестратор не перезапускал сервер из-за недоступной базы или воркера.
+func (s *ServerService) GetServerLivez() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "alive",
+			"uptime_seconds": int64(s.now().Sub(s.started).Seconds()),
+		})
+	}
+}
+
+// GET /readyz endpoint: самодиагностика хранилища, запись в базу, очередь и отметки воркеров.
+// Отвечает 503, если какая-либо проверка не пройдена.
+func (s *ServerService) GetServerReadyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		now := s.now()
+		report := s.store.SelfCheck(ctx)
+		report.Add("writable", s.store.CheckWritable(ctx), "ok")
+		response := ReadinessResponse{SchemaVersion: report.SchemaVersion}
+
+		if stats, err := s.store.QueueStats(ctx); err != nil {
+			report.Add("queue", err, "")
+		} else {
+			response.Queue = &QueueHealth{Pending: stats.Pending}
+			if stats.OldestCreatedAt > 0 {
+				response.Queue.OldestAgeSeconds = max(now.Unix()-stats.OldestCreatedAt, 0)
+			}
+			s.checkQueue(&report, *response.Queue)
+		}
+
+		if heartbeats, err := s.store.Heartbeats(ctx); err != nil {
+			report.Add("worker_heartbeat", err, "")
+		} else {
+			if len(heartbeats) > 0 {
+				last := heartbeats[0]
+				response.Worker = &WorkerHealth{
+					WorkerID:      last.WorkerID,
+					LastHeartbeat: time.Unix(last.LastRunAt, 0).UTC(),
+					AgeSeconds:    max(now.Unix()-last.LastRunAt, 0),
+				}
+			}
+			s.checkHeartbeat(&report, response.Worker)
+		}
+
+		response.Ready = report.OK()
+		response.Checks = report.Checks
+		status := http.StatusOK
+		if !response.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// checkQueue сравнивает глубину и возраст очереди с порогами
+func (s *ServerService) checkQueue(report *db.Report, queue QueueHealth) {
+	var err error
+	if limit := s.readiness.MaxQueueDepth; limit > 0 && queue.Pending > limit {
+		err = fmt.Errorf("%d pending trades, limit %d", queue.Pending, limit)
+	}
+	report.Add("queue_depth", err, fmt.Sprintf("%d pending trades", queue.Pending))
+
+	err = nil
+	age := time.Duration(queue.OldestAgeSeconds) * time.Second
+	if limit := s.readiness.MaxQueueAge; limit > 0 && age > limit {
+		err = fmt.Errorf("oldest pending trade waits %v, limit %v", age, limit)
+	}
+	report.Add("queue_age", err, fmt.Sprintf("oldest pending trade waits %v", age))
+}
+
+// checkHeartbeat сравнивает время с последнего прохода воркера с порогом.
+// Без порога отсутствие отметок не считается ошибкой.
+func (s *ServerService) checkHeartbeat(report *db.Report, worker *WorkerHealth) {
+	limit := s.readiness.MaxHeartbeatAge
+	if worker == nil {
+		var err error
+		if limit > 0 {
+			err = fmt.Errorf("no worker heartbeat recorded")
+		}
+		report.Add("worker_heartbeat", err, "no worker heartbeat recorded")
+		return
+	}
+
+	var err error
+	age := time.Duration(worker.AgeSeconds) * time.Second
+	if limit > 0 && age > limit {
+		err = fmt.Errorf("last heartbeat from %s %v ago, limit %v", worker.WorkerID, age, limit)
+	}
+	report.Add("worker_heartbeat", err, fmt.Sprintf("last heartbeat from %s %v ago", worker.WorkerID, age))
+}
+
+// Отметка старше этого времени помечается в GET /workers как устаревшая, по умолчанию.
+// Воркер отмечается после каждого прохода, а пауза между проходами не превышает -max-poll.
+const defaultWorkerStaleAfter = time.Minute
+
+// WithWorkerStaleAfter задает возраст отметки, после которого воркер считается остановленным
+func WithWorkerStaleAfter(d time.Duration) ServerServiceOption {
+	return func(s *ServerService) {
+		if d > 0 {
+			s.workerStaleAfter = d
+		}
+	}
+}
+
+// WorkerStatus - воркер в ответе GET /workers
+type WorkerStatus struct {
+	WorkerID      string    `json:"worker_id"`
+	Host          string    `json:"host"`
+	PID           int       `json:"pid"`
+	StartedAt     time.Time `json:"started_at"`
+	LastRunAt     time.Time `json:"last_run_at"`
+	LastBatchSize int       `json:"last_batch_size"`
+	LastError     string    `json:"last_error,omitempty"`
+	AgeSeconds    int64     `json:"age_seconds"`
+	Stale         bool      `json:"stale"`
+}
+
+// GET /workers endpoint: воркеры по отметкам в порядке убывания времени последнего прохода.
+// Воркер без отметки дольше workerStaleAfter помечается stale.
+func (s *ServerService) GetServerWorkers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		heartbeats, err := s.store.Heartbeats(ctx)
+		if err != nil {
+			dbError(ctx, w, "Failed to load workers", err)
+			return
+		}
+
+		now := s.now().Unix()
+		workers := make([]WorkerStatus, len(heartbeats))
+		for i, hb := range heartbeats {
+			age := max(now-hb.LastRunAt, 0)
+			workers[i] = WorkerStatus{
+				WorkerID:      hb.WorkerID,
+				Host:          hb.Host,
+				PID:           hb.PID,
+				StartedAt:     time.Unix(hb.StartedAt, 0).UTC(),
+				LastRunAt:     time.Unix(hb.LastRunAt, 0).UTC(),
+				LastBatchSize: hb.LastBatchSize,
+				LastError:     hb.LastError,
+				AgeSeconds:    age,
+				Stale:         time.Duration(age)*time.Second > s.workerStaleAfter,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(workers)
+	}
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+func readyz(t *testing.T, service *ServerService) (int, ReadinessResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	rr := httptest.NewRecorder()
+	service.GetServerReadyz().ServeHTTP(rr, req)
+
+	var response ReadinessResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return rr.Code, response
+}
+
+func failedChecks(response ReadinessResponse) []string {
+	var failed []string
+	for _, c := range response.Checks {
+		if !c.OK {
+			failed = append(failed, c.Name)
+		}
+	}
+	return failed
+}
+
+func TestGetServerLivez(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	service := NewServerService(store)
+
+	t.Run("alive without storage", func(t *testing.T) {
+		store.Close()
+		req := httptest.NewRequest(http.MethodGet, "/livez", nil)
+		rr := httptest.NewRecorder()
+		service.GetServerLivez().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", rr.Code)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body["status"] != "alive" {
+			t.Errorf("Expected status alive, got %v (%v)", body, err)
+		}
+	})
+
+	t.Run("invalid method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/livez", nil)
+		rr := httptest.NewRecorder()
+		service.GetServerLivez().ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+}
+
+func TestGetServerReadyz(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("empty queue", func(t *testing.T) {
+		store, cleanup := SetupTestStore(t)
+		defer cleanup()
+
+		code, response := readyz(t, NewServerService(store))
+		if code != http.StatusOK || !response.Ready {
+			t.Fatalf("Expected ready, got %d, failed checks %v", code, failedChecks(response))
+		}
+		if response.Queue == nil || response.Queue.Pending != 0 || response.Worker != nil {
+			t.Errorf("Unexpected response %+v", response)
+		}
+	})
+
+	t.Run("stale queue", func(t *testing.T) {
+		store, cleanup := SetupTestStore(t)
+		defer cleanup()
+		enqueueTestTrades(t, store, testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"))
+
+		service := NewServerService(store, WithReadinessThresholds(ReadinessThresholds{MaxQueueAge: time.Minute}))
+		if code, response := readyz(t, service); code != http.StatusOK {
+			t.Fatalf("Expected fresh queue to be ready, got %d, failed checks %v", code, failedChecks(response))
+		}
+
+		service.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		code, response := readyz(t, service)
+		if code != http.StatusServiceUnavailable || response.Ready {
+			t.Fatalf("Expected 503, got %d", code)
+		}
+		if failed := failedChecks(response); len(failed) != 1 || failed[0] != "queue_age" {
+			t.Errorf("Expected only queue_age to fail, got %v", failed)
+		}
+		if response.Queue.Pending != 1 || response.Queue.OldestAgeSeconds < 120 {
+			t.Errorf("Unexpected queue %+v", response.Queue)
+		}
+	})
+
+	t.Run("queue depth", func(t *testing.T) {
+		store, cleanup := SetupTestStore(t)
+		defer cleanup()
+		enqueueTestTrades(t, store,
+			testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"),
+			testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"))
+
+		service := NewServerService(store, WithReadinessThresholds(ReadinessThresholds{MaxQueueDepth: 1}))
+		code, response := readyz(t, service)
+		if code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected 503, got %d", code)
+		}
+		if failed := failedChecks(response); len(failed) != 1 || failed[0] != "queue_depth" {
+			t.Errorf("Expected only queue_depth to fail, got %v", failed)
+		}
+	})
+
+	t.Run("worker heartbeat", func(t *testing.T) {
+		store, cleanup := SetupTestStore(t)
+		defer cleanup()
+		service := NewServerService(store, WithReadinessThresholds(ReadinessThresholds{MaxHeartbeatAge: time.Minute}))
+
+		if code, response := readyz(t, service); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 without heartbeats, got %d, failed checks %v", code, failedChecks(response))
+		}
+
+		now := time.Now().Unix()
+		for _, hb := range []storage.WorkerHeartbeat{{WorkerID: "w1", LastRunAt: now - 600}, {WorkerID: "w2", LastRunAt: now - 5}} {
+			if err := store.RecordHeartbeat(ctx, hb); err != nil {
+				t.Fatalf("Failed to record heartbeat: %v", err)
+			}
+		}
+		code, response := readyz(t, service)
+		if code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d, failed checks %v", code, failedChecks(response))
+		}
+		if response.Worker == nil || response.Worker.WorkerID != "w2" || response.Worker.AgeSeconds < 5 {
+			t.Errorf("Expected latest heartbeat from w2, got %+v", response.Worker)
+		}
+
+		service.now = func() time.Time { return time.Now().Add(time.Hour) }
+		if code, response := readyz(t, service); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 for stale heartbeat, got %d, failed checks %v", code, failedChecks(response))
+		}
+	})
+
+	t.Run("closed store", func(t *testing.T) {
+		store, cleanup := SetupTestStore(t)
+		defer cleanup()
+		store.Close()
+
+		code, response := readyz(t, NewServerService(store))
+		if code != http.StatusServiceUnavailable || response.Ready {
+			t.Errorf("Expected 503, got %d", code)
+		}
+	})
+
+	t.Run("invalid method", func(t *testing.T) {
+		store, cleanup := SetupTestStore(t)
+		defer cleanup()
+		req := httptest.NewRequest(http.MethodPost, "/readyz", nil)
+		rr := httptest.NewRecorder()
+		NewServerService(store).GetServerReadyz().ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+}
+
+func TestGetServerWorkers(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	service := NewServerService(store, WithWorkerStaleAfter(time.Minute))
+	handler := service.GetServerWorkers()
+
+	t.Run("no workers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/workers", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		if body := strings.TrimSpace(rr.Body.String()); body != "[]" {
+			t.Errorf("Expected empty list, got %s", body)
+		}
+	})
+
+	t.Run("stale workers are flagged", func(t *testing.T) {
+		now := time.Now().Unix()
+		for _, hb := range []storage.WorkerHeartbeat{
+			{WorkerID: "w1", Host: "host-a", PID: 10, StartedAt: now - 3600, LastRunAt: now - 600, LastBatchSize: 4, LastError: "database is locked"},
+			{WorkerID: "w2", Host: "host-b", PID: 20, StartedAt: now - 60, LastRunAt: now - 2, LastBatchSize: 100},
+		} {
+			if err := store.RecordHeartbeat(context.Background(), hb); err != nil {
+				t.Fatalf("Failed to record heartbeat: %v", err)
+			}
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/workers", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		var workers []WorkerStatus
+		if err := json.NewDecoder(rr.Body).Decode(&workers); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(workers) != 2 || workers[0].WorkerID != "w2" || workers[1].WorkerID != "w1" {
+			t.Fatalf("Expected w2 then w1, got %+v", workers)
+		}
+		if workers[0].Stale || workers[0].LastBatchSize != 100 || workers[0].Host != "host-b" || workers[0].PID != 20 {
+			t.Errorf("Unexpected fresh worker %+v", workers[0])
+		}
+		if !workers[1].Stale || workers[1].AgeSeconds < 600 || workers[1].LastError != "database is locked" {
+			t.Errorf("Expected stale worker w1 with error, got %+v", workers[1])
+		}
+		if workers[1].StartedAt.Unix() != now-3600 {
+			t.Errorf("Expected started_at %d, got %v", now-3600, workers[1].StartedAt)
+		}
+	})
+
+	t.Run("invalid method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/workers", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+
+	t.Run("db closed", func(t *testing.T) {
+		store.Close()
+		req := httptest.NewRequest(http.MethodGet, "/workers", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("Expected 500, got %d", rr.Code)
+		}
+	})
+}
@@ -0,0 +1,20 @@
+package services
+
+import (
+	"context"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+// ImportInstrumentsFile загружает реестр инструментов из JSON/CSV-файла в хранилище
+func ImportInstrumentsFile(ctx context.Context, store storage.Store, path string) (int, error) {
+	instruments, err := model.LoadInstrumentsFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := store.StoreInstruments(ctx, instruments); err != nil {
+		return 0, err
+	}
+	return len(instruments), nil
+}
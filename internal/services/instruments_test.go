@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+)
+
+func TestImportInstrumentsFile(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+
+	path := filepath.Join(t.TempDir(), "instruments.csv")
+	content := "symbol,contract_size,pip_size,quote_currency,precision\nXAUUSD,100,0.01,USD,2\nUSDJPY,100000,0.01,JPY,3\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Не удалось записать файл: %v", err)
+	}
+
+	n, err := ImportInstrumentsFile(context.Background(), store, path)
+	if err != nil {
+		t.Fatalf("Ошибка импорта инструментов: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Ожидалось 2 инструмента, импортировано: %d", n)
+	}
+
+	// Повторная загрузка обновляет существующие записи
+	err = store.StoreInstruments(context.Background(), []model.Instrument{
+		{Symbol: "XAUUSD", ContractSize: 50, PipSize: 0.01, QuoteCurrency: "USD", Precision: 2},
+	})
+	if err != nil {
+		t.Fatalf("Ошибка обновления инструмента: %v", err)
+	}
+
+	instruments, err := store.Instruments(context.Background())
+	if err != nil {
+		t.Fatalf("Ошибка чтения реестра: %v", err)
+	}
+	if len(instruments) != 2 {
+		t.Fatalf("Ожидалось 2 инструмента в реестре, найдено: %d", len(instruments))
+	}
+	if instruments["XAUUSD"].ContractSize != 50 {
+		t.Errorf("Ожидался размер контракта 50, получено: %v", instruments["XAUUSD"].ContractSize)
+	}
+	if instruments["USDJPY"].QuoteCurrency != "JPY" {
+		t.Errorf("Ожидалась валюта котировки JPY, получено: %s", instruments["USDJPY"].QuoteCurrency)
+	}
+}
+
+func TestStoreInstruments_Invalid(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+
+	err := store.StoreInstruments(context.Background(), []model.Instrument{
+		{Symbol: "XAUUSD", ContractSize: 100, PipSize: 0.01, QuoteCurrency: "USD", Precision: 2},
+		{Symbol: "BAD/SYM", ContractSize: 100, PipSize: 0.01, QuoteCurrency: "USD", Precision: 2},
+	})
+	if err == nil {
+		t.Fatal("Ожидалась ошибка для невалидного инструмента")
+	}
+
+	instruments, err := store.Instruments(context.Background())
+	if err != nil {
+		t.Fatalf("Ошибка чтения реестра: %v", err)
+	}
+	if len(instruments) != 0 {
+		t.Errorf("Ожидалось, что транзакция будет откачена, но найдено инструментов: %d", len(instruments))
+	}
+}
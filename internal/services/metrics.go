@@ -0,0 +1,209 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/metrics"
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+// Причины отказа в постановке сделки для broker_trade_validation_failures_total,
+// помимо model.ValidationError.Reason
+const (
+	reasonInvalidJSON       = "invalid_json"
+	reasonIdempotencyKey    = "idempotency_key_mismatch"
+	reasonInvalidBatch      = "invalid_batch"
+	reasonEmptyBatch        = "empty_batch"
+	reasonBatchTooLarge     = "batch_too_large"
+	reasonClientIDConflict  = "client_trade_id_conflict"
+	reasonValidationUnknown = "other"
+)
+
+// Время, за которое метрика глубины очереди должна получить ответ базы
+const queueDepthTimeout = 2 * time.Second
+
+// ServerMetrics - метрики HTTP API. Нулевой указатель ничего не записывает.
+type ServerMetrics struct {
+	requests           *metrics.Counter
+	duration           *metrics.Histogram
+	validationFailures *metrics.Counter
+	enqueueErrors      *metrics.Counter
+}
+
+// NewServerMetrics регистрирует метрики HTTP API в reg
+func NewServerMetrics(reg *metrics.Registry) *ServerMetrics {
+	return &ServerMetrics{
+		requests: reg.NewCounter("broker_http_requests_total",
+			"HTTP requests by route pattern, method and status code.", "route", "method", "status"),
+		duration: reg.NewHistogram("broker_http_request_duration_seconds",
+			"HTTP request latency by route pattern, method and status code.", metrics.DefaultBuckets, "route", "method", "status"),
+		validationFailures: reg.NewCounter("broker_trade_validation_failures_total",
+			"Trades rejected by POST /trades and POST /trades/batch by reason.", "reason"),
+		enqueueErrors: reg.NewCounter("broker_enqueue_errors_total",
+			"Storage errors while enqueueing trades."),
+	}
+}
+
+// WithServerMetrics включает запись метрик обработчиками сделок
+func WithServerMetrics(m *ServerMetrics) ServerServiceOption {
+	return func(s *ServerService) {
+		s.metrics = m
+	}
+}
+
+// Handler оборачивает next и считает запросы по шаблону маршрута ServeMux,
+// чтобы значения путей (/stats/{acc}) не порождали новые ряды
+func (m *ServerMetrics) Handler(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		labels := []string{routeLabel(r.Pattern), r.Method, strconv.Itoa(sw.status)}
+		m.requests.Inc(labels...)
+		m.duration.Observe(time.Since(start).Seconds(), labels...)
+	})
+}
+
+// routeLabel убирает метод из шаблона маршрута ("GET /admin/rates" -> "/admin/rates")
+func routeLabel(pattern string) string {
+	if pattern == "" {
+		return "unmatched"
+	}
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		return strings.TrimSpace(pattern[i+1:])
+	}
+	return pattern
+}
+
+// validationFailed учитывает отклоненную сделку с причиной reason
+func (m *ServerMetrics) validationFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.validationFailures.Inc(reason)
+}
+
+// invalidTrade учитывает ошибку проверки сделки по причине из model.ValidationError
+func (m *ServerMetrics) invalidTrade(err error) {
+	reason := reasonValidationUnknown
+	var verr *model.ValidationError
+	if errors.As(err, &verr) {
+		reason = verr.Reason
+	}
+	m.validationFailed(reason)
+}
+
+// enqueueFailed учитывает ошибку хранилища при постановке в очередь
+func (m *ServerMetrics) enqueueFailed() {
+	if m == nil {
+		return
+	}
+	m.enqueueErrors.Inc()
+}
+
+// statusWriter запоминает код ответа для метрик и лога запросов
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap нужен http.ResponseController для доступа к Flush и дедлайнам
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// WorkerMetrics - метрики обработки очереди. Нулевой указатель ничего не записывает.
+type WorkerMetrics struct {
+	processed     *metrics.Counter
+	failed        *metrics.Counter
+	retried       *metrics.Counter
+	amended       *metrics.Counter
+	batchDuration *metrics.Histogram
+	latency       *metrics.Histogram
+}
+
+// Границы гистограммы задержки от постановки в очередь до обработки в секундах.
+// Время постановки хранится с точностью до секунды, поэтому мелкие корзины не нужны.
+var latencyBuckets = []float64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// NewWorkerMetrics регистрирует метрики воркера в reg. Глубина очереди
+// запрашивается у store при каждом чтении метрик.
+func NewWorkerMetrics(reg *metrics.Registry, store storage.Store) *WorkerMetrics {
+	reg.NewGaugeFunc("broker_queue_depth", "Trades waiting in the queue (NaN if storage is unavailable).", func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), queueDepthTimeout)
+		defer cancel()
+		stats, err := store.QueueStats(ctx)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(stats.Pending)
+	})
+	return &WorkerMetrics{
+		processed: reg.NewCounter("broker_worker_trades_processed_total",
+			"Trades applied to account statistics."),
+		failed: reg.NewCounter("broker_worker_trades_failed_total",
+			"Trades moved to dead-letter after a permanent error or too many attempts."),
+		retried: reg.NewCounter("broker_worker_trades_retried_total",
+			"Trades left in the queue after a temporary error."),
+		amended: reg.NewCounter("broker_worker_amendments_applied_total",
+			"Trade cancellations and corrections applied to account statistics."),
+		batchDuration: reg.NewHistogram("broker_worker_batch_duration_seconds",
+			"Time to claim and process one batch of trades.", metrics.DefaultBuckets),
+		latency: reg.NewHistogram("broker_trade_processing_latency_seconds",
+			"Time from enqueueing a trade to applying it.", latencyBuckets),
+	}
+}
+
+// WithWorkerMetrics включает запись метрик обработки очереди
+func WithWorkerMetrics(m *WorkerMetrics) TradeServiceOption {
+	return func(s *TradeService) {
+		s.metrics = m
+	}
+}
+
+// amendmentApplied учитывает отмену или исправление, примененное к статистике
+func (m *WorkerMetrics) amendmentApplied() {
+	if m == nil {
+		return
+	}
+	m.amended.Inc()
+}
+
+// batchDone учитывает зафиксированную порцию с примененными сделками processed
+func (m *WorkerMetrics) batchDone(result BatchResult, processed []storage.QueuedTrade, elapsed time.Duration, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.batchDuration.Observe(elapsed.Seconds())
+	m.processed.Add(float64(result.Processed))
+	m.failed.Add(float64(result.Failed))
+	m.retried.Add(float64(result.Retried))
+	for _, trade := range processed {
+		m.latency.Observe(math.Max(0, now.Sub(time.Unix(trade.CreatedAt, 0)).Seconds()))
+	}
+}
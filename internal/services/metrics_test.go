@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/digineat/go-broker-test/internal/metrics"
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+// enqueueFailingStore - хранилище, в котором постановка в очередь завершается ошибкой
+type enqueueFailingStore struct {
+	storage.Store
+}
+
+func (s enqueueFailingStore) EnqueueTrade(ctx context.Context, trade model.Trade) (storage.EnqueuedTrade, error) {
+	return storage.EnqueuedTrade{}, errors.New("disk full")
+}
+
+func (s enqueueFailingStore) EnqueueTrades(ctx context.Context, trades []model.Trade) ([]storage.EnqueuedTrade, error) {
+	return nil, errors.New("disk full")
+}
+
+// commitFailingStore - хранилище, в котором транзакция порции не фиксируется
+type commitFailingStore struct {
+	storage.Store
+}
+
+func (s commitFailingStore) ProcessBatch(ctx context.Context, fn func(tx storage.BatchTx) error) error {
+	return s.Store.ProcessBatch(ctx, func(tx storage.BatchTx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return errors.New("commit failed")
+	})
+}
+
+// scrape возвращает вывод /metrics
+func scrape(t *testing.T, reg *metrics.Registry) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 from /metrics, got %d", rr.Code)
+	}
+	return rr.Body.String()
+}
+
+func TestServerMetrics(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+
+	reg := metrics.NewRegistry()
+	m := NewServerMetrics(reg)
+	service := NewServerService(store, WithServerMetrics(m))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/trades", service.PostServerTrades())
+	mux.HandleFunc("/trades/batch", service.PostServerTradesBatch())
+	mux.HandleFunc("GET /stats/{acc}", service.GetServerStats())
+	handler := m.Handler(mux)
+
+	do := func(method, path, body string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	t.Run("requests by route", func(t *testing.T) {
+		valid := `{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`
+		if code := do(http.MethodPost, "/trades", valid); code != http.StatusAccepted {
+			t.Fatalf("Expected status 202, got %d", code)
+		}
+		do(http.MethodGet, "/stats/ACC1", "")
+		do(http.MethodGet, "/stats/ACC2", "")
+		do(http.MethodGet, "/nope", "")
+
+		if v := m.requests.Value("/trades", "POST", "202"); v != 1 {
+			t.Errorf("Expected 1 POST /trades 202, got %v", v)
+		}
+		// Значение {acc} не попадает в метки
+		if v := m.requests.Value("/stats/{acc}", "GET", "200"); v != 2 {
+			t.Errorf("Expected 2 GET /stats/{acc} 200, got %v", v)
+		}
+		if v := m.requests.Value("unmatched", "GET", "404"); v != 1 {
+			t.Errorf("Expected 1 unmatched 404, got %v", v)
+		}
+		if c := m.duration.Count("/stats/{acc}", "GET", "200"); c != 2 {
+			t.Errorf("Expected 2 latency observations, got %d", c)
+		}
+	})
+
+	t.Run("validation failures", func(t *testing.T) {
+		do(http.MethodPost, "/trades", `{`)
+		do(http.MethodPost, "/trades", `{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"hold"}`)
+		do(http.MethodPost, "/trades", `{"account":"","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`)
+		do(http.MethodPost, "/trades/batch", `[]`)
+		do(http.MethodPost, "/trades/batch", `[{"account":"ACC1","symbol":"eur","volume":1,"open":1.1,"close":1.2,"side":"buy"}, 5]`)
+
+		for reason, want := range map[string]float64{
+			"invalid_json": 2,
+			"side":         1,
+			"account":      1,
+			"symbol":       1,
+			"empty_batch":  1,
+		} {
+			if v := m.validationFailures.Value(reason); v != want {
+				t.Errorf("Expected %v failures with reason %s, got %v", want, reason, v)
+			}
+		}
+	})
+
+	t.Run("enqueue errors", func(t *testing.T) {
+		failing := NewServerService(enqueueFailingStore{store}, WithServerMetrics(m))
+		valid := `{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`
+
+		rr := httptest.NewRecorder()
+		failing.PostServerTrades().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/trades", strings.NewReader(valid)))
+		rr = httptest.NewRecorder()
+		failing.PostServerTradesBatch().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/trades/batch", strings.NewReader("["+valid+"]")))
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status 500, got %d", rr.Code)
+		}
+		if v := m.enqueueErrors.Value(); v != 2 {
+			t.Errorf("Expected 2 enqueue errors, got %v", v)
+		}
+	})
+
+	t.Run("exposition", func(t *testing.T) {
+		out := scrape(t, reg)
+		for _, line := range []string{
+			`broker_http_requests_total{route="/trades",method="POST",status="202"} 1`,
+			`broker_http_request_duration_seconds_count{route="/stats/{acc}",method="GET",status="200"} 2`,
+			`broker_trade_validation_failures_total{reason="invalid_json"} 2`,
+			`broker_enqueue_errors_total 2`,
+		} {
+			if !strings.Contains(out, line+"\n") {
+				t.Errorf("Expected %q in output:\n%s", line, out)
+			}
+		}
+	})
+}
+
+func TestServerMetrics_Nil(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+
+	// Без метрик обработчики работают как прежде
+	var m *ServerMetrics
+	service := NewServerService(store)
+	rr := httptest.NewRecorder()
+	m.Handler(service.PostServerTrades()).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/trades", strings.NewReader(`{`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", rr.Code)
+	}
+}
+
+func TestWorkerMetrics(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+
+	reg := metrics.NewRegistry()
+	m := NewWorkerMetrics(reg, store)
+	service := NewTradeService(store, WithWorkerMetrics(m), WithMaxAttempts(1))
+
+	enqueueTestTrades(t, store,
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "sell"),
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "hold"),
+	)
+	if out := scrape(t, reg); !strings.Contains(out, "broker_queue_depth 3\n") {
+		t.Errorf("Expected queue depth 3 before processing:\n%s", out)
+	}
+
+	if err := service.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("ProcessTrades failed: %v", err)
+	}
+
+	if v := m.processed.Value(); v != 2 {
+		t.Errorf("Expected 2 processed trades, got %v", v)
+	}
+	if v := m.failed.Value(); v != 1 {
+		t.Errorf("Expected 1 failed trade, got %v", v)
+	}
+	if c := m.batchDuration.Count(); c != 1 {
+		t.Errorf("Expected 1 batch observation, got %d", c)
+	}
+	if c := m.latency.Count(); c != 2 {
+		t.Errorf("Expected 2 latency observations, got %d", c)
+	}
+	out := scrape(t, reg)
+	for _, line := range []string{
+		"broker_queue_depth 0",
+		"broker_worker_trades_processed_total 2",
+		"broker_worker_trades_failed_total 1",
+		"broker_worker_batch_duration_seconds_count 1",
+		"broker_trade_processing_latency_seconds_count 2",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected %q in output:\n%s", line, out)
+		}
+	}
+
+	t.Run("rolled back batch", func(t *testing.T) {
+		service := NewTradeService(commitFailingStore{store}, WithWorkerMetrics(m))
+		enqueueTestTrades(t, store, testTrade("ACC2", "EURUSD", 1, 1.1, 1.2, "buy"))
+
+		if err := service.ProcessTrades(context.Background()); err == nil {
+			t.Fatal("Expected error from ProcessTrades")
+		}
+		// Откатившаяся порция не учитывается
+		if v := m.processed.Value(); v != 2 {
+			t.Errorf("Expected 2 processed trades, got %v", v)
+		}
+		if c := m.latency.Count(); c != 2 {
+			t.Errorf("Expected 2 latency observations, got %d", c)
+		}
+	})
+}
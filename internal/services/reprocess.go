@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+// ReprocessOptions - параметры пересборки статистики
+type ReprocessOptions struct {
+	Scope storage.RebuildScope
+	// DryRun - только сравнить пересобранную статистику с рабочей, не заменяя ее
+	DryRun bool
+}
+
+// ReprocessReport - итог пересборки статистики
+type ReprocessReport struct {
+	Account string     `json:"account,omitempty"`
+	From    *time.Time `json:"from,omitempty"`
+	To      *time.Time `json:"to,omitempty"`
+	DryRun  bool       `json:"dry_run"`
+	// Applied - рабочая статистика заменена пересобранной
+	Applied bool `json:"applied"`
+	// Trades - обработанные сделки области пересборки, Recalculated - сделки с пересчитанной
+	// прибылью, Changed - сделки, прибыль которых после пересчета изменилась
+	Trades       int `json:"trades"`
+	Recalculated int `json:"recalculated"`
+	Changed      int `json:"changed"`
+	// Failures - сделки, прибыль которых не удалось пересчитать. Если они есть,
+	// рабочая статистика не заменяется.
+	Failures []ReprocessFailure `json:"failures,omitempty"`
+	Diff     []StatsDiff        `json:"diff"`
+}
+
+// ReprocessFailure - сделка, которую не удалось пересчитать
+type ReprocessFailure struct {
+	TradeID int64  `json:"trade_id"`
+	Reason  string `json:"reason"`
+}
+
+// StatsDiff - строка статистики, отличающаяся в рабочих и пересобранных агрегатах
+type StatsDiff struct {
+	// Table - account_stats, account_symbol_stats или account_pnl_history
+	Table   string `json:"table"`
+	Account string `json:"account"`
+	Symbol  string `json:"symbol,omitempty"`
+	Side    string `json:"side,omitempty"`
+	Period  string `json:"period,omitempty"`
+	// Bucket - начало периода истории прибыли
+	Bucket  *time.Time  `json:"bucket,omitempty"`
+	Live    StatsValues `json:"live"`
+	Rebuilt StatsValues `json:"rebuilt"`
+}
+
+// StatsValues - значения строки статистики; volume, gross_profit, gross_loss и wins
+// есть только у статистики по символам
+type StatsValues struct {
+	Trades      int     `json:"trades"`
+	Profit      float64 `json:"profit"`
+	Volume      float64 `json:"volume,omitempty"`
+	GrossProfit float64 `json:"gross_profit,omitempty"`
+	GrossLoss   float64 `json:"gross_loss,omitempty"`
+	Wins        int     `json:"wins,omitempty"`
+}
+
+// ParseRebuildScope разбирает область пересборки: аккаунт и период from-to
+// (RFC 3339 или YYYY-MM-DD, to не включается). Пустые значения не ограничивают область.
+func ParseRebuildScope(account, from, to string) (storage.RebuildScope, error) {
+	scope := storage.RebuildScope{Account: account}
+	if from != "" {
+		t, err := parseTimeParam(from)
+		if err != nil {
+			return scope, fmt.Errorf("Invalid from: %v", err)
+		}
+		scope.From = t.Unix()
+	}
+	if to != "" {
+		t, err := parseTimeParam(to)
+		if err != nil {
+			return scope, fmt.Errorf("Invalid to: %v", err)
+		}
+		scope.To = t.Unix()
+	}
+	if scope.From != 0 && scope.To != 0 && scope.From >= scope.To {
+		return scope, fmt.Errorf("from must be before to")
+	}
+	return scope, nil
+}
+
+// Reprocess пересобирает статистику из обработанных сделок trades_q в теневые агрегаты
+// и сравнивает их с рабочими. Прибыль сделок из периода opts.Scope пересчитывается
+// по текущему реестру инструментов и курсам, остальные сделки учитываются с сохраненной
+// прибылью. Если не задан DryRun и все сделки пересчитаны, рабочие агрегаты области
+// и прибыль сделок заменяются пересобранными в той же транзакции.
+func (s *TradeService) Reprocess(ctx context.Context, opts ReprocessOptions) (ReprocessReport, error) {
+	report := ReprocessReport{
+		Account: opts.Scope.Account,
+		From:    unixTime(opts.Scope.From),
+		To:      unixTime(opts.Scope.To),
+		DryRun:  opts.DryRun,
+	}
+
+	started := time.Now()
+	err := s.store.Rebuild(ctx, opts.Scope, func(tx storage.RebuildTx) error {
+		env, err := loadProcessingEnv(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		var afterID int64
+		for {
+			trades, err := tx.ProcessedTrades(ctx, afterID, s.batchSize)
+			if err != nil {
+				return err
+			}
+			for _, trade := range trades {
+				afterID = trade.ID
+				result, err := s.rebuildTrade(ctx, tx, env, opts.Scope, trade, &report)
+				if err != nil {
+					return err
+				}
+				if err := tx.AddTrade(ctx, result); err != nil {
+					return err
+				}
+			}
+			if len(trades) < s.batchSize {
+				break
+			}
+		}
+
+		diff, err := tx.Diff(ctx)
+		if err != nil {
+			return err
+		}
+		report.Diff = make([]StatsDiff, 0, len(diff))
+		for _, d := range diff {
+			report.Diff = append(report.Diff, newStatsDiff(d))
+		}
+
+		if opts.DryRun || len(report.Failures) > 0 {
+			return nil
+		}
+		if err := tx.Swap(ctx); err != nil {
+			return err
+		}
+		report.Applied = true
+		return nil
+	})
+	if err != nil {
+		return ReprocessReport{}, err
+	}
+
+	s.logger.InfoContext(ctx, "stats rebuilt",
+		"account", opts.Scope.Account, "dry_run", opts.DryRun, "applied", report.Applied,
+		"trades", report.Trades, "recalculated", report.Recalculated, "changed", report.Changed,
+		"failures", len(report.Failures), "diff", len(report.Diff), "duration", time.Since(started).String())
+	return report, nil
+}
+
+// rebuildTrade возвращает вклад сделки в пересобранные агрегаты: пересчитанный, если сделка
+// попадает в период scope, иначе сохраненный. Сделка, которую не удалось пересчитать,
+// учитывается с сохраненной прибылью и попадает в report.Failures.
+func (s *TradeService) rebuildTrade(ctx context.Context, tx storage.RebuildTx, env *processingEnv, scope storage.RebuildScope, trade storage.TradeRecord, report *ReprocessReport) (storage.AppliedTrade, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.AppliedTrade{}, fmt.Errorf("rebuild interrupted: %v", err)
+	}
+	report.Trades++
+
+	stored := storedResult(trade)
+	if !scope.Recalculates(stored.Time) {
+		return stored, nil
+	}
+
+	result, err := s.settle(ctx, tx, env, trade.QueuedTrade)
+	if err != nil {
+		if ctx.Err() != nil {
+			return storage.AppliedTrade{}, fmt.Errorf("rebuild interrupted: %v", ctx.Err())
+		}
+		report.Failures = append(report.Failures, ReprocessFailure{TradeID: trade.ID, Reason: err.Error()})
+		return stored, nil
+	}
+	report.Recalculated++
+	if result.Profit != stored.Profit || result.ConvertedProfit != stored.ConvertedProfit ||
+		result.QuoteCurrency != stored.QuoteCurrency || result.AccountCurrency != stored.AccountCurrency {
+		report.Changed++
+	}
+	return result, nil
+}
+
+func newStatsDiff(d storage.AggregateDiff) StatsDiff {
+	diff := StatsDiff{
+		Table:   d.Table,
+		Account: d.Account,
+		Symbol:  d.Symbol,
+		Side:    d.Side,
+		Period:  d.Period,
+		Live:    StatsValues(d.Live),
+		Rebuilt: StatsValues(d.Rebuilt),
+	}
+	if d.Table == storage.TableHistory {
+		bucket := time.Unix(d.Bucket, 0).UTC()
+		diff.Bucket = &bucket
+	}
+	return diff
+}
+
+// WithRebuildService задает сервис, который пересобирает статистику по POST /admin/reprocess.
+// Он должен считать прибыль так же, как воркеры; по умолчанию используется
+// NewTradeService с настройками по умолчанию.
+func WithRebuildService(t *TradeService) ServerServiceOption {
+	return func(s *ServerService) {
+		if t != nil {
+			s.rebuilder = t
+		}
+	}
+}
+
+// rebuildRetryAfter - подсказка клиенту в Retry-After, пока идет пересборка статистики
+const rebuildRetryAfter = "5"
+
+// rejectDuringRebuild отвечает 503, если идет пересборка статистики, а хранилище на это
+// время не принимает запись (SQLite, хранилище в памяти). Иначе запрос ждал бы конца
+// пересборки и на SQLite завершался бы ошибкой по истечении busy_timeout.
+func (s *ServerService) rejectDuringRebuild(w http.ResponseWriter) bool {
+	if !s.rebuilding.Load() || !s.store.RebuildBlocksWrites() {
+		return false
+	}
+	w.Header().Set("Retry-After", rebuildRetryAfter)
+	http.Error(w, "Stats rebuild is running, retry later", http.StatusServiceUnavailable)
+	return true
+}
+
+// POST /admin/reprocess endpoint
+func (s *ServerService) PostAdminReprocess() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		scope, err := ParseRebuildScope(query.Get("account"), query.Get("from"), query.Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var dryRun bool
+		if v := query.Get("dry_run"); v != "" {
+			dryRun, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid dry_run", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Одновременно идет только одна пересборка: вторая ждала бы блокировки агрегатов
+		if !s.rebuilding.CompareAndSwap(false, true) {
+			http.Error(w, "Stats rebuild is already running", http.StatusConflict)
+			return
+		}
+		defer s.rebuilding.Store(false)
+
+		// Пересборка читает всю историю сделок и не ограничивается таймаутом запросов к базе
+		ctx := r.Context()
+		report, err := s.rebuilder.Reprocess(ctx, ReprocessOptions{Scope: scope, DryRun: dryRun})
+		if errors.Is(err, storage.ErrRebuildAmendmentsPending) {
+			http.Error(w, "Trade amendments are pending, retry after the worker applies them", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			dbError(ctx, w, "Failed to rebuild stats", err)
+			return
+		}
+
+		status := http.StatusOK
+		if !dryRun && !report.Applied {
+			slog.WarnContext(ctx, "stats rebuild not applied", "failures", len(report.Failures))
+			status = http.StatusUnprocessableEntity
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+func TestReprocess(t *testing.T) {
+	ctx := context.Background()
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	service := NewTradeService(store)
+
+	enqueueTestTrades(t, store,
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("ACC1", "EURUSD", 1, 1.2, 1.1, "sell"),
+		testTrade("ACC2", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("ACC3", "GBPUSD", 1, 1.1, 1.2, "buy"),
+	)
+	if err := service.ProcessTrades(ctx); err != nil {
+		t.Fatalf("ProcessTrades failed: %v", err)
+	}
+
+	// Размер контракта изменился после обработки сделок, GBPUSD больше не торгуется
+	err := store.StoreInstruments(ctx, []model.Instrument{
+		{Symbol: "EURUSD", ContractSize: 1000, PipSize: 0.0001, QuoteCurrency: "USD", Precision: 5},
+	})
+	if err != nil {
+		t.Fatalf("Failed to store instruments: %v", err)
+	}
+	profit := func(t *testing.T, account string) float64 {
+		t.Helper()
+		stats, err := store.AccountStats(ctx, account)
+		if err != nil {
+			t.Fatalf("Failed to get stats: %v", err)
+		}
+		return stats.Profit
+	}
+	reprocess := func(t *testing.T, opts ReprocessOptions) ReprocessReport {
+		t.Helper()
+		report, err := service.Reprocess(ctx, opts)
+		if err != nil {
+			t.Fatalf("Reprocess failed: %v", err)
+		}
+		return report
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		report := reprocess(t, ReprocessOptions{Scope: storage.RebuildScope{Account: "ACC1"}, DryRun: true})
+		if report.Applied || report.Trades != 2 || report.Recalculated != 2 || report.Changed != 2 || len(report.Failures) != 0 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		// Строки account_stats, account_symbol_stats по buy и sell и история за день и час
+		if len(report.Diff) != 5 {
+			t.Fatalf("Expected 5 changed rows, got %+v", report.Diff)
+		}
+		if d := report.Diff[0]; d.Table != storage.TableAccountStats ||
+			d.Live != (StatsValues{Trades: 2, Profit: 20000}) || d.Rebuilt != (StatsValues{Trades: 2, Profit: 200}) {
+			t.Errorf("Unexpected account diff %+v", d)
+		}
+		if d := report.Diff[3]; d.Table != storage.TableHistory || d.Bucket == nil {
+			t.Errorf("Expected history diff with bucket, got %+v", d)
+		}
+		if p := profit(t, "ACC1"); p != 20000 {
+			t.Errorf("Expected live stats unchanged, got %v", p)
+		}
+	})
+
+	t.Run("account scope", func(t *testing.T) {
+		report := reprocess(t, ReprocessOptions{Scope: storage.RebuildScope{Account: "ACC2"}})
+		if !report.Applied || report.Trades != 1 || len(report.Diff) != 4 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		if p := profit(t, "ACC2"); p != 100 {
+			t.Errorf("Expected rebuilt profit 100, got %v", p)
+		}
+		if p := profit(t, "ACC1"); p != 20000 {
+			t.Errorf("Expected ACC1 unchanged, got %v", p)
+		}
+		if trade := queuedTrade(t, store, 3); trade.Profit != 100 || trade.ConvertedProfit != 100 {
+			t.Errorf("Expected recalculated trade profit, got %+v", trade)
+		}
+	})
+
+	t.Run("date range", func(t *testing.T) {
+		tomorrow := time.Now().Add(24 * time.Hour).Unix()
+		report := reprocess(t, ReprocessOptions{Scope: storage.RebuildScope{Account: "ACC1", From: tomorrow}})
+		if !report.Applied || report.Trades != 2 || report.Recalculated != 0 || len(report.Diff) != 0 {
+			t.Errorf("Expected nothing to recalculate, got %+v", report)
+		}
+		if p := profit(t, "ACC1"); p != 20000 {
+			t.Errorf("Expected ACC1 unchanged, got %v", p)
+		}
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		report := reprocess(t, ReprocessOptions{})
+		if report.Applied || report.Trades != 4 || len(report.Failures) != 1 || report.Failures[0].TradeID != 4 {
+			t.Errorf("Expected unapplied rebuild with GBPUSD failure, got %+v", report)
+		}
+		if p := profit(t, "ACC1"); p != 20000 {
+			t.Errorf("Expected ACC1 unchanged, got %v", p)
+		}
+
+		report = reprocess(t, ReprocessOptions{Scope: storage.RebuildScope{Account: "ACC1"}})
+		if !report.Applied {
+			t.Errorf("Expected ACC1 rebuild to be applied, got %+v", report)
+		}
+		if p := profit(t, "ACC1"); p != 200 {
+			t.Errorf("Expected rebuilt profit 200, got %v", p)
+		}
+	})
+}
+
+func TestPostAdminReprocess(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	enqueueTestTrades(t, store, testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"))
+	if err := NewTradeService(store).ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("ProcessTrades failed: %v", err)
+	}
+	logs := captureLogs(t)
+	rebuilder := NewTradeService(store, WithBatchSize(1))
+	service := NewServerService(store, WithRebuildService(rebuilder))
+	handler := service.PostAdminReprocess()
+
+	post := func(method, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+
+	rr := post(http.MethodPost, "/admin/reprocess?account=ACC1&from=2026-01-01&dry_run=true")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var report ReprocessReport
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !report.DryRun || report.Account != "ACC1" || report.From == nil || report.Trades != 1 || len(report.Diff) != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	// Пересборку выполняет переданный сервис
+	if entries := logEntries(t, logs, "stats rebuilt"); len(entries) != 1 || entries[0]["worker_id"] != rebuilder.WorkerID() {
+		t.Errorf("Expected rebuild by worker %s, got %+v", rebuilder.WorkerID(), entries)
+	}
+
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{http.MethodPost, "/admin/reprocess", http.StatusOK},
+		{http.MethodPost, "/admin/reprocess?from=yesterday", http.StatusBadRequest},
+		{http.MethodPost, "/admin/reprocess?from=2026-02-01&to=2026-01-01", http.StatusBadRequest},
+		{http.MethodPost, "/admin/reprocess?dry_run=maybe", http.StatusBadRequest},
+		{http.MethodGet, "/admin/reprocess", http.StatusMethodNotAllowed},
+	} {
+		if rr := post(c.method, c.target); rr.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.target, c.code, rr.Code)
+		}
+	}
+
+	if _, err := store.AmendTrade(context.Background(), storage.Amendment{TradeID: 1, Action: model.AmendmentCancel}); err != nil {
+		t.Fatalf("Failed to cancel trade: %v", err)
+	}
+	if rr := post(http.MethodPost, "/admin/reprocess"); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while amendment is pending, got %d", rr.Code)
+	}
+}
+
+// blockingRebuildStore держит пересборку статистики, пока не закрыт release
+type blockingRebuildStore struct {
+	storage.Store
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingRebuildStore) Rebuild(ctx context.Context, scope storage.RebuildScope, fn func(tx storage.RebuildTx) error) error {
+	close(s.started)
+	<-s.release
+	return s.Store.Rebuild(ctx, scope, fn)
+}
+
+func TestPostAdminReprocess_RejectsWrites(t *testing.T) {
+	memory, cleanup := SetupTestStore(t)
+	defer cleanup()
+	store := &blockingRebuildStore{Store: memory, started: make(chan struct{}), release: make(chan struct{})}
+	service := NewServerService(store, WithRebuildService(NewTradeService(store)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /trades", service.PostServerTrades())
+	mux.HandleFunc("/trades/batch", service.PostServerTradesBatch())
+	mux.HandleFunc("/trades/{id}", service.ServerTrade())
+	mux.HandleFunc("POST /admin/rates", service.PostAdminRates())
+	mux.HandleFunc("/admin/accounts/{acc}", service.PutAdminAccount())
+	mux.HandleFunc("/admin/dead-letters/{id}/retry", service.PostAdminDeadLetterRetry())
+	mux.HandleFunc("/admin/dead-letters/{id}", service.DeleteAdminDeadLetter())
+	mux.HandleFunc("/admin/reprocess", service.PostAdminReprocess())
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rr
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(http.MethodPost, "/admin/reprocess", "") }()
+	<-store.started
+
+	// Пока идет пересборка, вторая получает 409, а запись - 503 без ожидания блокировки
+	if rr := serve(http.MethodPost, "/admin/reprocess", ""); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 while rebuild is running, got %d", rr.Code)
+	}
+	writes := []struct{ method, target, body string }{
+		{http.MethodPost, "/trades", `{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`},
+		{http.MethodPost, "/trades/batch", `[{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}]`},
+		{http.MethodPatch, "/trades/1", `{"volume":2}`},
+		{http.MethodDelete, "/trades/1", ""},
+		{http.MethodPost, "/admin/rates", `[{"from":"EUR","to":"USD","rate":1.1}]`},
+		{http.MethodPut, "/admin/accounts/ACC1", `{"currency":"EUR"}`},
+		{http.MethodPost, "/admin/dead-letters/1/retry", ""},
+		{http.MethodDelete, "/admin/dead-letters/1", ""},
+	}
+	for _, c := range writes {
+		if rr := serve(c.method, c.target, c.body); rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%s %s: expected 503 with Retry-After, got %d", c.method, c.target, rr.Code)
+		}
+	}
+
+	close(store.release)
+	if rr := <-done; rr.Code != http.StatusOK {
+		t.Fatalf("Expected rebuild to finish with 200, got %d: %s", rr.Code, rr.Body)
+	}
+	// После пересборки запись снова принимается
+	if rr := serve(writes[0].method, writes[0].target, writes[0].body); rr.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 after rebuild, got %d", rr.Code)
+	}
+}
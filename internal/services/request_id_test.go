@@ -0,0 +1,144 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/digineat/go-broker-test/internal/logging"
+)
+
+// captureLogs перенаправляет логгер по умолчанию в JSON-буфер до конца теста
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, logging.FormatJSON, "debug")
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// logEntries разбирает записи JSON-лога с сообщением msg
+func logEntries(t *testing.T, buf *bytes.Buffer, msg string) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Failed to decode log line %q: %v", line, err)
+		}
+		if entry["msg"] == msg {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	logs := captureLogs(t)
+
+	var seen string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats/{acc}", func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := RequestIDHandler(mux)
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "client id", header: "abc-123", keep: true},
+		{name: "generated id", header: ""},
+		{name: "invalid id replaced", header: "has space"},
+		{name: "too long id replaced", header: strings.Repeat("x", maxRequestIDLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest(http.MethodGet, "/stats/ACC1", nil)
+			if tt.header != "" {
+				req.Header.Set(requestIDHeader, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			id := rr.Header().Get(requestIDHeader)
+			if id == "" || id != seen {
+				t.Fatalf("Expected response id %q to match handler id %q", id, seen)
+			}
+			if tt.keep != (id == tt.header) {
+				t.Errorf("Unexpected request id %q for header %q", id, tt.header)
+			}
+
+			entries := logEntries(t, logs, "http request")
+			if len(entries) != 1 {
+				t.Fatalf("Expected 1 request log entry, got %d: %s", len(entries), logs)
+			}
+			entry := entries[0]
+			if entry["request_id"] != id || entry["route"] != "/stats/{acc}" || entry["status"] != float64(http.StatusTeapot) {
+				t.Errorf("Unexpected log entry %v", entry)
+			}
+		})
+	}
+}
+
+func TestRequestID_Traced(t *testing.T) {
+	logs := captureLogs(t)
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+
+	server := NewServerService(store)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/trades", server.PostServerTrades())
+	mux.HandleFunc("/trades/batch", server.PostServerTradesBatch())
+	handler := RequestIDHandler(mux)
+
+	post := func(path, id, body string) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(requestIDHeader, id)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted && rr.Code != http.StatusOK {
+			t.Fatalf("Expected success for %s, got %d: %s", path, rr.Code, rr.Body)
+		}
+	}
+	trade := `{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`
+	post("/trades", "single-1", trade)
+	post("/trades/batch", "batch-1", "["+trade+","+strings.Replace(trade, "buy", "sell", 1)+"]")
+
+	for id, want := range map[int64]string{1: "single-1", 2: "batch-1", 3: "batch-1"} {
+		if got := queuedTrade(t, store, id).RequestID; got != want {
+			t.Errorf("Expected trade %d with request id %q, got %q", id, want, got)
+		}
+	}
+
+	worker := NewTradeService(store, WithWorkerID("w1"))
+	if err := worker.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("ProcessTrades failed: %v", err)
+	}
+	entries := logEntries(t, logs, "trade processed")
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 processed trade log entries, got %d: %s", len(entries), logs)
+	}
+	for _, entry := range entries {
+		want := "batch-1"
+		if entry["trade_id"] == float64(1) {
+			want = "single-1"
+		}
+		if entry["request_id"] != want || entry["worker_id"] != "w1" {
+			t.Errorf("Unexpected log entry %v", entry)
+		}
+	}
+}
@@ -1,63 +1,452 @@
 package services
 
 import (
-	"database/sql"
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"gitlab.com/digineat/go-broker-test/internal/db"
+	"gitlab.com/digineat/go-broker-test/internal/logging"
 	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
 )
 
-type SqliteRepository struct {
-	db *sql.DB
+// Заголовок с ключом идемпотентности, альтернатива полю client_trade_id
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Максимальное количество сделок в одном запросе POST /trades/batch
+const maxBatchSize = 1000
+
+// Максимальный размер тела POST /trades/batch, с запасом на maxBatchSize сделок
+const maxBatchBodySize = 4 << 20
+
+// errBatchTooLarge - тело POST /trades/batch больше maxBatchBodySize
+var errBatchTooLarge = fmt.Errorf("Batch body must not exceed %d bytes", maxBatchBodySize)
+
+const (
+	BatchStatusAccepted  = "accepted"
+	BatchStatusDuplicate = "duplicate"
+	BatchStatusRejected  = "rejected"
+)
+
+// BatchItemResult описывает результат обработки одной сделки из батча
+type BatchItemResult struct {
+	Index int `json:"index"`
+	// ID - запись очереди для принятой сделки или дубликата
+	ID     int64  `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchResponse - ответ POST /trades/batch
+type BatchResponse struct {
+	Accepted   int               `json:"accepted"`
+	Duplicates int               `json:"duplicates"`
+	Rejected   int               `json:"rejected"`
+	Results    []BatchItemResult `json:"results"`
+}
+
+// ServerService обслуживает HTTP API поверх хранилища
+type ServerService struct {
+	store        storage.Store
+	notifier     EnqueueNotifier
+	queryTimeout time.Duration
+	readiness    ReadinessThresholds
+	// workerStaleAfter - возраст отметки, после которого воркер помечается stale в GET /workers
+	workerStaleAfter time.Duration
+	started          time.Time
+	// now - текущее время для проверок готовности, подменяется в тестах
+	now     func() time.Time
+	metrics *ServerMetrics
+	// processed будит запросы, ожидающие обработки сделки (?wait=)
+	processed *Broadcaster
+	// rebuilder пересобирает статистику по POST /admin/reprocess, rebuilding - пересборка идет
+	rebuilder  *TradeService
+	rebuilding atomic.Bool
+}
+
+type ServerServiceOption func(*ServerService)
+
+// WithEnqueueNotifier задает уведомитель, который вызывается после постановки новых сделок в очередь
+func WithEnqueueNotifier(n EnqueueNotifier) ServerServiceOption {
+	return func(s *ServerService) {
+		s.notifier = n
+	}
+}
+
+// WithQueryTimeout ограничивает время, которое обработчик запроса может провести в базе.
+// Ноль - без ограничения, запросы прерываются только при отключении клиента.
+func WithQueryTimeout(d time.Duration) ServerServiceOption {
+	return func(s *ServerService) {
+		if d > 0 {
+			s.queryTimeout = d
+		}
+	}
+}
+
+// WithProcessedEvents задает источник уведомлений об обработанных сделках,
+// общий со встроенным воркером или с обработчиком PostServerProcessed
+func WithProcessedEvents(b *Broadcaster) ServerServiceOption {
+	return func(s *ServerService) {
+		if b != nil {
+			s.processed = b
+		}
+	}
+}
+
+func NewServerService(store storage.Store, opts ...ServerServiceOption) *ServerService {
+	s := &ServerService{
+		store:            store,
+		processed:        NewBroadcaster(),
+		readiness:        DefaultReadinessThresholds,
+		workerStaleAfter: defaultWorkerStaleAfter,
+		started:          time.Now(),
+		now:              time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.rebuilder == nil {
+		s.rebuilder = NewTradeService(store)
+	}
+	return s
+}
+
+// queryContext возвращает контекст запросов к базе для HTTP-запроса r:
+// он отменяется при отключении клиента и по истечении queryTimeout
+func (s *ServerService) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.queryTimeout > 0 {
+		return context.WithTimeout(r.Context(), s.queryTimeout)
+	}
+	return context.WithCancel(r.Context())
 }
 
-func NewSqliteRepository(db *sql.DB) *SqliteRepository {
-	return &SqliteRepository{db: db}
+// dbError отвечает на ошибку базы: 503, если истек таймаут запроса, иначе 500
+func dbError(ctx context.Context, w http.ResponseWriter, message string, err error) {
+	slog.ErrorContext(ctx, message, "err", err)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "Request timed out", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s: %v", message, err), http.StatusInternalServerError)
+}
+
+// notifyEnqueued будит воркеры, если в очередь добавлены новые сделки
+func (s *ServerService) notifyEnqueued() {
+	if s.notifier != nil {
+		s.notifier.Notify()
+	}
 }
 
 // POST /trades endpoint
-func (s *SqliteRepository) PostServerTrades() http.HandlerFunc {
+func (s *ServerService) PostServerTrades() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if s.rejectDuringRebuild(w) {
+			return
+		}
+
+		wait, err := parseWait(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
 
 		var trade model.Trade
 		if err := json.NewDecoder(r.Body).Decode(&trade); err != nil {
+			s.metrics.validationFailed(reasonInvalidJSON)
 			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
 			return
 		}
 
-		if err := model.ValidateTrade(trade); err != nil {
+		if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+			if trade.ClientTradeID != "" && trade.ClientTradeID != key {
+				s.metrics.validationFailed(reasonIdempotencyKey)
+				http.Error(w, "Idempotency-Key header does not match client_trade_id", http.StatusBadRequest)
+				return
+			}
+			trade.ClientTradeID = key
+		}
+		trade.RequestID = logging.RequestID(r.Context())
+
+		instruments, err := s.store.Instruments(ctx)
+		if err != nil {
+			dbError(ctx, w, "Failed to load instruments", err)
+			return
+		}
+		if err := instruments.ValidateTrade(trade); err != nil {
+			s.metrics.invalidTrade(err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		_, err := s.db.Exec(
-			"INSERT INTO trades_q (account, symbol, volume, open, close, side) VALUES (?, ?, ?, ?, ?, ?)",
-			trade.Account, trade.Symbol, trade.Volume, trade.Open, trade.Close, trade.Side,
-		)
+		result, err := s.store.EnqueueTrade(ctx, trade)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to enqueue trade: %s", err), http.StatusInternalServerError)
+			s.metrics.enqueueFailed()
+			dbError(ctx, w, "Failed to enqueue trade", err)
+			return
+		}
+
+		switch result.Result {
+		case storage.EnqueueConflict:
+			s.metrics.validationFailed(reasonClientIDConflict)
+			http.Error(w, "client_trade_id is already used by a different trade", http.StatusConflict)
 			return
+		case storage.Enqueued:
+			slog.DebugContext(ctx, "trade enqueued", "trade_id", result.ID, "account", trade.Account, "symbol", trade.Symbol)
+			s.notifyEnqueued()
 		}
 
-		w.WriteHeader(http.StatusNoContent)
+		if wait > 0 {
+			record, err := s.waitTrade(r, result.ID, wait)
+			// Сделка уже в очереди, поэтому ошибка ожидания не ошибка запроса:
+			// отвечаем как без ожидания, а результат клиент получит по Location
+			if err != nil {
+				slog.WarnContext(r.Context(), "failed to wait for trade", "trade_id", result.ID, "err", err)
+			}
+			// Результат готов - отвечаем им, иначе как без ожидания
+			if err == nil && finalStatus(record.Status) {
+				w.Header().Set("Location", tradeLocation(result.ID))
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(newTradeResponse(record))
+				return
+			}
+		}
+
+		// Повторная отправка той же сделки получает тот же ответ, что и первая
+		w.Header().Set("Location", tradeLocation(result.ID))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(EnqueueResponse{ID: result.ID})
 	}
 }
 
+// POST /trades/batch endpoint
+func (s *ServerService) PostServerTradesBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.rejectDuringRebuild(w) {
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+		items, err := decodeBatch(r)
+		if err == errBatchTooLarge {
+			s.metrics.validationFailed(reasonBatchTooLarge)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			s.metrics.validationFailed(reasonInvalidBatch)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(items) == 0 {
+			s.metrics.validationFailed(reasonEmptyBatch)
+			http.Error(w, "Batch must not be empty", http.StatusBadRequest)
+			return
+		}
+		if len(items) > maxBatchSize {
+			s.metrics.validationFailed(reasonBatchTooLarge)
+			http.Error(w, fmt.Sprintf("Batch must not exceed %d trades", maxBatchSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		instruments, err := s.store.Instruments(ctx)
+		if err != nil {
+			dbError(ctx, w, "Failed to load instruments", err)
+			return
+		}
+
+		response := BatchResponse{Results: make([]BatchItemResult, len(items))}
+		var (
+			valid  []model.Trade
+			source []int
+		)
+		for i, item := range items {
+			response.Results[i] = BatchItemResult{Index: i, Status: BatchStatusRejected}
+
+			var trade model.Trade
+			if err := json.Unmarshal(item, &trade); err != nil {
+				s.metrics.validationFailed(reasonInvalidJSON)
+				response.Results[i].Error = "Invalid JSON payload"
+				continue
+			}
+			if err := instruments.ValidateTrade(trade); err != nil {
+				s.metrics.invalidTrade(err)
+				response.Results[i].Error = err.Error()
+				continue
+			}
+			trade.RequestID = logging.RequestID(r.Context())
+			valid = append(valid, trade)
+			source = append(source, i)
+		}
+		response.Rejected = len(items) - len(valid)
+
+		// Все валидные сделки ставятся в очередь одной транзакцией
+		var results []storage.EnqueuedTrade
+		if len(valid) > 0 {
+			results, err = s.store.EnqueueTrades(ctx, valid)
+			if err != nil {
+				s.metrics.enqueueFailed()
+				dbError(ctx, w, "Failed to enqueue trades", err)
+				return
+			}
+		}
+
+		for n, result := range results {
+			i := source[n]
+			switch result.Result {
+			case storage.EnqueueDuplicate:
+				response.Results[i].Status = BatchStatusDuplicate
+				response.Results[i].ID = result.ID
+				response.Duplicates++
+			case storage.EnqueueConflict:
+				s.metrics.validationFailed(reasonClientIDConflict)
+				response.Results[i].Error = "client_trade_id is already used by a different trade"
+				response.Rejected++
+			default:
+				response.Results[i].Status = BatchStatusAccepted
+				response.Results[i].ID = result.ID
+				response.Accepted++
+			}
+		}
+		if response.Accepted > 0 {
+			s.notifyEnqueued()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// decodeBatch разбирает тело запроса как JSON-массив или NDJSON-поток (application/x-ndjson).
+// Ошибка возвращается только если не удалось разобрать сам контейнер,
+// отдельные элементы проверяются позже. Чтение останавливается на элементе maxBatchSize+1;
+// если тело больше лимита MaxBytesReader, возвращается errBatchTooLarge.
+func decodeBatch(r *http.Request) ([]json.RawMessage, error) {
+	var (
+		items []json.RawMessage
+		err   error
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" || mediaType == "application/jsonl" {
+		items, err = decodeNDJSON(r.Body)
+	} else {
+		items, err = decodeJSONArray(r.Body)
+	}
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return nil, errBatchTooLarge
+	}
+	return items, err
+}
+
+func decodeJSONArray(body io.Reader) ([]json.RawMessage, error) {
+	invalid := func(err error) error {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			return err
+		}
+		return fmt.Errorf("Invalid JSON payload: expected an array of trades")
+	}
+
+	decoder := json.NewDecoder(body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, invalid(err)
+	}
+	items := []json.RawMessage{}
+	for decoder.More() {
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, invalid(err)
+		}
+		items = append(items, item)
+		if len(items) > maxBatchSize {
+			return items, nil
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, invalid(err)
+	}
+	return items, nil
+}
+
+func decodeNDJSON(body io.Reader) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		// Копируем строку, так как буфер сканера переиспользуется
+		items = append(items, json.RawMessage(bytes.Clone(line)))
+		if len(items) > maxBatchSize {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Invalid NDJSON payload: %v", err)
+	}
+	return items, nil
+}
+
 // GET /healthz endpoint
-func (s *SqliteRepository) GetServerHealthz() http.HandlerFunc {
+func (s *ServerService) GetServerHealthz() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		if err := s.db.Ping(); err != nil {
-			http.Error(w, "Database connection failed", http.StatusInternalServerError)
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		// Тот же отчет самодиагностики, что печатается при запуске
+		report := s.store.SelfCheck(ctx)
+		status := http.StatusOK
+		if !report.OK() {
+			status = http.StatusInternalServerError
+		}
+		if r.URL.Query().Get("verbose") != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(struct {
+				OK     bool       `json:"ok"`
+				Checks []db.Check `json:"checks"`
+			}{report.OK(), report.Checks})
+			return
+		}
+		if err := report.Err(); err != nil {
+			http.Error(w, err.Error(), status)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -66,46 +455,232 @@ func (s *SqliteRepository) GetServerHealthz() http.HandlerFunc {
 }
 
 // GET /stats/{acc} endpoint
-func (s *SqliteRepository) GetServerStats() http.HandlerFunc {
+func (s *ServerService) GetServerStats() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
 		account := r.URL.Path[len("/stats/"):]
 		if account == "" {
 			http.Error(w, "Account is required", http.StatusBadRequest)
 			return
 		}
 
-		row := s.db.QueryRow("SELECT account, trades, profit FROM account_stats WHERE account = ?", account)
-		var (
-			acc    string
-			trades int
-			profit float64
-		)
-		if err := row.Scan(&acc, &trades, &profit); err != nil {
-			if err == sql.ErrNoRows {
-				// Если аккаунт не найден, возвращаем нулевые значения
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"account": account,
-					"trades":  0,
-					"profit":  0.0,
-				})
-				return
-			}
-			http.Error(w, fmt.Sprintf("Failed to fetch stats: %v", err), http.StatusInternalServerError)
+		currency, err := s.store.AccountCurrency(ctx, account)
+		if err != nil {
+			dbError(ctx, w, "Failed to fetch stats", err)
 			return
 		}
 
+		// Если аккаунт не найден, возвращаются нулевые значения
+		stats, err := s.store.AccountStats(ctx, account)
+		if err != nil {
+			dbError(ctx, w, "Failed to fetch stats", err)
+			return
+		}
+
+		// Прибыль хранится в валюте аккаунта
 		response := map[string]interface{}{
-			"account": acc,
-			"trades":  trades,
-			"profit":  profit,
+			"account":  stats.Account,
+			"trades":   stats.Trades,
+			"profit":   stats.Profit,
+			"currency": currency,
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	}
 }
+
+// SymbolStats - статистика аккаунта по символу и направлению сделок
+type SymbolStats struct {
+	Symbol      string  `json:"symbol"`
+	Side        string  `json:"side"`
+	Trades      int     `json:"trades"`
+	Volume      float64 `json:"volume"`
+	GrossProfit float64 `json:"gross_profit"`
+	GrossLoss   float64 `json:"gross_loss"`
+	NetProfit   float64 `json:"net_profit"`
+	WinRate     float64 `json:"win_rate"`
+}
+
+// GET /stats/{acc}/symbols endpoint
+func (s *ServerService) GetServerSymbolStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		account := strings.TrimSuffix(r.URL.Path[len("/stats/"):], "/symbols")
+		if account == "" {
+			http.Error(w, "Account is required", http.StatusBadRequest)
+			return
+		}
+
+		currency, err := s.store.AccountCurrency(ctx, account)
+		if err != nil {
+			dbError(ctx, w, "Failed to fetch stats", err)
+			return
+		}
+
+		rows, err := s.store.SymbolStats(ctx, account)
+		if err != nil {
+			dbError(ctx, w, "Failed to fetch stats", err)
+			return
+		}
+
+		symbols := make([]SymbolStats, 0, len(rows))
+		for _, row := range rows {
+			stats := SymbolStats{
+				Symbol:      row.Symbol,
+				Side:        row.Side,
+				Trades:      row.Trades,
+				Volume:      row.Volume,
+				GrossProfit: row.GrossProfit,
+				GrossLoss:   row.GrossLoss,
+				NetProfit:   roundFloat(row.GrossProfit-row.GrossLoss, profitPrecision),
+			}
+			if row.Trades > 0 {
+				stats.WinRate = roundFloat(float64(row.Wins)/float64(row.Trades), 4)
+			}
+			symbols = append(symbols, stats)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"account":  account,
+			"currency": currency,
+			"symbols":  symbols,
+		})
+	}
+}
+
+// Максимальное количество периодов в ответе GET /stats/{acc}/history
+const maxHistoryBuckets = 5000
+
+// HistoryPoint - прибыль аккаунта за один период
+type HistoryPoint struct {
+	Time   time.Time `json:"time"`
+	Trades int       `json:"trades"`
+	Profit float64   `json:"profit"`
+}
+
+// GET /stats/{acc}/history endpoint
+func (s *ServerService) GetServerHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx, cancel := s.queryContext(r)
+		defer cancel()
+
+		account := strings.TrimSuffix(r.URL.Path[len("/stats/"):], "/history")
+		if account == "" {
+			http.Error(w, "Account is required", http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		interval := query.Get("interval")
+		if interval == "" {
+			interval = "day"
+		}
+		seconds, ok := storage.PeriodSeconds(interval)
+		if !ok {
+			http.Error(w, "interval must be either 'day' or 'hour'", http.StatusBadRequest)
+			return
+		}
+
+		to := time.Now().UTC()
+		if v := query.Get("to"); v != "" {
+			parsed, err := parseTimeParam(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid to: %v", err), http.StatusBadRequest)
+				return
+			}
+			to = parsed
+		}
+		// По умолчанию - последние 30 дней или 48 часов
+		from := to.Add(-30 * 24 * time.Hour)
+		if interval == "hour" {
+			from = to.Add(-48 * time.Hour)
+		}
+		if v := query.Get("from"); v != "" {
+			parsed, err := parseTimeParam(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid from: %v", err), http.StatusBadRequest)
+				return
+			}
+			from = parsed
+		}
+		if !from.Before(to) {
+			http.Error(w, "from must be before to", http.StatusBadRequest)
+			return
+		}
+
+		// Период, в который попадает from, включается целиком
+		fromBucket := from.Unix() - from.Unix()%seconds
+		if (to.Unix()-fromBucket)/seconds > maxHistoryBuckets {
+			http.Error(w, fmt.Sprintf("Range must not exceed %d intervals", maxHistoryBuckets), http.StatusBadRequest)
+			return
+		}
+
+		currency, err := s.store.AccountCurrency(ctx, account)
+		if err != nil {
+			dbError(ctx, w, "Failed to fetch history", err)
+			return
+		}
+
+		buckets, err := s.store.History(ctx, storage.HistoryQuery{
+			Account: account,
+			Period:  interval,
+			From:    fromBucket,
+			To:      to.Unix(),
+		})
+		if err != nil {
+			dbError(ctx, w, "Failed to fetch history", err)
+			return
+		}
+
+		points := make([]HistoryPoint, 0, len(buckets))
+		for _, bucket := range buckets {
+			points = append(points, HistoryPoint{
+				Time:   time.Unix(bucket.Bucket, 0).UTC(),
+				Trades: bucket.Trades,
+				Profit: roundFloat(bucket.Profit, profitPrecision),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"account":  account,
+			"currency": currency,
+			"interval": interval,
+			"from":     from,
+			"to":       to,
+			"points":   points,
+		})
+	}
+}
+
+// parseTimeParam разбирает время в формате RFC 3339 или дату YYYY-MM-DD (UTC)
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 time or YYYY-MM-DD date")
+	}
+	return t, nil
+}
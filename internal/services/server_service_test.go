@@ -2,19 +2,22 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
 )
 
 func TestPostServerTrades(t *testing.T) {
-	dbConn, cleanup := SetupTestDB(t)
+	store, cleanup := SetupTestStore(t)
 	defer cleanup()
-	repo := NewSqliteRepository(dbConn)
+	repo := NewServerService(store)
 	handler := repo.PostServerTrades()
 
 	t.Run("valid trade", func(t *testing.T) {
@@ -24,8 +27,15 @@ func TestPostServerTrades(t *testing.T) {
 		req.Header.Set("Content-Type", "application/json")
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
-		if rr.Code != http.StatusNoContent {
-			t.Errorf("Expected 204, got %d", rr.Code)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202, got %d", rr.Code)
+		}
+		var response EnqueueResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if response.ID != 1 || rr.Header().Get("Location") != "/trades/1" {
+			t.Errorf("Expected id 1 and Location /trades/1, got %d and %q", response.ID, rr.Header().Get("Location"))
 		}
 	})
 
@@ -47,6 +57,31 @@ func TestPostServerTrades(t *testing.T) {
 		}
 	})
 
+	t.Run("unknown instrument", func(t *testing.T) {
+		// Реестр задается в отдельном хранилище, чтобы не влиять на остальные проверки
+		store, cleanup := SetupTestStore(t)
+		defer cleanup()
+		handler := NewServerService(store).PostServerTrades()
+		err := store.StoreInstruments(context.Background(), []model.Instrument{
+			{Symbol: "EURUSD", ContractSize: 100000, PipSize: 0.0001, QuoteCurrency: "USD", Precision: 5},
+		})
+		if err != nil {
+			t.Fatalf("Failed to store instruments: %v", err)
+		}
+
+		trade := model.Trade{Account: "ACC1", Symbol: "XAUUSD", Volume: 1, Open: 2300, Close: 2310, Side: "buy"}
+		body, _ := json.Marshal(trade)
+		req := httptest.NewRequest(http.MethodPost, "/trades", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+		if got := strings.TrimSpace(rr.Body.String()); got != "unknown symbol XAUUSD" {
+			t.Errorf("Unexpected body: %q", got)
+		}
+	})
+
 	t.Run("invalid trade", func(t *testing.T) {
 		trade := model.Trade{Account: "", Symbol: "EURUSD", Volume: 1.5, Open: 1.2345, Close: 1.2350, Side: "buy"}
 		body, _ := json.Marshal(trade)
@@ -59,10 +94,253 @@ func TestPostServerTrades(t *testing.T) {
 	})
 }
 
+func TestPostServerTrades_Idempotency(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	repo := NewServerService(store)
+	handler := repo.PostServerTrades()
+
+	post := func(trade model.Trade, key string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(trade)
+		req := httptest.NewRequest(http.MethodPost, "/trades", bytes.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	countTrades := func(t *testing.T, clientTradeID string) int {
+		count := 0
+		for _, record := range queuedTrades(t, store) {
+			if record.ClientTradeID == clientTradeID {
+				count++
+			}
+		}
+		return count
+	}
+
+	trade := model.Trade{ClientTradeID: "fill-1", Account: "ACC1", Symbol: "EURUSD", Volume: 1, Open: 1.1, Close: 1.2, Side: "buy"}
+
+	t.Run("retry with client_trade_id", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			rr := post(trade, "")
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("Attempt %d: expected 202, got %d", i, rr.Code)
+			}
+			// Повтор получает id исходной записи
+			if location := rr.Header().Get("Location"); location != "/trades/1" {
+				t.Errorf("Attempt %d: expected Location /trades/1, got %q", i, location)
+			}
+		}
+		if got := countTrades(t, "fill-1"); got != 1 {
+			t.Errorf("Expected 1 enqueued trade, got %d", got)
+		}
+	})
+
+	t.Run("retry with Idempotency-Key header", func(t *testing.T) {
+		noID := trade
+		noID.ClientTradeID = ""
+		for i := 0; i < 2; i++ {
+			if rr := post(noID, "key-1"); rr.Code != http.StatusAccepted {
+				t.Fatalf("Attempt %d: expected 202, got %d", i, rr.Code)
+			}
+		}
+		if got := countTrades(t, "key-1"); got != 1 {
+			t.Errorf("Expected 1 enqueued trade, got %d", got)
+		}
+	})
+
+	t.Run("key reused for different trade", func(t *testing.T) {
+		changed := trade
+		changed.Volume = 2
+		if rr := post(changed, ""); rr.Code != http.StatusConflict {
+			t.Errorf("Expected 409, got %d", rr.Code)
+		}
+	})
+
+	t.Run("header does not match body", func(t *testing.T) {
+		if rr := post(trade, "other-key"); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("trades without id are not deduplicated", func(t *testing.T) {
+		noID := trade
+		noID.ClientTradeID = ""
+		post(noID, "")
+		post(noID, "")
+		if count := countTrades(t, ""); count != 2 {
+			t.Errorf("Expected 2 trades without client_trade_id, got %d", count)
+		}
+	})
+}
+
+func TestPostServerTradesBatch(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	repo := NewServerService(store)
+	handler := repo.PostServerTradesBatch()
+
+	countTrades := func(t *testing.T) int {
+		return len(queuedTrades(t, store))
+	}
+
+	t.Run("json array with invalid item", func(t *testing.T) {
+		before := countTrades(t)
+		body := `[
+			{"account":"ACC1","symbol":"EURUSD","volume":1.5,"open":1.2345,"close":1.2350,"side":"buy"},
+			{"account":"","symbol":"EURUSD","volume":1.5,"open":1.2345,"close":1.2350,"side":"buy"},
+			{"account":"ACC1","symbol":"GBPUSD","volume":1,"open":1.3,"close":1.2,"side":"sell"}
+		]`
+		req := httptest.NewRequest(http.MethodPost, "/trades/batch", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp BatchResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if resp.Accepted != 2 || resp.Rejected != 1 || len(resp.Results) != 3 {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		if resp.Results[1].Status != BatchStatusRejected || resp.Results[1].Error != "account must not be empty" {
+			t.Errorf("Unexpected result for index 1: %+v", resp.Results[1])
+		}
+		if got := countTrades(t) - before; got != 2 {
+			t.Errorf("Expected 2 enqueued trades, got %d", got)
+		}
+	})
+
+	t.Run("ndjson stream", func(t *testing.T) {
+		before := countTrades(t)
+		body := "{\"account\":\"ACC2\",\"symbol\":\"EURUSD\",\"volume\":1,\"open\":1.1,\"close\":1.2,\"side\":\"buy\"}\n" +
+			"\n" +
+			"{not json}\n" +
+			"{\"account\":\"ACC2\",\"symbol\":\"EURUSD\",\"volume\":2,\"open\":1.1,\"close\":1.0,\"side\":\"sell\"}\n"
+		req := httptest.NewRequest(http.MethodPost, "/trades/batch", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp BatchResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if resp.Accepted != 2 || resp.Rejected != 1 {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		if resp.Results[1].Index != 1 || resp.Results[1].Error != "Invalid JSON payload" {
+			t.Errorf("Unexpected result for index 1: %+v", resp.Results[1])
+		}
+		if got := countTrades(t) - before; got != 2 {
+			t.Errorf("Expected 2 enqueued trades, got %d", got)
+		}
+	})
+
+	t.Run("duplicates within and across batches", func(t *testing.T) {
+		before := countTrades(t)
+		body := `[
+			{"client_trade_id":"b-1","account":"ACC3","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"},
+			{"client_trade_id":"b-1","account":"ACC3","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"},
+			{"client_trade_id":"b-1","account":"ACC3","symbol":"EURUSD","volume":5,"open":1.1,"close":1.2,"side":"buy"}
+		]`
+		req := httptest.NewRequest(http.MethodPost, "/trades/batch", bytes.NewReader([]byte(body)))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp BatchResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if resp.Accepted != 1 || resp.Duplicates != 1 || resp.Rejected != 1 {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		if resp.Results[1].Status != BatchStatusDuplicate || resp.Results[2].Status != BatchStatusRejected {
+			t.Errorf("Unexpected results: %+v", resp.Results)
+		}
+		if got := countTrades(t) - before; got != 1 {
+			t.Errorf("Expected 1 enqueued trade, got %d", got)
+		}
+	})
+
+	t.Run("not an array", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/trades/batch", bytes.NewReader([]byte(`{"account":"ACC1"}`)))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("too many trades", func(t *testing.T) {
+		item := `{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`
+		items := strings.Repeat(item+",", maxBatchSize) + item
+		for _, c := range []struct{ contentType, body string }{
+			// Разбор останавливается на лишнем элементе, поэтому хвост тела не читается
+			{"application/json", "[" + items + ",not json"},
+			{"application/x-ndjson", strings.ReplaceAll(items, "},{", "}\n{") + "\nnot json"},
+		} {
+			req := httptest.NewRequest(http.MethodPost, "/trades/batch", strings.NewReader(c.body))
+			req.Header.Set("Content-Type", c.contentType)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("%s: expected 413, got %d", c.contentType, rr.Code)
+			}
+		}
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		// Пробелы и пустые строки не являются сделками, поэтому лимит срабатывает по размеру тела
+		for _, c := range []struct{ contentType, body string }{
+			{"application/json", "[" + strings.Repeat(" ", maxBatchBodySize) + "]"},
+			{"application/x-ndjson", strings.Repeat("\n", maxBatchBodySize+1)},
+		} {
+			req := httptest.NewRequest(http.MethodPost, "/trades/batch", strings.NewReader(c.body))
+			req.Header.Set("Content-Type", c.contentType)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("%s: expected 413, got %d", c.contentType, rr.Code)
+			}
+		}
+	})
+
+	t.Run("empty batch", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/trades/batch", bytes.NewReader([]byte(`[]`)))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("invalid method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/trades/batch", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+
+	t.Run("db closed", func(t *testing.T) {
+		store.Close()
+		body := `[{"account":"ACC1","symbol":"EURUSD","volume":1.5,"open":1.2345,"close":1.2350,"side":"buy"}]`
+		req := httptest.NewRequest(http.MethodPost, "/trades/batch", bytes.NewReader([]byte(body)))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("Expected 500, got %d", rr.Code)
+		}
+	})
+}
+
 func TestGetServerHealthz(t *testing.T) {
-	dbConn, cleanup := SetupTestDB(t)
+	store, cleanup := SetupTestStore(t)
 	defer cleanup()
-	repo := NewSqliteRepository(dbConn)
+	repo := NewServerService(store)
 	handler := repo.GetServerHealthz()
 
 	t.Run("health ok", func(t *testing.T) {
@@ -86,28 +364,55 @@ func TestGetServerHealthz(t *testing.T) {
 		}
 	})
 
+	t.Run("verbose report", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/healthz?verbose=1", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", rr.Code)
+		}
+		var report struct {
+			OK     bool `json:"ok"`
+			Checks []struct {
+				Name string `json:"name"`
+				OK   bool   `json:"ok"`
+			} `json:"checks"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+			t.Fatalf("Failed to decode report: %v", err)
+		}
+		if !report.OK || len(report.Checks) == 0 {
+			t.Errorf("Expected passing report with checks, got %+v", report)
+		}
+	})
+
 	t.Run("db closed", func(t *testing.T) {
-		dbConn.Close()
+		store.Close()
 		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
 		if rr.Code != http.StatusInternalServerError {
 			t.Errorf("Expected 500, got %d", rr.Code)
 		}
+		if !strings.Contains(rr.Body.String(), "connection") {
+			t.Errorf("Expected failed connection check in body, got %s", rr.Body.String())
+		}
 	})
 }
 
 func TestGetServerStats(t *testing.T) {
-	dbConn, cleanup := SetupTestDB(t)
+	store, cleanup := SetupTestStore(t)
 	defer cleanup()
-	repo := NewSqliteRepository(dbConn)
+	repo := NewServerService(store)
 	handler := repo.GetServerStats()
 
 	t.Run("existing account", func(t *testing.T) {
-		_, err := dbConn.Exec("INSERT INTO account_stats (account, trades, profit) VALUES ('ACC1', 5, 1000.5)")
-		if err != nil {
-			t.Fatalf("Failed to insert: %v", err)
-		}
+		applyTestTrades(t, store,
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1, ConvertedProfit: 1000.5},
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1},
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1},
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1},
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1})
 		req := httptest.NewRequest(http.MethodGet, "/stats/ACC1", nil)
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
@@ -154,7 +459,7 @@ func TestGetServerStats(t *testing.T) {
 	})
 
 	t.Run("db closed", func(t *testing.T) {
-		dbConn.Close()
+		store.Close()
 		req := httptest.NewRequest(http.MethodGet, "/stats/ACC1", nil)
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req)
@@ -163,3 +468,187 @@ func TestGetServerStats(t *testing.T) {
 		}
 	})
 }
+
+func TestGetServerSymbolStats(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	repo := NewServerService(store)
+	handler := repo.GetServerSymbolStats()
+
+	t.Run("existing account", func(t *testing.T) {
+		applyTestTrades(t, store,
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 2, ConvertedProfit: 100},
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 2, ConvertedProfit: 100},
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1.5, ConvertedProfit: 100},
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1, ConvertedProfit: -100},
+			storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "sell", Volume: 1, ConvertedProfit: -50})
+		req := httptest.NewRequest(http.MethodGet, "/stats/ACC1/symbols", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		var resp struct {
+			Account  string        `json:"account"`
+			Currency string        `json:"currency"`
+			Symbols  []SymbolStats `json:"symbols"`
+		}
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if resp.Account != "ACC1" || resp.Currency != "USD" || len(resp.Symbols) != 2 {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		want := SymbolStats{Symbol: "EURUSD", Side: "buy", Trades: 4, Volume: 6.5, GrossProfit: 300, GrossLoss: 100, NetProfit: 200, WinRate: 0.75}
+		if resp.Symbols[0] != want {
+			t.Errorf("Unexpected buy stats: %+v", resp.Symbols[0])
+		}
+		if resp.Symbols[1].Side != "sell" || resp.Symbols[1].NetProfit != -50 || resp.Symbols[1].WinRate != 0 {
+			t.Errorf("Unexpected sell stats: %+v", resp.Symbols[1])
+		}
+	})
+
+	t.Run("non-existing account", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/stats/ACC2/symbols", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), `"symbols":[]`) {
+			t.Errorf("Expected empty symbols list, got %s", rr.Body.String())
+		}
+	})
+
+	t.Run("invalid method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/stats/ACC1/symbols", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+
+	t.Run("db closed", func(t *testing.T) {
+		store.Close()
+		req := httptest.NewRequest(http.MethodGet, "/stats/ACC1/symbols", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("Expected 500, got %d", rr.Code)
+		}
+	})
+}
+
+func TestGetServerHistory(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	repo := NewServerService(store)
+	handler := repo.GetServerHistory()
+
+	day1 := time.Date(2026, 5, 3, 0, 0, 0, 0, time.UTC)
+	day2 := time.Date(2026, 5, 4, 0, 0, 0, 0, time.UTC)
+	applyTestTrades(t, store,
+		storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1, ConvertedProfit: 100, Time: day1.Add(time.Hour).Unix()},
+		storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1, ConvertedProfit: 50, Time: day1.Add(2 * time.Hour).Unix()},
+		storage.AppliedTrade{Account: "ACC1", Symbol: "EURUSD", Side: "buy", Volume: 1, ConvertedProfit: -40, Time: day2.Add(9 * time.Hour).Unix()})
+
+	type response struct {
+		Account  string         `json:"account"`
+		Interval string         `json:"interval"`
+		Points   []HistoryPoint `json:"points"`
+	}
+	get := func(url string) (*httptest.ResponseRecorder, response) {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp response
+		json.NewDecoder(bytes.NewReader(rr.Body.Bytes())).Decode(&resp)
+		return rr, resp
+	}
+
+	t.Run("daily series", func(t *testing.T) {
+		rr, resp := get("/stats/ACC1/history?from=2026-05-01&to=2026-05-10&interval=day")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if resp.Account != "ACC1" || resp.Interval != "day" || len(resp.Points) != 2 {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		if !resp.Points[0].Time.Equal(day1) || resp.Points[0].Trades != 2 || resp.Points[0].Profit != 150 {
+			t.Errorf("Unexpected first point: %+v", resp.Points[0])
+		}
+	})
+
+	t.Run("from inside bucket includes it", func(t *testing.T) {
+		_, resp := get("/stats/ACC1/history?from=2026-05-04T12:00:00Z&to=2026-05-05T00:00:00Z")
+		if len(resp.Points) != 1 || !resp.Points[0].Time.Equal(day2) {
+			t.Errorf("Unexpected points: %+v", resp.Points)
+		}
+	})
+
+	t.Run("hourly series", func(t *testing.T) {
+		_, resp := get("/stats/ACC1/history?from=2026-05-04&to=2026-05-05&interval=hour")
+		if len(resp.Points) != 1 || resp.Points[0].Profit != -40 {
+			t.Errorf("Unexpected points: %+v", resp.Points)
+		}
+	})
+
+	t.Run("invalid interval", func(t *testing.T) {
+		if rr, _ := get("/stats/ACC1/history?interval=week"); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		if rr, _ := get("/stats/ACC1/history?from=2026-05-05&to=2026-05-01"); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+		if rr, _ := get("/stats/ACC1/history?from=yesterday"); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rr.Code)
+		}
+		if rr, _ := get("/stats/ACC1/history?from=2000-01-01&to=2026-01-01&interval=hour"); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for too many intervals, got %d", rr.Code)
+		}
+	})
+
+	t.Run("invalid method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/stats/ACC1/history", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+}
+
+func TestQueryContext(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+
+	t.Run("query timeout", func(t *testing.T) {
+		repo := NewServerService(store, WithQueryTimeout(time.Nanosecond))
+		req := httptest.NewRequest(http.MethodGet, "/stats/ACC1", nil)
+		rr := httptest.NewRecorder()
+		repo.GetServerStats().ServeHTTP(rr, req)
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503, got %d", rr.Code)
+		}
+	})
+
+	t.Run("client disconnected", func(t *testing.T) {
+		repo := NewServerService(store)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		trade := model.Trade{Account: "ACC1", Symbol: "EURUSD", Volume: 1, Open: 1.1, Close: 1.2, Side: "buy"}
+		body, _ := json.Marshal(trade)
+		req := httptest.NewRequest(http.MethodPost, "/trades", bytes.NewReader(body)).WithContext(ctx)
+		rr := httptest.NewRecorder()
+		repo.PostServerTrades().ServeHTTP(rr, req)
+		if rr.Code == http.StatusNoContent {
+			t.Error("Expected request to fail")
+		}
+
+		if count := len(queuedTrades(t, store)); count != 0 {
+			t.Errorf("Expected no trades, got %d", count)
+		}
+	})
+}
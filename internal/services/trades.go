@@ -0,0 +1,341 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+// EnqueueResponse - ответ POST /trades, состояние сделки доступно по GET /trades/{id}
+type EnqueueResponse struct {
+	ID int64 `json:"id"`
+}
+
+// TradeResponse - ответ GET /trades/{id}
+type TradeResponse struct {
+	ID            int64      `json:"id"`
+	ClientTradeID string     `json:"client_trade_id,omitempty"`
+	Account       string     `json:"account"`
+	Symbol        string     `json:"symbol"`
+	Volume        float64    `json:"volume"`
+	Open          float64    `json:"open"`
+	Close         float64    `json:"close"`
+	Side          string     `json:"side"`
+	OpenTime      *time.Time `json:"open_time,omitempty"`
+	CloseTime     *time.Time `json:"close_time,omitempty"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	FailedReason  string     `json:"failed_reason,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	RequestID     string     `json:"request_id,omitempty"`
+	// Result заполняется после обработки сделки воркером
+	Result *TradeResult `json:"result,omitempty"`
+}
+
+// TradeResult - прибыль обработанной сделки в валюте котировки и в валюте аккаунта
+type TradeResult struct {
+	Profit          float64 `json:"profit"`
+	QuoteCurrency   string  `json:"quote_currency,omitempty"`
+	ConvertedProfit float64 `json:"converted_profit"`
+	AccountCurrency string  `json:"account_currency"`
+}
+
+// TradeListResponse - страница ответа GET /trades. NextCursor передается
+// в параметре cursor для получения следующей страницы и пуст на последней.
+type TradeListResponse struct {
+	Trades     []TradeResponse `json:"trades"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// Ограничения на размер страницы GET /trades
+const (
+	defaultTradesLimit = 100
+	maxTradesLimit     = 1000
+)
+
+// Максимальное время ожидания обработки сделки в параметре wait
+const maxWait = 30 * time.Second
+
+// Интервал, с которым ожидающий запрос перечитывает сделку, если уведомление
+// от воркера не пришло (например, воркер запущен без -notify-server-url)
+const waitRecheckInterval = time.Second
+
+// GET /trades/{id} endpoint
+func (s *ServerService) GetServerTrade() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := tradeID(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wait, err := parseWait(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Без ожидания waitTrade читает сделку один раз
+		record, err := s.waitTrade(r, id, wait)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, fmt.Sprintf("Trade %d not found", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			dbError(r.Context(), w, "Failed to fetch trade", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newTradeResponse(record))
+	}
+}
+
+// GET /trades endpoint
+func (s *ServerService) GetServerTrades() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.listTrades(w, r, r.URL.Query().Get("account"))
+	}
+}
+
+// GET /accounts/{acc}/trades endpoint - GET /trades с фильтром по аккаунту
+func (s *ServerService) GetServerAccountTrades() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		account := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/accounts/"), "/trades")
+		if account == "" || strings.Contains(account, "/") {
+			http.Error(w, "Account is required", http.StatusBadRequest)
+			return
+		}
+		s.listTrades(w, r, account)
+	}
+}
+
+// listTrades отвечает страницей сделок аккаунта account (пустой - всех аккаунтов)
+// с фильтрами из параметров запроса
+func (s *ServerService) listTrades(w http.ResponseWriter, r *http.Request, account string) {
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	query, err := parseTradeQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Account = account
+
+	// Лишняя запись показывает, есть ли следующая страница
+	limit := query.Limit
+	query.Limit++
+	rows, err := s.store.Trades(ctx, query)
+	if err != nil {
+		dbError(ctx, w, "Failed to fetch trades", err)
+		return
+	}
+
+	response := TradeListResponse{Trades: make([]TradeResponse, 0, len(rows))}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		response.NextCursor = strconv.FormatInt(rows[limit-1].ID, 10)
+	}
+	for _, row := range rows {
+		response.Trades = append(response.Trades, newTradeResponse(row))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseTradeQuery разбирает фильтры, размер страницы и курсор GET /trades
+func parseTradeQuery(values url.Values) (storage.TradeQuery, error) {
+	query := storage.TradeQuery{
+		Symbol: values.Get("symbol"),
+		Side:   values.Get("side"),
+		Status: values.Get("status"),
+		Limit:  defaultTradesLimit,
+	}
+	if query.Side != "" && query.Side != "buy" && query.Side != "sell" {
+		return query, fmt.Errorf("side must be either 'buy' or 'sell'")
+	}
+	switch query.Status {
+	case "", model.StatusPending, model.StatusProcessed, model.StatusFailed, model.StatusDiscarded, model.StatusCancelled:
+	default:
+		return query, fmt.Errorf("Invalid status: %s", query.Status)
+	}
+
+	if v := values.Get("from"); v != "" {
+		from, err := parseTimeParam(v)
+		if err != nil {
+			return query, fmt.Errorf("Invalid from: %v", err)
+		}
+		query.From = from.Unix()
+	}
+	if v := values.Get("to"); v != "" {
+		to, err := parseTimeParam(v)
+		if err != nil {
+			return query, fmt.Errorf("Invalid to: %v", err)
+		}
+		query.To = to.Unix()
+	}
+	if query.From != 0 && query.To != 0 && query.From >= query.To {
+		return query, fmt.Errorf("from must be before to")
+	}
+
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxTradesLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxTradesLimit)
+		}
+		query.Limit = n
+	}
+	if v := values.Get("cursor"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return query, fmt.Errorf("Invalid cursor")
+		}
+		query.AfterID = id
+	}
+	return query, nil
+}
+
+// POST /internal/processed endpoint
+//
+// Воркер сообщает, что зафиксировал порцию обработанных сделок. Ожидающие запросы
+// перечитывают свои сделки из базы, поэтому лишнее уведомление безвредно.
+func (s *ServerService) PostServerProcessed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.processed.Notify()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// waitTrade читает сделку id и, пока она не в конечном статусе, ждет уведомления
+// об обработанных сделках, но не дольше wait. Каждое чтение ограничено queryTimeout.
+func (s *ServerService) waitTrade(r *http.Request, id int64, wait time.Duration) (storage.TradeRecord, error) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	recheck := time.NewTicker(waitRecheckInterval)
+	defer recheck.Stop()
+
+	for {
+		// Канал берется до чтения, чтобы не пропустить уведомление между чтением и ожиданием
+		notified := s.processed.Wait()
+		record, err := s.readTrade(r, id)
+		if err != nil || finalStatus(record.Status) || wait <= 0 {
+			return record, err
+		}
+
+		select {
+		case <-notified:
+		case <-recheck.C:
+		case <-deadline.C:
+			return record, nil
+		case <-r.Context().Done():
+			return record, r.Context().Err()
+		}
+	}
+}
+
+func (s *ServerService) readTrade(r *http.Request, id int64) (storage.TradeRecord, error) {
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+	record, err := s.store.Trade(ctx, id)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return record, context.DeadlineExceeded
+	}
+	return record, err
+}
+
+// finalStatus сообщает, что воркер больше не будет обрабатывать сделку без вмешательства администратора
+func finalStatus(status string) bool {
+	return status != model.StatusPending
+}
+
+// parseWait разбирает параметр wait (например, 5s); 0 - не ждать
+func parseWait(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(v)
+	if err != nil || wait < 0 || wait > maxWait {
+		return 0, fmt.Errorf("wait must be a duration between 0s and %v", maxWait)
+	}
+	return wait, nil
+}
+
+func newTradeResponse(record storage.TradeRecord) TradeResponse {
+	response := TradeResponse{
+		ID:            record.ID,
+		ClientTradeID: record.ClientTradeID,
+		Account:       record.Account,
+		Symbol:        record.Symbol,
+		Volume:        record.Volume,
+		Open:          record.Open,
+		Close:         record.Close,
+		Side:          record.Side,
+		OpenTime:      unixTime(record.OpenTime),
+		CloseTime:     unixTime(record.CloseTime),
+		Status:        record.Status,
+		Attempts:      record.Attempts,
+		FailedReason:  record.FailedReason,
+		CreatedAt:     time.Unix(record.CreatedAt, 0).UTC(),
+		RequestID:     record.RequestID,
+	}
+	if record.Status == model.StatusProcessed {
+		response.Result = &TradeResult{
+			Profit:          record.Profit,
+			QuoteCurrency:   record.QuoteCurrency,
+			ConvertedProfit: record.ConvertedProfit,
+			AccountCurrency: record.AccountCurrency,
+		}
+	}
+	return response
+}
+
+// unixTime переводит необязательное время в секундах Unix, 0 - время не задано
+func unixTime(sec int64) *time.Time {
+	if sec == 0 {
+		return nil
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t
+}
+
+// tradeLocation возвращает адрес состояния сделки для заголовка Location
+func tradeLocation(id int64) string {
+	return "/trades/" + strconv.FormatInt(id, 10)
+}
+
+func tradeID(path string) (int64, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(path, "/trades/"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("Invalid trade id")
+	}
+	return id, nil
+}
@@ -0,0 +1,332 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
+)
+
+func TestGetServerTrade(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	service := NewServerService(store)
+
+	// enqueue ставит сделку через POST /trades и возвращает адрес из Location
+	enqueue := func(t *testing.T, body string) string {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		service.PostServerTrades().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/trades", strings.NewReader(body)))
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202, got %d: %s", rr.Code, rr.Body)
+		}
+		return rr.Header().Get("Location")
+	}
+	get := func(t *testing.T, path string) (int, TradeResponse) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		service.GetServerTrade().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		var response TradeResponse
+		if rr.Code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return rr.Code, response
+	}
+
+	processed := enqueue(t, `{"client_trade_id":"c-1","account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy","close_time":"2026-05-04T10:00:00Z"}`)
+	failed := enqueue(t, `{"account":"ACC1","symbol":"GBPUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`)
+	// Сделка с неизвестным символом попадает в dead-letter при обработке
+	if err := store.StoreInstruments(context.Background(), []model.Instrument{
+		{Symbol: "EURUSD", ContractSize: 100000, PipSize: 0.0001, QuoteCurrency: "USD", Precision: 5},
+	}); err != nil {
+		t.Fatalf("Failed to store instruments: %v", err)
+	}
+
+	t.Run("pending", func(t *testing.T) {
+		code, trade := get(t, processed)
+		if code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+		if trade.ID != 1 || trade.ClientTradeID != "c-1" || trade.Status != model.StatusPending || trade.Result != nil ||
+			trade.CloseTime == nil || trade.CloseTime.Unix() != 1777888800 || trade.OpenTime != nil {
+			t.Errorf("Unexpected pending trade %+v", trade)
+		}
+	})
+
+	if err := NewTradeService(store).ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("ProcessTrades failed: %v", err)
+	}
+
+	t.Run("processed", func(t *testing.T) {
+		_, trade := get(t, processed)
+		if trade.Status != model.StatusProcessed || trade.Attempts != 1 || trade.Result == nil ||
+			trade.Result.Profit != 10000 || trade.Result.ConvertedProfit != 10000 || trade.Result.AccountCurrency != "USD" {
+			t.Errorf("Unexpected processed trade %+v (result %+v)", trade, trade.Result)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		_, trade := get(t, failed)
+		if trade.ID != 2 || trade.Status != model.StatusFailed || trade.FailedReason != "unknown symbol GBPUSD" || trade.Result != nil {
+			t.Errorf("Unexpected failed trade %+v", trade)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if code, _ := get(t, "/trades/99"); code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", code)
+		}
+		if code, _ := get(t, "/trades/abc"); code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", code)
+		}
+		rr := httptest.NewRecorder()
+		service.GetServerTrade().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, failed, nil))
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+}
+
+func TestWaitTrade(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	processed := NewBroadcaster()
+	service := NewServerService(store, WithProcessedEvents(processed))
+	worker := NewTradeService(store, WithProcessedNotifier(processed))
+
+	post := func(t *testing.T, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		service.PostServerTrades().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rr
+	}
+
+	t.Run("processed before timeout", func(t *testing.T) {
+		done := make(chan error, 1)
+		go func() {
+			// Воркер обрабатывает сделку, когда запрос уже ждет
+			time.Sleep(50 * time.Millisecond)
+			done <- worker.ProcessTrades(context.Background())
+		}()
+
+		start := time.Now()
+		rr := post(t, "/trades?wait=5s", `{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`)
+		if err := <-done; err != nil {
+			t.Fatalf("ProcessTrades failed: %v", err)
+		}
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body)
+		}
+		if elapsed := time.Since(start); elapsed >= waitRecheckInterval {
+			t.Errorf("Expected notification to wake the request, waited %v", elapsed)
+		}
+		var trade TradeResponse
+		if err := json.NewDecoder(rr.Body).Decode(&trade); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if trade.Status != model.StatusProcessed || trade.Result == nil || trade.Result.Profit != 10000 {
+			t.Errorf("Unexpected trade %+v (result %+v)", trade, trade.Result)
+		}
+		if rr.Header().Get("Location") != tradeLocation(trade.ID) {
+			t.Errorf("Unexpected Location %q", rr.Header().Get("Location"))
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		rr := post(t, "/trades?wait=100ms", `{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202, got %d: %s", rr.Code, rr.Body)
+		}
+		var response EnqueueResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || response.ID == 0 {
+			t.Fatalf("Expected trade id, got %+v (%v)", response, err)
+		}
+
+		// GET с ожиданием возвращает текущее состояние и после таймаута
+		req := httptest.NewRequest(http.MethodGet, tradeLocation(response.ID)+"?wait=100ms", nil)
+		get := httptest.NewRecorder()
+		service.GetServerTrade().ServeHTTP(get, req)
+		var trade TradeResponse
+		if err := json.NewDecoder(get.Body).Decode(&trade); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if get.Code != http.StatusOK || trade.Status != model.StatusPending {
+			t.Errorf("Expected pending trade, got %d %+v", get.Code, trade)
+		}
+	})
+
+	t.Run("get waits for worker", func(t *testing.T) {
+		location := post(t, "/trades", `{"account":"ACC2","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"sell"}`).Header().Get("Location")
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			worker.ProcessTrades(context.Background())
+		}()
+
+		rr := httptest.NewRecorder()
+		service.GetServerTrade().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, location+"?wait=5s", nil))
+		var trade TradeResponse
+		if err := json.NewDecoder(rr.Body).Decode(&trade); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if trade.Status != model.StatusProcessed || trade.Result == nil || trade.Result.Profit != -10000 {
+			t.Errorf("Unexpected trade %+v (result %+v)", trade, trade.Result)
+		}
+	})
+
+	t.Run("read failure after enqueue", func(t *testing.T) {
+		failing := NewServerService(tradeReadFailingStore{Store: store}, WithProcessedEvents(processed))
+		rr := httptest.NewRecorder()
+		body := `{"account":"ACC3","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`
+		failing.PostServerTrades().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/trades?wait=5s", strings.NewReader(body)))
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("Expected 202, got %d: %s", rr.Code, rr.Body)
+		}
+		var response EnqueueResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || response.ID == 0 {
+			t.Fatalf("Expected trade id, got %+v (%v)", response, err)
+		}
+		if rr.Header().Get("Location") != tradeLocation(response.ID) {
+			t.Errorf("Unexpected Location %q", rr.Header().Get("Location"))
+		}
+	})
+
+	t.Run("invalid wait", func(t *testing.T) {
+		for _, wait := range []string{"abc", "-1s", "1m"} {
+			rr := post(t, "/trades?wait="+wait, `{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}`)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("wait=%s: expected 400, got %d", wait, rr.Code)
+			}
+		}
+	})
+}
+
+// tradeReadFailingStore - хранилище, в котором чтение сделки завершается ошибкой
+type tradeReadFailingStore struct {
+	storage.Store
+}
+
+func (s tradeReadFailingStore) Trade(ctx context.Context, id int64) (storage.TradeRecord, error) {
+	return storage.TradeRecord{}, errors.New("connection reset")
+}
+
+func TestPostServerProcessed(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	processed := NewBroadcaster()
+	handler := NewServerService(store, WithProcessedEvents(processed)).PostServerProcessed()
+
+	waiting := processed.Wait()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/internal/processed", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rr.Code)
+	}
+	select {
+	case <-waiting:
+	default:
+		t.Error("Expected waiters to be notified")
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/internal/processed", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rr.Code)
+	}
+}
+
+func TestGetServerTrades(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	service := NewServerService(store)
+	enqueueTestTrades(t, store,
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("ACC2", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("ACC1", "EURUSD", 1, 1.2, 1.1, "sell"),
+		testTrade("ACC1", "EURUSD", 2, 1.1, 1.2, "buy"),
+	)
+
+	list := func(t *testing.T, handler http.HandlerFunc, target string) (int, TradeListResponse) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		var response TradeListResponse
+		if rr.Code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return rr.Code, response
+	}
+	ids := func(response TradeListResponse) []int64 {
+		var ids []int64
+		for _, trade := range response.Trades {
+			ids = append(ids, trade.ID)
+		}
+		return ids
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		var pages [][]int64
+		cursor := ""
+		for i := 0; i < 3; i++ {
+			code, response := list(t, service.GetServerTrades(), "/trades?account=ACC1&limit=2&cursor="+cursor)
+			if code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", code)
+			}
+			pages = append(pages, ids(response))
+			if cursor = response.NextCursor; cursor == "" {
+				break
+			}
+		}
+		if len(pages) != 2 || !slices.Equal(pages[0], []int64{1, 3}) || !slices.Equal(pages[1], []int64{4}) {
+			t.Errorf("Unexpected pages %v", pages)
+		}
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		_, response := list(t, service.GetServerTrades(), "/trades?side=sell&status=pending&from=2020-01-01")
+		if got := ids(response); !slices.Equal(got, []int64{3}) || response.NextCursor != "" {
+			t.Errorf("Expected trade 3, got %v (cursor %q)", got, response.NextCursor)
+		}
+		_, response = list(t, service.GetServerTrades(), "/trades?status=processed")
+		if response.Trades == nil || len(response.Trades) != 0 {
+			t.Errorf("Expected empty list, got %+v", response.Trades)
+		}
+	})
+
+	t.Run("account shortcut", func(t *testing.T) {
+		code, response := list(t, service.GetServerAccountTrades(), "/accounts/ACC2/trades")
+		if code != http.StatusOK || !slices.Equal(ids(response), []int64{2}) || response.Trades[0].Account != "ACC2" {
+			t.Errorf("Expected trade 2 of ACC2, got %d %+v", code, response)
+		}
+	})
+
+	t.Run("invalid params", func(t *testing.T) {
+		for _, target := range []string{
+			"/trades?limit=0", "/trades?limit=1001", "/trades?cursor=abc", "/trades?side=long",
+			"/trades?status=done", "/trades?from=yesterday", "/trades?from=2026-05-02&to=2026-05-01",
+		} {
+			if code, _ := list(t, service.GetServerTrades(), target); code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d", target, code)
+			}
+		}
+		if code, _ := list(t, service.GetServerAccountTrades(), "/accounts//trades"); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 without account, got %d", code)
+		}
+		rr := httptest.NewRecorder()
+		service.GetServerAccountTrades().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/accounts/ACC1/trades", nil))
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+}
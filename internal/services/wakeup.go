@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backoff - экспоненциально растущая пауза между проходами воркера по пустой очереди
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	current time.Duration
+}
+
+// Next возвращает следующую паузу: Min, 2*Min, 4*Min ... но не больше Max
+func (b *Backoff) Next() time.Duration {
+	if b.current == 0 {
+		b.current = b.Min
+	} else {
+		b.current *= 2
+	}
+	if b.current > b.Max {
+		b.current = b.Max
+	}
+	return b.current
+}
+
+// Reset возвращает паузу к минимальной
+func (b *Backoff) Reset() {
+	b.current = 0
+}
+
+// WakeupHandler будит воркер, если он ждет новых сделок. Повторные сигналы,
+// пришедшие до того, как воркер проснулся, объединяются в один.
+//
+// POST /wakeup endpoint
+func WakeupHandler(wake chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// EnqueueNotifier сообщает воркерам о новых сделках в очереди
+type EnqueueNotifier interface {
+	Notify()
+}
+
+// ChannelNotifier будит воркер, запущенный в том же процессе.
+// Канал должен быть буферизован, чтобы сигналы объединялись, как в WakeupHandler.
+type ChannelNotifier chan struct{}
+
+func (n ChannelNotifier) Notify() {
+	select {
+	case n <- struct{}{}:
+	default:
+	}
+}
+
+// Broadcaster будит всех, кто ждет канал из Wait, при каждом вызове Notify.
+// Сервер ждет через него сообщений воркера об обработанных сделках.
+type Broadcaster struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{ch: make(chan struct{})}
+}
+
+// Wait возвращает канал, который закроется при следующем Notify
+func (b *Broadcaster) Wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ch
+}
+
+func (b *Broadcaster) Notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.ch)
+	b.ch = make(chan struct{})
+}
+
+// Таймаут одного уведомления воркера
+const notifyTimeout = time.Second
+
+// HTTPNotifier отправляет POST на адреса воркеров после постановки сделок в очередь,
+// а также на адреса серверов после обработки сделок воркером. Уведомления отправляются
+// в фоне и объединяются: пока предыдущее не отправлено, новые вызовы Notify
+// не создают дополнительных запросов.
+type HTTPNotifier struct {
+	targets []notifyTarget
+	pending chan struct{}
+}
+
+type notifyTarget struct {
+	// addr - адрес из настроек для логов, url - адрес запроса
+	addr   string
+	url    string
+	client *http.Client
+}
+
+// NewHTTPNotifier создает уведомитель для списка адресов. Адрес - это URL
+// (http://worker:9090/wakeup) или путь к UNIX-сокету с префиксом unix:, за которым
+// может следовать путь запроса (unix:/run/server.sock:/internal/processed).
+// Без пути запроса уведомление отправляется на /wakeup.
+func NewHTTPNotifier(addrs []string) *HTTPNotifier {
+	n := &HTTPNotifier{pending: make(chan struct{}, 1)}
+	for _, addr := range addrs {
+		n.targets = append(n.targets, newNotifyTarget(addr))
+	}
+	go n.loop()
+	return n
+}
+
+func newNotifyTarget(addr string) notifyTarget {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return notifyTarget{addr: addr, url: addr, client: &http.Client{Timeout: notifyTimeout}}
+	}
+	// Путь запроса отделяется от пути сокета последним ":/"
+	endpoint := "/wakeup"
+	if i := strings.LastIndex(path, ":/"); i >= 0 {
+		path, endpoint = path[:i], path[i+1:]
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return notifyTarget{
+		addr:   addr,
+		url:    "http://unix" + endpoint,
+		client: &http.Client{Timeout: notifyTimeout, Transport: transport},
+	}
+}
+
+func (n *HTTPNotifier) Notify() {
+	select {
+	case n.pending <- struct{}{}:
+	default:
+	}
+}
+
+func (n *HTTPNotifier) loop() {
+	for range n.pending {
+		for _, target := range n.targets {
+			resp, err := target.client.Post(target.url, "text/plain", nil)
+			if err != nil {
+				// Получатель все равно перечитает очередь или сделку по своему таймеру
+				slog.Warn("failed to send notification", "target", target.addr, "err", err)
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+}
+
+// ListenWakeup начинает принимать уведомления о новых сделках на адресе
+// host:port или unix:/path и возвращает канал сигналов для TradeService.Run.
+// Прием уведомлений прекращается при отмене ctx.
+func ListenWakeup(ctx context.Context, addr string) (<-chan struct{}, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	wake := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wakeup", WakeupHandler(wake))
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("wakeup listener stopped", "err", err)
+		}
+	}()
+	context.AfterFunc(ctx, func() {
+		server.Close()
+	})
+	return wake, nil
+}
+
+// removeStaleSocket удаляет файл сокета, оставшийся после аварийного завершения процесса.
+// Сокет, который еще принимает соединения, не удаляется: net.Listen вернет ошибку.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", path, notifyTimeout); err == nil {
+		conn.Close()
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/model"
+)
+
+type countingNotifier struct {
+	calls atomic.Int32
+}
+
+func (n *countingNotifier) Notify() {
+	n.calls.Add(1)
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, want := range expected {
+		if got := b.Next(); got != want {
+			t.Errorf("Step %d: expected %v, got %v", i, want, got)
+		}
+	}
+
+	b.Reset()
+	if got := b.Next(); got != 100*time.Millisecond {
+		t.Errorf("Expected %v after reset, got %v", 100*time.Millisecond, got)
+	}
+}
+
+func TestWakeupHandler(t *testing.T) {
+	wake := make(chan struct{}, 1)
+	handler := WakeupHandler(wake)
+
+	t.Run("invalid method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/wakeup", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405, got %d", rr.Code)
+		}
+	})
+
+	t.Run("signals are coalesced", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/wakeup", nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusNoContent {
+				t.Errorf("Expected 204, got %d", rr.Code)
+			}
+		}
+		if len(wake) != 1 {
+			t.Errorf("Expected 1 pending signal, got %d", len(wake))
+		}
+	})
+}
+
+func TestHTTPNotifier(t *testing.T) {
+	received := make(chan struct{}, 10)
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer worker.Close()
+
+	notifier := NewHTTPNotifier([]string{worker.URL + "/wakeup"})
+	notifier.Notify()
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Worker was not notified")
+	}
+}
+
+func TestListenWakeup_Unix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "worker.sock")
+	wake, err := ListenWakeup(t.Context(), "unix:"+socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	NewHTTPNotifier([]string{"unix:" + socket}).Notify()
+
+	select {
+	case <-wake:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wakeup signal was not received")
+	}
+}
+
+func TestListenWakeup_StaleSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "worker.sock")
+	// Файл сокета остается, как после аварийного завершения воркера
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	wake, err := ListenWakeup(t.Context(), "unix:"+socket)
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	// Сокет работающего воркера не удаляется
+	if _, err := ListenWakeup(t.Context(), "unix:"+socket); err == nil {
+		t.Error("Expected error for a socket in use")
+	}
+
+	NewHTTPNotifier([]string{"unix:" + socket}).Notify()
+	select {
+	case <-wake:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wakeup signal was not received")
+	}
+}
+
+func TestHTTPNotifier_UnixPath(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "server.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	received := make(chan string, 10)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	NewHTTPNotifier([]string{"unix:" + socket + ":/internal/processed"}).Notify()
+
+	select {
+	case path := <-received:
+		if path != "/internal/processed" {
+			t.Errorf("Expected /internal/processed, got %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server was not notified")
+	}
+}
+
+func TestPostServerTrades_Notify(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	notifier := &countingNotifier{}
+	repo := NewServerService(store, WithEnqueueNotifier(notifier))
+
+	post := func(trade model.Trade) int {
+		body, _ := json.Marshal(trade)
+		req := httptest.NewRequest(http.MethodPost, "/trades", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		repo.PostServerTrades().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	trade := model.Trade{ClientTradeID: "t-1", Account: "ACC1", Symbol: "EURUSD", Volume: 1, Open: 1.1, Close: 1.2, Side: "buy"}
+	if code := post(trade); code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", code)
+	}
+	// Повторная отправка не добавляет сделку в очередь и не будит воркер
+	if code := post(trade); code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", code)
+	}
+	if got := notifier.calls.Load(); got != 1 {
+		t.Errorf("Expected 1 notification, got %d", got)
+	}
+
+	body := []byte(`[{"account":"ACC1","symbol":"EURUSD","volume":1,"open":1.1,"close":1.2,"side":"buy"}]`)
+	req := httptest.NewRequest(http.MethodPost, "/trades/batch", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	repo.PostServerTradesBatch().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rr.Code)
+	}
+	if got := notifier.calls.Load(); got != 2 {
+		t.Errorf("Expected 2 notifications, got %d", got)
+	}
+}
+
+func TestTradeService_RunWakeup(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wake := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		// Пауза между проходами намного больше таймаута теста: сделка
+		// может быть обработана вовремя только по сигналу wake
+		tradeService.Run(ctx, wake, Backoff{Min: time.Hour, Max: time.Hour})
+		close(done)
+	}()
+
+	enqueueTestTrades(t, store, testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"))
+	wake <- struct{}{}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := queuedTrade(t, store, 1).Status
+		if status == model.StatusProcessed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Trade was not processed after wakeup, status %s", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop")
+	}
+}
+
+func TestChannelNotifier(t *testing.T) {
+	wake := make(ChannelNotifier, 1)
+	// Сигналы, пришедшие до пробуждения воркера, объединяются
+	wake.Notify()
+	wake.Notify()
+	if len(wake) != 1 {
+		t.Errorf("Expected 1 pending signal, got %d", len(wake))
+	}
+}
+
+func TestBroadcaster(t *testing.T) {
+	b := NewBroadcaster()
+	first, second := b.Wait(), b.Wait()
+	b.Notify()
+	for _, ch := range []<-chan struct{}{first, second} {
+		select {
+		case <-ch:
+		default:
+			t.Fatal("Expected all waiters to be notified")
+		}
+	}
+	// После уведомления ожидание начинается заново
+	select {
+	case <-b.Wait():
+		t.Error("Expected new wait channel to be open")
+	default:
+	}
+}
+
+func TestProcessTrades_NotifiesProcessed(t *testing.T) {
+	store, cleanup := SetupTestStore(t)
+	defer cleanup()
+	notifier := &countingNotifier{}
+	service := NewTradeService(store, WithProcessedNotifier(notifier))
+
+	if err := service.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("ProcessTrades failed: %v", err)
+	}
+	if n := notifier.calls.Load(); n != 0 {
+		t.Errorf("Expected no notifications for an empty queue, got %d", n)
+	}
+
+	enqueueTestTrades(t, store, testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"))
+	if err := service.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("ProcessTrades failed: %v", err)
+	}
+	if n := notifier.calls.Load(); n != 1 {
+		t.Errorf("Expected 1 notification, got %d", n)
+	}
+}
@@ -1,93 +1,715 @@
 package services
 
 import (
-	"database/sql"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
+	"os"
 	"sync"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/logging"
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
 )
 
+// Количество знаков после запятой при округлении прибыли
+const profitPrecision = 1
+
+// Количество попыток обработки сделки по умолчанию
+const defaultMaxAttempts = 5
+
+// Размер порции сделок, обрабатываемой в одной транзакции, по умолчанию
+const defaultBatchSize = 100
+
+// Время, на которое воркер захватывает сделки, по умолчанию.
+// Если воркер не обработал сделку за это время, ее может забрать другой воркер.
+const defaultLeaseDuration = 30 * time.Second
+
+// Время, которое Run дает текущей порции на завершение после остановки, по умолчанию
+const defaultDrainTimeout = 5 * time.Second
+
+// TradeService обрабатывает очередь trades_q. Несколько экземпляров (в том числе
+// в разных процессах) могут работать с одной базой: сделки захватываются
+// в аренду на leaseDuration и применяются только владельцем аренды.
 type TradeService struct {
-	db *sql.DB
-	mu sync.Mutex
+	store         storage.Store
+	mu            sync.Mutex
+	maxAttempts   int
+	batchSize     int
+	workerID      string
+	leaseDuration time.Duration
+	drainTimeout  time.Duration
+	// host и started попадают в отметку воркера для GET /workers
+	host    string
+	started time.Time
+	metrics *WorkerMetrics
+	// processed сообщает серверу о сделках, перешедших в конечный статус
+	processed ProcessedNotifier
+	// logger добавляет worker_id ко всем записям воркера
+	logger *slog.Logger
+}
+
+type TradeServiceOption func(*TradeService)
+
+// ProcessedNotifier сообщает серверу, что сделки обработаны или перемещены в dead-letter,
+// чтобы запросы, ожидающие результата (?wait=), проверили свои сделки
+type ProcessedNotifier interface {
+	Notify()
+}
+
+// WithProcessedNotifier задает уведомитель, который вызывается после фиксации порции,
+// изменившей статус хотя бы одной сделки на конечный
+func WithProcessedNotifier(n ProcessedNotifier) TradeServiceOption {
+	return func(s *TradeService) {
+		s.processed = n
+	}
+}
+
+// WithMaxAttempts задает количество попыток, после которого сделка
+// с временной ошибкой переводится в статус failed
+func WithMaxAttempts(n int) TradeServiceOption {
+	return func(s *TradeService) {
+		if n > 0 {
+			s.maxAttempts = n
+		}
+	}
+}
+
+// WithBatchSize задает максимальное количество сделок в одной транзакции
+func WithBatchSize(n int) TradeServiceOption {
+	return func(s *TradeService) {
+		if n > 0 {
+			s.batchSize = n
+		}
+	}
+}
+
+// WithWorkerID задает идентификатор воркера, под которым захватываются сделки
+func WithWorkerID(id string) TradeServiceOption {
+	return func(s *TradeService) {
+		if id != "" {
+			s.workerID = id
+		}
+	}
+}
+
+// WithLeaseDuration задает время аренды захваченных сделок
+func WithLeaseDuration(d time.Duration) TradeServiceOption {
+	return func(s *TradeService) {
+		if d > 0 {
+			s.leaseDuration = d
+		}
+	}
+}
+
+// WithDrainTimeout задает время, которое Run дает текущей порции на завершение после остановки
+func WithDrainTimeout(d time.Duration) TradeServiceOption {
+	return func(s *TradeService) {
+		if d > 0 {
+			s.drainTimeout = d
+		}
+	}
 }
 
-func NewTradeService(db *sql.DB) *TradeService {
-	return &TradeService{db: db}
+func NewTradeService(store storage.Store, opts ...TradeServiceOption) *TradeService {
+	s := &TradeService{
+		store:         store,
+		maxAttempts:   defaultMaxAttempts,
+		batchSize:     defaultBatchSize,
+		workerID:      DefaultWorkerID(),
+		leaseDuration: defaultLeaseDuration,
+		drainTimeout:  defaultDrainTimeout,
+		host:          hostname(),
+		started:       time.Now(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.logger = slog.Default().With("worker_id", s.workerID)
+	return s
+}
+
+// WorkerID возвращает идентификатор воркера
+func (s *TradeService) WorkerID() string {
+	return s.workerID
+}
+
+// DefaultWorkerID строит идентификатор воркера из имени хоста, pid и случайного суффикса
+func DefaultWorkerID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostname(), os.Getpid(), hex.EncodeToString(suffix))
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
 }
 
-func (s *TradeService) ProcessTrades() error {
+// BatchResult описывает итог обработки одной порции сделок.
+// Сделки из Processed применены к статистике ровно один раз; сделки из Retried
+// и Failed не изменили статистику. Если транзакция порции не зафиксирована,
+// ни одна сделка порции не применена и BatchResult не возвращается.
+type BatchResult struct {
+	// Claimed - количество сделок, выбранных из очереди
+	Claimed int
+	// Processed - сделки, примененные к статистике
+	Processed int
+	// Retried - сделки с временной ошибкой, оставшиеся в очереди
+	Retried int
+	// Failed - сделки, перемещенные в dead-letter
+	Failed int
+	// Lost - сделки, аренду которых до обработки забрал другой воркер
+	Lost int
+	// Amended - отмены и исправления обработанных сделок, учтенные в статистике
+	Amended int
+	// LastID - id последней выбранной сделки
+	LastID int64
+}
+
+func (r *BatchResult) add(other BatchResult) {
+	r.Claimed += other.Claimed
+	r.Processed += other.Processed
+	r.Retried += other.Retried
+	r.Failed += other.Failed
+	r.Lost += other.Lost
+	r.Amended += other.Amended
+	if other.LastID > r.LastID {
+		r.LastID = other.LastID
+	}
+}
+
+// permanentError - ошибка в самой сделке, повторная обработка ее не исправит
+type permanentError struct {
+	reason string
+}
+
+func (e *permanentError) Error() string {
+	return e.reason
+}
+
+// processingEnv - справочные данные, общие для всех сделок в транзакции
+type processingEnv struct {
+	instruments model.Instruments
+	rates       model.Rates
+	currencies  map[string]string
+}
+
+// ProcessTrades обрабатывает все сделки, ожидающие в очереди на момент вызова,
+// порциями по batchSize. Каждая сделка рассматривается не более одного раза за вызов.
+// Отмена ctx прерывает обработку: транзакция текущей порции откатывается,
+// уже зафиксированные порции остаются примененными.
+func (s *TradeService) ProcessTrades(ctx context.Context) error {
+	_, err := s.ProcessPending(ctx)
+	return err
+}
+
+// ProcessPending работает как ProcessTrades и возвращает суммарный итог всех порций.
+// Следующая порция выбирается сразу, пока предыдущая была заполнена полностью.
+func (s *TradeService) ProcessPending(ctx context.Context) (BatchResult, error) {
+	return s.processPending(ctx, ctx.Done())
+}
+
+// processPending обрабатывает порции в контексте ctx и не начинает новую порцию после закрытия stop
+func (s *TradeService) processPending(ctx context.Context, stop <-chan struct{}) (BatchResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	tx, err := s.db.Begin()
+	var total BatchResult
+	for {
+		select {
+		case <-stop:
+			return total, ctx.Err()
+		default:
+		}
+
+		result, err := s.processBatch(ctx, total.LastID)
+		if err != nil {
+			return total, err
+		}
+		total.add(result)
+		if result.Claimed < s.batchSize {
+			break
+		}
+	}
+
+	// Изменения применяются после сделок: исправленная сделка, поставленная
+	// до изменения, к этому моменту уже учтена в статистике
+	amended, err := s.processAmendments(ctx, stop)
+	total.Amended += amended
+	return total, err
+}
+
+// Run обрабатывает очередь до отмены ctx. После прохода, в котором
+// сделки были применены, воркер ждет backoff.Min; после пустых проходов пауза
+// растет экспоненциально до backoff.Max. Сигнал из wake (может быть nil)
+// прерывает паузу и запускает следующий проход немедленно.
+//
+// После отмены ctx новые порции не выбираются, а текущей порции дается drainTimeout
+// на завершение; если она не успела, ее транзакция откатывается. Перед выходом
+// воркер снимает аренду с необработанных сделок, чтобы их сразу могли забрать другие воркеры.
+func (s *TradeService) Run(ctx context.Context, wake <-chan struct{}, backoff Backoff) {
+	work, cancel := drainContext(ctx, s.drainTimeout)
+	defer cancel()
+	defer s.releaseLeases(context.WithoutCancel(ctx))
+
+	for {
+		result, err := s.processPending(work, ctx.Done())
+		if err != nil {
+			s.logger.Error("failed to process trades", "err", err)
+		}
+		s.recordHeartbeat(work, result, err)
+
+		wait := backoff.Min
+		if err == nil && result.Processed+result.Failed+result.Amended > 0 {
+			backoff.Reset()
+		} else {
+			wait = backoff.Next()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-wake:
+			timer.Stop()
+			backoff.Reset()
+		case <-timer.C:
+		}
+	}
+}
+
+// drainContext возвращает контекст обработки, который отменяется через timeout после отмены ctx
+func drainContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-work.Done():
+			return
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-work.Done():
+		}
+	}()
+	return work, cancel
+}
+
+// recordHeartbeat записывает итог прохода по очереди; по отметкам сервер судит, работает ли воркер
+func (s *TradeService) recordHeartbeat(ctx context.Context, result BatchResult, runErr error) {
+	heartbeat := storage.WorkerHeartbeat{
+		WorkerID:      s.workerID,
+		Host:          s.host,
+		PID:           os.Getpid(),
+		StartedAt:     s.started.Unix(),
+		LastRunAt:     time.Now().Unix(),
+		LastBatchSize: result.Claimed,
+	}
+	if runErr != nil {
+		heartbeat.LastError = runErr.Error()
+	}
+	if err := s.store.RecordHeartbeat(ctx, heartbeat); err != nil {
+		s.logger.Error("failed to record heartbeat", "err", err)
+	}
+}
+
+// releaseLeases снимает аренду этого воркера с сделок, которые еще ожидают обработки
+func (s *TradeService) releaseLeases(ctx context.Context) {
+	if err := s.store.ReleaseLeases(ctx, s.workerID); err != nil {
+		s.logger.Error("failed to release leases", "err", err)
+	}
+}
+
+// ProcessBatch захватывает одну порцию сделок с id больше afterID и обрабатывает ее в одной транзакции
+func (s *TradeService) ProcessBatch(ctx context.Context, afterID int64) (BatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.processBatch(ctx, afterID)
+}
+
+func (s *TradeService) processBatch(ctx context.Context, afterID int64) (BatchResult, error) {
+	var result BatchResult
+
+	now := time.Now()
+	trades, err := s.store.ClaimTrades(ctx, storage.Claim{
+		WorkerID:   s.workerID,
+		AfterID:    afterID,
+		Limit:      s.batchSize,
+		Now:        now.Unix(),
+		LeaseUntil: now.Add(s.leaseDuration).Unix(),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return result, err
 	}
-	defer tx.Rollback()
+	result.Claimed = len(trades)
+	if len(trades) == 0 {
+		return result, nil
+	}
+	result.LastID = trades[len(trades)-1].ID
+
+	// Примененные сделки попадают в лог и метрики только после фиксации порции
+	var processed []storage.QueuedTrade
+	// При отмене ctx незафиксированная транзакция откатывается
+	err = s.store.ProcessBatch(ctx, func(tx storage.BatchTx) error {
+		env, err := loadProcessingEnv(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		for _, trade := range trades {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("batch interrupted: %v", err)
+			}
 
-	rows, err := tx.Query("SELECT id, account, symbol, volume, open, close, side FROM trades_q WHERE processed = 0")
+			status := model.StatusPending
+			applyErr := applyOrRecord(ctx, tx, func() error {
+				return s.applyTrade(ctx, tx, env, trade)
+			}, func(applyErr error) error {
+				// Прерванная сделка не считается неудачной попыткой
+				if errors.Is(applyErr, storage.ErrLeaseLost) || ctx.Err() != nil {
+					return nil
+				}
+				var err error
+				status, err = s.recordFailure(ctx, tx, trade, applyErr)
+				return err
+			})
+			if applyErr != nil && ctx.Err() != nil {
+				return fmt.Errorf("batch interrupted: %v", ctx.Err())
+			}
+
+			switch {
+			case applyErr == nil:
+				result.Processed++
+				processed = append(processed, trade)
+			case errors.Is(applyErr, storage.ErrLeaseLost):
+				s.logger.WarnContext(tradeContext(ctx, trade), "trade lease taken over by another worker", "trade_id", trade.ID)
+				result.Lost++
+			case status == model.StatusFailed:
+				result.Failed++
+			default:
+				result.Retried++
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to query trades: %v", err)
+		return BatchResult{}, err
+	}
+
+	done := time.Now()
+	for _, trade := range processed {
+		s.logger.InfoContext(tradeContext(ctx, trade), "trade processed",
+			"trade_id", trade.ID, "account", trade.Account, "symbol", trade.Symbol, "attempt", trade.Attempts+1)
+	}
+	s.metrics.batchDone(result, processed, done.Sub(now), done)
+	if s.processed != nil && result.Processed+result.Failed > 0 {
+		s.processed.Notify()
+	}
+	return result, nil
+}
+
+// applyOrRecord выполняет всю работу над одной сделкой или изменением в точке сохранения tx:
+// apply - во вложенной точке, после отката которой record записывает ошибку apply.
+// Ошибочный запрос откатывает только эту сделку, а не всю транзакцию порции.
+// Возвращает ошибку apply.
+func applyOrRecord(ctx context.Context, tx storage.BatchTx, apply func() error, record func(applyErr error) error) error {
+	var applyErr error
+	// Ошибку record уже записал в лог, а сломанная точка сохранения не даст зафиксировать порцию
+	tx.Savepoint(ctx, func() error {
+		applyErr = tx.Savepoint(ctx, apply)
+		if applyErr == nil {
+			return nil
+		}
+		return record(applyErr)
+	})
+	return applyErr
+}
+
+// tradeContext добавляет к ctx идентификатор запроса, поставившего сделку в очередь
+func tradeContext(ctx context.Context, trade storage.QueuedTrade) context.Context {
+	if trade.RequestID == "" {
+		return ctx
+	}
+	return logging.WithRequestID(ctx, trade.RequestID)
+}
+
+// loadProcessingEnv читает справочные данные в транзакции tx
+func loadProcessingEnv(ctx context.Context, tx storage.ReferenceTx) (*processingEnv, error) {
+	env := &processingEnv{currencies: make(map[string]string)}
+	var err error
+	env.instruments, err = tx.Instruments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	env.rates, err = tx.Rates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// applyTrade считает прибыль сделки и применяет ее к агрегатам.
+// Если аренда сделки перешла к другому воркеру, возвращает storage.ErrLeaseLost.
+func (s *TradeService) applyTrade(ctx context.Context, tx storage.BatchTx, env *processingEnv, trade storage.QueuedTrade) error {
+	applied, err := s.settle(ctx, tx, env, trade)
+	if err != nil {
+		return err
+	}
+	return tx.ApplyTrade(ctx, applied)
+}
+
+// settle считает прибыль сделки в валюте котировки и в валюте аккаунта
+func (s *TradeService) settle(ctx context.Context, tx storage.ReferenceTx, env *processingEnv, trade storage.QueuedTrade) (storage.AppliedTrade, error) {
+	if trade.Side != "buy" && trade.Side != "sell" {
+		return storage.AppliedTrade{}, &permanentError{reason: fmt.Sprintf("invalid side %q", trade.Side)}
+	}
+	if !env.instruments.Known(trade.Symbol) {
+		return storage.AppliedTrade{}, &permanentError{reason: fmt.Sprintf("unknown symbol %s", trade.Symbol)}
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var (
-			id      int
-			account string
-			symbol  string
-			volume  float64
-			open    float64
-			close   float64
-			side    string
-		)
+	lot := env.instruments.ContractSize(trade.Symbol)
+	profit := roundFloat((trade.Close-trade.Open)*trade.Volume*lot, profitPrecision)
+	if trade.Side == "sell" {
+		profit = -profit
+	}
 
-		if err := rows.Scan(&id, &account, &symbol, &volume, &open, &close, &side); err != nil {
-			log.Printf("Ошибка при сканировании записи: %v", err)
-			continue
+	currency, ok := env.currencies[trade.Account]
+	if !ok {
+		var err error
+		currency, err = tx.AccountCurrency(ctx, trade.Account)
+		if err != nil {
+			return storage.AppliedTrade{}, err
 		}
+		env.currencies[trade.Account] = currency
+	}
 
-		if side != "buy" && side != "sell" {
-			log.Printf("Некорректное значение side: %s для записи с id=%d", side, id)
-			continue
+	// Прибыль считается в валюте котировки и пересчитывается в валюту аккаунта.
+	// Если валюта котировки неизвестна, считаем ее совпадающей с валютой аккаунта.
+	quoteCurrency := env.instruments.QuoteCurrency(trade.Symbol)
+	converted := profit
+	if quoteCurrency != "" && quoteCurrency != currency {
+		var err error
+		converted, err = env.rates.Convert(profit, quoteCurrency, currency)
+		if err != nil {
+			return storage.AppliedTrade{}, fmt.Errorf("failed to convert profit: %v", err)
 		}
+		converted = roundFloat(converted, profitPrecision)
+	}
+
+	return storage.AppliedTrade{
+		ID:              trade.ID,
+		WorkerID:        s.workerID,
+		Account:         trade.Account,
+		Symbol:          trade.Symbol,
+		Side:            trade.Side,
+		Volume:          trade.Volume,
+		Profit:          profit,
+		QuoteCurrency:   quoteCurrency,
+		ConvertedProfit: converted,
+		AccountCurrency: currency,
+		Time:            tradeTime(trade),
+	}, nil
+}
+
+// tradeTime - время сделки для истории прибыли. Сделка относится к периоду по времени
+// закрытия, а если оно не передано - по времени постановки в очередь.
+func tradeTime(trade storage.QueuedTrade) int64 {
+	if trade.CloseTime != 0 {
+		return trade.CloseTime
+	}
+	return trade.CreatedAt
+}
+
+// storedResult - вклад обработанной сделки в агрегаты по сохраненному результату расчета
+func storedResult(trade storage.TradeRecord) storage.AppliedTrade {
+	return storage.AppliedTrade{
+		ID:              trade.ID,
+		Account:         trade.Account,
+		Symbol:          trade.Symbol,
+		Side:            trade.Side,
+		Volume:          trade.Volume,
+		Profit:          trade.Profit,
+		QuoteCurrency:   trade.QuoteCurrency,
+		ConvertedProfit: trade.ConvertedProfit,
+		AccountCurrency: trade.AccountCurrency,
+		Time:            tradeTime(trade.QueuedTrade),
+	}
+}
+
+// recordFailure увеличивает счетчик попыток и переводит сделку в failed,
+// если ошибка постоянная или попытки исчерпаны. Возвращает новый статус сделки
+// и ошибку записи, при которой сделка остается в очереди.
+func (s *TradeService) recordFailure(ctx context.Context, tx storage.BatchTx, trade storage.QueuedTrade, cause error) (string, error) {
+	attempts := trade.Attempts + 1
+	status := model.StatusPending
+	var permanent *permanentError
+	if errors.As(cause, &permanent) || attempts >= s.maxAttempts {
+		status = model.StatusFailed
+	}
+
+	logCtx := tradeContext(ctx, trade)
+	if status == model.StatusFailed {
+		s.logger.ErrorContext(logCtx, "trade moved to dead-letter", "trade_id", trade.ID, "attempt", attempts, "err", cause)
+	} else {
+		s.logger.WarnContext(logCtx, "trade processing failed, will retry",
+			"trade_id", trade.ID, "attempt", attempts, "max_attempts", s.maxAttempts, "err", cause)
+	}
+
+	// Аренда снимается, чтобы следующая попытка не ждала ее истечения
+	err := tx.RecordFailure(ctx, storage.Failure{
+		ID:       trade.ID,
+		WorkerID: s.workerID,
+		Status:   status,
+		Attempts: attempts,
+		Reason:   cause.Error(),
+	})
+	if err != nil {
+		s.logger.ErrorContext(logCtx, "failed to record trade failure", "trade_id", trade.ID, "err", err)
+		return model.StatusPending, err
+	}
+	return status, nil
+}
 
-		lot := 100000.0
-		profit := roundFloat((close-open)*volume*lot, 1)
-		if side == "sell" {
-			profit = -profit
+// processAmendments применяет к статистике отмены и исправления обработанных сделок,
+// каждое изменение - в своей транзакции. Возвращает количество примененных изменений.
+func (s *TradeService) processAmendments(ctx context.Context, stop <-chan struct{}) (int, error) {
+	applied := 0
+	var afterID int64
+	for {
+		pending, err := s.store.PendingAmendments(ctx, afterID, s.batchSize)
+		if err != nil {
+			return applied, err
+		}
+		for _, amendment := range pending {
+			select {
+			case <-stop:
+				return applied, ctx.Err()
+			default:
+			}
+
+			afterID = amendment.ID
+			ok, err := s.processAmendment(ctx, amendment)
+			if err != nil {
+				return applied, err
+			}
+			if ok {
+				applied++
+			}
 		}
+		if len(pending) < s.batchSize {
+			return applied, nil
+		}
+	}
+}
+
+// processAmendment применяет одно изменение и сообщает, было ли оно применено этим воркером
+func (s *TradeService) processAmendment(ctx context.Context, amendment storage.PendingAmendment) (bool, error) {
+	logCtx := ctx
+	if amendment.RequestID != "" {
+		logCtx = logging.WithRequestID(ctx, amendment.RequestID)
+	}
 
-		// Обновление статистики аккаунта
-		_, err = tx.Exec(
-			"INSERT INTO account_stats (account, trades, profit) VALUES (?, 1, ?) "+
-				"ON CONFLICT(account) DO UPDATE SET trades = trades + 1, profit = profit + excluded.profit",
-			account, profit,
-		)
+	applied := false
+	err := s.store.ProcessBatch(ctx, func(tx storage.BatchTx) error {
+		env, err := loadProcessingEnv(ctx, tx)
 		if err != nil {
-			log.Printf("Ошибка при обновлении статистики аккаунта: %v", err)
-			continue
+			return err
+		}
+
+		applyErr := applyOrRecord(ctx, tx, func() error {
+			return s.applyAmendment(ctx, tx, env, amendment)
+		}, func(applyErr error) error {
+			// Изменение уже применил другой воркер
+			if errors.Is(applyErr, storage.ErrNotFound) || ctx.Err() != nil {
+				return nil
+			}
+			return s.recordAmendmentFailure(logCtx, tx, amendment, applyErr)
+		})
+		if applyErr != nil && ctx.Err() != nil {
+			return fmt.Errorf("amendment interrupted: %v", ctx.Err())
 		}
+		applied = applyErr == nil
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if applied {
+		s.logger.InfoContext(logCtx, "trade amended",
+			"amendment_id", amendment.ID, "trade_id", amendment.TradeID, "action", amendment.Action)
+		s.metrics.amendmentApplied()
+	}
+	return applied, nil
+}
 
-		// Пометка записи как обработанной
-		_, err = tx.Exec("UPDATE trades_q SET processed = 1 WHERE id = ?", id)
+// applyAmendment вычитает из статистики вклад сделки до изменения и для исправления
+// добавляет вклад сделки с новыми значениями
+func (s *TradeService) applyAmendment(ctx context.Context, tx storage.BatchTx, env *processingEnv, amendment storage.PendingAmendment) error {
+	trade := amendment.Trade
+	applied := storage.AppliedAmendment{
+		ID:       amendment.ID,
+		TradeID:  amendment.TradeID,
+		Values:   amendment.Values,
+		Reversed: storedResult(trade),
+		Now:      time.Now().Unix(),
+	}
+
+	if amendment.Action == model.AmendmentCorrect {
+		corrected := trade.QueuedTrade
+		corrected.Volume, corrected.Open, corrected.Close, corrected.Side =
+			amendment.Values.Volume, amendment.Values.Open, amendment.Values.Close, amendment.Values.Side
+		result, err := s.settle(ctx, tx, env, corrected)
 		if err != nil {
-			log.Printf("Ошибка при обновлении статуса записи: %v", err)
-			continue
+			return err
 		}
+		applied.Corrected = &result
 	}
+	return tx.ApplyAmendment(ctx, applied)
+}
 
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("error iterating trades: %v", err)
+// recordAmendmentFailure увеличивает счетчик попыток изменения и переводит его в failed,
+// если ошибка постоянная или попытки исчерпаны. Сделка и статистика при этом не меняются.
+func (s *TradeService) recordAmendmentFailure(ctx context.Context, tx storage.BatchTx, amendment storage.PendingAmendment, cause error) error {
+	attempts := amendment.Attempts + 1
+	status := model.StatusPending
+	var permanent *permanentError
+	if errors.As(cause, &permanent) || attempts >= s.maxAttempts {
+		status = model.StatusFailed
 	}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+	if status == model.StatusFailed {
+		s.logger.ErrorContext(ctx, "trade amendment failed",
+			"amendment_id", amendment.ID, "trade_id", amendment.TradeID, "attempt", attempts, "err", cause)
+	} else {
+		s.logger.WarnContext(ctx, "trade amendment failed, will retry",
+			"amendment_id", amendment.ID, "trade_id", amendment.TradeID, "attempt", attempts, "max_attempts", s.maxAttempts, "err", cause)
 	}
 
-	return nil
+	err := tx.RecordAmendmentFailure(ctx, storage.Failure{
+		ID:       amendment.ID,
+		Status:   status,
+		Attempts: attempts,
+		Reason:   cause.Error(),
+	})
+	if err != nil {
+		s.logger.ErrorContext(ctx, "failed to record amendment failure", "amendment_id", amendment.ID, "err", err)
+	}
+	return err
 }
 
 func roundFloat(val float64, precision int) float64 {
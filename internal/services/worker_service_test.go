@@ -1,150 +1,305 @@
 package services
 
 import (
-	"database/sql"
+	"context"
+	"errors"
+	"fmt"
 	"math"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"gitlab.com/digineat/go-broker-test/internal/model"
+	"gitlab.com/digineat/go-broker-test/internal/storage"
 )
 
-func setupTestDB(t *testing.T) (*sql.DB, func()) {
-	db, err := sql.Open("sqlite3", ":memory:")
+func setupTestStore(t *testing.T) (*storage.MemoryStore, func()) {
+	return SetupTestStore(t)
+}
+
+func testTrade(account, symbol string, volume, open, close float64, side string) model.Trade {
+	return model.Trade{Account: account, Symbol: symbol, Volume: volume, Open: open, Close: close, Side: side}
+}
+
+// enqueueTestTrades ставит сделки в очередь, id выдаются по порядку начиная с 1
+func enqueueTestTrades(t *testing.T, store storage.Store, trades ...model.Trade) {
+	t.Helper()
+	if _, err := store.EnqueueTrades(context.Background(), trades); err != nil {
+		t.Fatalf("Не удалось вставить тестовые данные: %v", err)
+	}
+}
+
+// queuedTrade возвращает запись очереди по id
+func queuedTrade(t *testing.T, store storage.Store, id int64) storage.TradeRecord {
+	t.Helper()
+	record, err := store.Trade(context.Background(), id)
 	if err != nil {
-		t.Fatalf("Не удалось открыть базу данных в памяти: %v", err)
+		t.Fatalf("Не удалось получить запись %d из очереди: %v", id, err)
 	}
+	return record
+}
 
-	createTradesQ := `
-		CREATE TABLE trades_q (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			account TEXT NOT NULL,
-			symbol TEXT NOT NULL,
-			volume REAL NOT NULL,
-			open REAL NOT NULL,
-			close REAL NOT NULL,
-			side TEXT NOT NULL,
-			processed INTEGER DEFAULT 0
-		)`
-	createAccountStats := `
-		CREATE TABLE account_stats (
-			account TEXT PRIMARY KEY,
-			trades INTEGER DEFAULT 0,
-			profit REAL DEFAULT 0.0
-		)`
+// queuedTrades возвращает все записи очереди в порядке id
+func queuedTrades(t *testing.T, store storage.Store) []storage.TradeRecord {
+	t.Helper()
+	var records []storage.TradeRecord
+	for id := int64(1); ; id++ {
+		record, err := store.Trade(context.Background(), id)
+		if errors.Is(err, storage.ErrNotFound) {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("Не удалось получить запись %d из очереди: %v", id, err)
+		}
+		records = append(records, record)
+	}
+}
 
-	if _, err := db.Exec(createTradesQ); err != nil {
-		t.Fatalf("Не удалось создать таблицу trades_q: %v", err)
+// claimTestTrades захватывает сделки в аренду воркером workerID до момента leaseUntil
+func claimTestTrades(t *testing.T, store storage.Store, workerID string, afterID int64, limit int, leaseUntil time.Time) {
+	t.Helper()
+	_, err := store.ClaimTrades(context.Background(), storage.Claim{
+		WorkerID:   workerID,
+		AfterID:    afterID,
+		Limit:      limit,
+		Now:        time.Now().Unix(),
+		LeaseUntil: leaseUntil.Unix(),
+	})
+	if err != nil {
+		t.Fatalf("Не удалось захватить сделки: %v", err)
 	}
-	if _, err := db.Exec(createAccountStats); err != nil {
-		t.Fatalf("Не удалось создать таблицу account_stats: %v", err)
+}
+
+// applyTestTrades проводит сделки через очередь с заданной прибылью, чтобы наполнить
+// статистику. Хранилище должно быть пустым.
+func applyTestTrades(t *testing.T, store storage.Store, trades ...storage.AppliedTrade) {
+	t.Helper()
+	ctx := context.Background()
+	for _, trade := range trades {
+		enqueueTestTrades(t, store, testTrade(trade.Account, trade.Symbol, trade.Volume, 1, 1, trade.Side))
+	}
+	now := time.Now().Unix()
+	claimed, err := store.ClaimTrades(ctx, storage.Claim{WorkerID: "seed", Limit: len(trades), Now: now, LeaseUntil: now + 60})
+	if err != nil || len(claimed) != len(trades) {
+		t.Fatalf("Не удалось захватить тестовые сделки: %v", err)
+	}
+	err = store.ProcessBatch(ctx, func(tx storage.BatchTx) error {
+		for i, trade := range trades {
+			trade.ID, trade.WorkerID = claimed[i].ID, "seed"
+			if trade.AccountCurrency == "" {
+				trade.AccountCurrency = model.DefaultAccountCurrency
+			}
+			if trade.Time == 0 {
+				trade.Time = claimed[i].CreatedAt
+			}
+			if err := tx.ApplyTrade(ctx, trade); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Не удалось применить тестовые сделки: %v", err)
 	}
+}
 
-	cleanup := func() {
-		db.Close()
+// faultyStore - хранилище, в котором операции транзакции порции завершаются ошибкой
+type faultyStore struct {
+	storage.Store
+	// applyErr вызывается перед применением сделки, ошибка возвращается вместо применения
+	applyErr   func(trade storage.AppliedTrade) error
+	failureErr error
+}
+
+func (s *faultyStore) ProcessBatch(ctx context.Context, fn func(tx storage.BatchTx) error) error {
+	return s.Store.ProcessBatch(ctx, func(tx storage.BatchTx) error {
+		return fn(&faultyBatchTx{BatchTx: tx, store: s})
+	})
+}
+
+type faultyBatchTx struct {
+	storage.BatchTx
+	store *faultyStore
+}
+
+func (tx *faultyBatchTx) ApplyTrade(ctx context.Context, trade storage.AppliedTrade) error {
+	if tx.store.applyErr != nil {
+		if err := tx.store.applyErr(trade); err != nil {
+			return err
+		}
 	}
+	return tx.BatchTx.ApplyTrade(ctx, trade)
+}
 
-	return db, cleanup
+func (tx *faultyBatchTx) RecordFailure(ctx context.Context, failure storage.Failure) error {
+	if tx.store.failureErr != nil {
+		return tx.store.failureErr
+	}
+	return tx.BatchTx.RecordFailure(ctx, failure)
 }
 
-func TestProcessTrades_Success(t *testing.T) {
-	db, cleanup := setupTestDB(t)
-	defer cleanup()
+// errTxAborted - ошибка PostgreSQL для запросов в прерванной транзакции
+var errTxAborted = errors.New("current transaction is aborted, commands ignored until end of transaction block")
 
-	tradeService := NewTradeService(db)
+// abortingStore воспроизводит транзакцию PostgreSQL: после ошибочного запроса любые
+// операции завершаются ошибкой до отката к точке сохранения, а прерванная транзакция
+// при фиксации откатывается целиком
+type abortingStore struct {
+	storage.Store
+	// brokenAccount - аккаунт, чтение валюты которого завершается ошибкой
+	brokenAccount string
+}
 
-	_, err := db.Exec(`
-		INSERT INTO trades_q (account, symbol, volume, open, close, side)
-		VALUES (?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?),
-		(?, ?, ?, ?, ?, ?)`,
-		"user1", "BTC", 1.5, 100.0, 110.0, "buy",
-		"user1", "ETH", 2.0, 200.0, 190.0, "sell",
-		"user2", "BTC", 1.0, 150.0, 160.0, "buy")
-	if err != nil {
-		t.Fatalf("Не удалось вставить тестовые данные: %v", err)
+func (s *abortingStore) ProcessBatch(ctx context.Context, fn func(tx storage.BatchTx) error) error {
+	return s.Store.ProcessBatch(ctx, func(tx storage.BatchTx) error {
+		atx := &abortingBatchTx{BatchTx: tx, store: s}
+		if err := fn(atx); err != nil {
+			return err
+		}
+		if atx.aborted {
+			return errTxAborted
+		}
+		return nil
+	})
+}
+
+type abortingBatchTx struct {
+	storage.BatchTx
+	store   *abortingStore
+	aborted bool
+}
+
+// run выполняет операцию, если транзакция не прервана, и прерывает ее при ошибке
+func (tx *abortingBatchTx) run(op func() error) error {
+	if tx.aborted {
+		return errTxAborted
 	}
+	if err := op(); err != nil {
+		tx.aborted = true
+		return err
+	}
+	return nil
+}
 
-	err = tradeService.ProcessTrades()
+func (tx *abortingBatchTx) Savepoint(ctx context.Context, fn func() error) error {
+	if tx.aborted {
+		return errTxAborted
+	}
+	err := tx.BatchTx.Savepoint(ctx, fn)
 	if err != nil {
-		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
+		// ROLLBACK TO снимает прерывание транзакции
+		tx.aborted = false
 	}
+	return err
+}
+
+func (tx *abortingBatchTx) AccountCurrency(ctx context.Context, account string) (string, error) {
+	var currency string
+	err := tx.run(func() error {
+		if account == tx.store.brokenAccount {
+			return errors.New("canceling statement due to lock timeout")
+		}
+		var err error
+		currency, err = tx.BatchTx.AccountCurrency(ctx, account)
+		return err
+	})
+	return currency, err
+}
+
+func (tx *abortingBatchTx) ApplyTrade(ctx context.Context, trade storage.AppliedTrade) error {
+	return tx.run(func() error { return tx.BatchTx.ApplyTrade(ctx, trade) })
+}
+
+func (tx *abortingBatchTx) RecordFailure(ctx context.Context, failure storage.Failure) error {
+	return tx.run(func() error { return tx.BatchTx.RecordFailure(ctx, failure) })
+}
+
+func (tx *abortingBatchTx) ApplyAmendment(ctx context.Context, amendment storage.AppliedAmendment) error {
+	return tx.run(func() error { return tx.BatchTx.ApplyAmendment(ctx, amendment) })
+}
 
-	var processedCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM trades_q WHERE processed = 1").Scan(&processedCount)
+func (tx *abortingBatchTx) RecordAmendmentFailure(ctx context.Context, failure storage.Failure) error {
+	return tx.run(func() error { return tx.BatchTx.RecordAmendmentFailure(ctx, failure) })
+}
+
+// accountStats возвращает общую статистику аккаунта
+func accountStats(t *testing.T, store storage.Store, account string) storage.AccountStats {
+	t.Helper()
+	stats, err := store.AccountStats(context.Background(), account)
 	if err != nil {
-		t.Fatalf("Не удалось выполнить запрос к trades_q: %v", err)
-	}
-	if processedCount != 3 {
-		t.Errorf("Ожидалось, что обработано 3 записи, но обработано: %d", processedCount)
+		t.Fatalf("Не удалось получить статистику аккаунта %s: %v", account, err)
 	}
+	return stats
+}
+
+func TestProcessTrades_Success(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store)
 
-	var trades1 int
-	var profit1 float64
-	err = db.QueryRow("SELECT trades, profit FROM account_stats WHERE account = 'user1'").Scan(&trades1, &profit1)
+	enqueueTestTrades(t, store,
+		testTrade("user1", "BTC", 1.5, 100.0, 110.0, "buy"),
+		testTrade("user1", "ETH", 2.0, 200.0, 190.0, "sell"),
+		testTrade("user2", "BTC", 1.0, 150.0, 160.0, "buy"))
+
+	err := tradeService.ProcessTrades(context.Background())
 	if err != nil {
-		t.Fatalf("Не удалось выполнить запрос к account_stats для user1: %v", err)
+		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
 	}
-	if trades1 != 2 {
-		t.Errorf("Ожидалось 2 сделки для user1, но найдено: %d", trades1)
+
+	for id := int64(1); id <= 3; id++ {
+		if status := queuedTrade(t, store, id).Status; status != model.StatusProcessed {
+			t.Errorf("Ожидалось, что запись %d обработана, но найдено: %s", id, status)
+		}
+	}
+
+	stats1 := accountStats(t, store, "user1")
+	if stats1.Trades != 2 {
+		t.Errorf("Ожидалось 2 сделки для user1, но найдено: %d", stats1.Trades)
 	}
 	expectedProfit1 := 3500000.0
-	if math.Abs(profit1-expectedProfit1) > 0.01 {
-		t.Errorf("Ожидалась прибыль для user1 %.1f, но найдено: %.1f", expectedProfit1, profit1)
+	if math.Abs(stats1.Profit-expectedProfit1) > 0.01 {
+		t.Errorf("Ожидалась прибыль для user1 %.1f, но найдено: %.1f", expectedProfit1, stats1.Profit)
 	}
 
-	var trades2 int
-	var profit2 float64
-	err = db.QueryRow("SELECT trades, profit FROM account_stats WHERE account = 'user2'").Scan(&trades2, &profit2)
-	if err != nil {
-		t.Fatalf("Не удалось выполнить запрос к account_stats для user2: %v", err)
-	}
-	if trades2 != 1 {
-		t.Errorf("Ожидалась 1 сделка для user2, но найдено: %d", trades2)
+	stats2 := accountStats(t, store, "user2")
+	if stats2.Trades != 1 {
+		t.Errorf("Ожидалась 1 сделка для user2, но найдено: %d", stats2.Trades)
 	}
 	expectedProfit2 := 1000000.0
-	if math.Abs(profit2-expectedProfit2) > 0.01 {
-		t.Errorf("Ожидалась прибыль для user2 %.1f, но найдено: %.1f", expectedProfit2, profit2)
+	if math.Abs(stats2.Profit-expectedProfit2) > 0.01 {
+		t.Errorf("Ожидалась прибыль для user2 %.1f, но найдено: %.1f", expectedProfit2, stats2.Profit)
 	}
 }
 
-func TestProcessTrades_ErrorOnBegin(t *testing.T) {
-	db, cleanup := setupTestDB(t)
+func TestProcessTrades_ClosedStore(t *testing.T) {
+	store, cleanup := setupTestStore(t)
 	cleanup()
 
-	tradeService := NewTradeService(db)
+	tradeService := NewTradeService(store)
 
-	err := tradeService.ProcessTrades()
+	err := tradeService.ProcessTrades(context.Background())
 	if err == nil {
-		t.Error("Ожидалась ошибка при начале транзакции, но её не произошло")
-	}
-	if err.Error() != "failed to begin transaction: sql: database is closed" {
-		t.Errorf("Ожидалась ошибка 'failed to begin transaction: sql: database is closed', но получено: %v", err)
+		t.Error("Ожидалась ошибка при обращении к закрытому хранилищу, но её не произошло")
 	}
 }
 
 func TestProcessTrades_RoundProfit(t *testing.T) {
-	db, cleanup := setupTestDB(t)
+	store, cleanup := setupTestStore(t)
 	defer cleanup()
 
-	tradeService := NewTradeService(db)
+	tradeService := NewTradeService(store)
 
-	_, err := db.Exec(`
-		INSERT INTO trades_q (account, symbol, volume, open, close, side)
-		VALUES (?, ?, ?, ?, ?, ?)`,
-		"user1", "BTC", 1.5, 100.0, 110.123456, "buy")
-	if err != nil {
-		t.Fatalf("Не удалось вставить тестовые данные: %v", err)
-	}
+	enqueueTestTrades(t, store, testTrade("user1", "BTC", 1.5, 100.0, 110.123456, "buy"))
 
-	err = tradeService.ProcessTrades()
+	err := tradeService.ProcessTrades(context.Background())
 	if err != nil {
 		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
 	}
 
-	var profit float64
-	err = db.QueryRow("SELECT profit FROM account_stats WHERE account = 'user1'").Scan(&profit)
-	if err != nil {
-		t.Fatalf("Не удалось выполнить запрос к account_stats: %v", err)
-	}
+	profit := accountStats(t, store, "user1").Profit
 	expectedProfit := 1518518.4
 	if math.Abs(profit-expectedProfit) > 0.01 {
 		t.Errorf("Ожидалась прибыль %.1f, но найдено: %.1f", expectedProfit, profit)
@@ -152,119 +307,631 @@ func TestProcessTrades_RoundProfit(t *testing.T) {
 }
 
 func TestProcessTrades_ErrorInLoop(t *testing.T) {
-	db, cleanup := setupTestDB(t)
+	memory, cleanup := setupTestStore(t)
 	defer cleanup()
 
-	tradeService := NewTradeService(db)
+	store := &faultyStore{Store: memory, applyErr: func(storage.AppliedTrade) error {
+		return errors.New("account stats unavailable")
+	}}
+	tradeService := NewTradeService(store)
 
-	_, err := db.Exec(`
-		INSERT INTO trades_q (account, symbol, volume, open, close, side)
-		VALUES (?, ?, ?, ?, ?, ?)`,
-		"user1", "BTC", 1.5, 100.0, 110.0, "buy")
+	enqueueTestTrades(t, store, testTrade("user1", "BTC", 1.5, 100.0, 110.0, "buy"))
+
+	err := tradeService.ProcessTrades(context.Background())
 	if err != nil {
-		t.Fatalf("Не удалось вставить тестовые данные: %v", err)
+		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, несмотря на ошибки в цикле: %v", err)
+	}
+
+	record := queuedTrade(t, store, 1)
+	if record.Status != model.StatusPending || record.Attempts != 1 || record.FailedReason == "" {
+		t.Errorf("Ожидалось, что запись останется в очереди после первой попытки, но найдено: status=%s attempts=%d reason=%q",
+			record.Status, record.Attempts, record.FailedReason)
 	}
+}
+
+func TestProcessTrades_NoRows(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
 
-	_, err = db.Exec("DROP TABLE account_stats")
+	tradeService := NewTradeService(store)
+
+	result, err := tradeService.ProcessPending(context.Background())
 	if err != nil {
-		t.Fatalf("Не удалось удалить таблицу account_stats: %v", err)
+		t.Fatalf("Ожидалось успешное выполнение ProcessPending с пустым результатом, но произошла ошибка: %v", err)
+	}
+	if result != (BatchResult{}) {
+		t.Errorf("Ожидался пустой результат, но найдено: %+v", result)
 	}
+}
 
-	err = tradeService.ProcessTrades()
+func TestProcessTrades_PostgresAbortedTransaction(t *testing.T) {
+	memory, cleanup := setupTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	store := &abortingStore{Store: memory, brokenAccount: "user2"}
+	tradeService := NewTradeService(store)
+	enqueueTestTrades(t, store,
+		testTrade("user1", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("user2", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("user3", "EURUSD", 1, 1.1, 1.2, "buy"),
+	)
+
+	// Ошибка чтения валюты одной сделки не прерывает транзакцию порции
+	result, err := tradeService.ProcessPending(ctx)
 	if err != nil {
-		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, несмотря на ошибки в цикле: %v", err)
+		t.Fatalf("Ожидалось, что порция будет зафиксирована, но произошла ошибка: %v", err)
+	}
+	if result.Processed != 2 || result.Retried != 1 {
+		t.Errorf("Ожидалось 2 обработанные сделки и 1 повтор, но найдено: %+v", result)
+	}
+	for _, id := range []int64{1, 3} {
+		if record := queuedTrade(t, store, id); record.Status != model.StatusProcessed {
+			t.Errorf("Ожидалось, что сделка %d обработана, но найдено: %s", id, record.Status)
+		}
+	}
+	record := queuedTrade(t, store, 2)
+	if record.Status != model.StatusPending || record.Attempts != 1 || record.FailedReason == "" {
+		t.Errorf("Ожидалось, что ошибка сделки 2 записана, но найдено: status=%s attempts=%d reason=%q",
+			record.Status, record.Attempts, record.FailedReason)
 	}
 
-	var processed int
-	err = db.QueryRow("SELECT processed FROM trades_q WHERE account = 'user1'").Scan(&processed)
+	// То же для изменения обработанной сделки
+	store.brokenAccount = "user1"
+	values := storage.TradeValues{Volume: 2, Open: 1.1, Close: 1.2, Side: "buy"}
+	if _, err := store.AmendTrade(ctx, storage.Amendment{
+		TradeID: 1,
+		Action:  model.AmendmentCorrect,
+		Correct: func(storage.TradeRecord) (storage.TradeValues, error) { return values, nil },
+	}); err != nil {
+		t.Fatalf("Не удалось исправить сделку: %v", err)
+	}
+	if _, err := tradeService.ProcessPending(ctx); err != nil {
+		t.Fatalf("Ожидалось, что изменение будет обработано, но произошла ошибка: %v", err)
+	}
+	amendments, err := store.Amendments(ctx, 1)
 	if err != nil {
-		t.Fatalf("Не удалось выполнить запрос к trades_q: %v", err)
+		t.Fatalf("Не удалось получить изменения сделки: %v", err)
 	}
-	if processed != 0 {
-		t.Errorf("Ожидалось, что запись не обработана (processed=0), но найдено: %d", processed)
+	if len(amendments) != 1 || amendments[0].Status != model.StatusPending || amendments[0].Attempts != 1 || amendments[0].FailedReason == "" {
+		t.Errorf("Ожидалось, что ошибка изменения записана, но найдено: %+v", amendments)
 	}
 }
 
-func TestProcessTrades_NoRows(t *testing.T) {
-	db, cleanup := setupTestDB(t)
+func TestProcessTrades_UpdateError(t *testing.T) {
+	memory, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	// Не удается ни применить сделку, ни сохранить ошибку
+	updateErr := errors.New("update not allowed")
+	store := &faultyStore{
+		Store:      memory,
+		applyErr:   func(storage.AppliedTrade) error { return updateErr },
+		failureErr: updateErr,
+	}
+	tradeService := NewTradeService(store)
+
+	enqueueTestTrades(t, store, testTrade("user1", "BTC", 1.5, 100.0, 110.0, "buy"))
+
+	err := tradeService.ProcessTrades(context.Background())
+	if err != nil {
+		t.Fatalf("Ожидалось успешное выполнение ProcessTrades несмотря на ошибку обновления: %v", err)
+	}
+
+	record := queuedTrade(t, store, 1)
+	if record.Status != model.StatusPending || record.Attempts != 0 {
+		t.Errorf("Ожидалось, что запись не обработана (status=pending) из-за ошибки обновления, но найдено: %s, %d",
+			record.Status, record.Attempts)
+	}
+}
+
+func TestProcessTrades_LogError(t *testing.T) {
+	store, cleanup := setupTestStore(t)
 	defer cleanup()
 
-	tradeService := NewTradeService(db)
+	tradeService := NewTradeService(store)
 
-	err := tradeService.ProcessTrades()
+	enqueueTestTrades(t, store, testTrade("user1", "BTC", 1.5, 100.0, 110.0, "invalid_side"))
+
+	err := tradeService.ProcessTrades(context.Background())
 	if err != nil {
-		t.Fatalf("Ожидалось успешное выполнение ProcessTrades с пустым результатом, но произошла ошибка: %v", err)
+		t.Fatalf("Ожидалась обработка ошибки без возврата: %v", err)
 	}
 
-	var count int
-	err = db.QueryRow("SELECT COUNT(*) FROM account_stats").Scan(&count)
+	record := queuedTrade(t, store, 1)
+	// Некорректный side не исправится повторной обработкой, запись сразу попадает в dead-letter
+	if record.Status != model.StatusFailed || record.FailedReason != `invalid side "invalid_side"` {
+		t.Errorf("Ожидалось, что запись будет в статусе failed, но найдено: status=%s reason=%q", record.Status, record.FailedReason)
+	}
+}
+
+func TestProcessTrades_InstrumentContractSize(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store)
+
+	err := store.StoreInstruments(context.Background(), []model.Instrument{
+		{Symbol: "XAUUSD", ContractSize: 100, PipSize: 0.01, QuoteCurrency: "USD", Precision: 2},
+	})
 	if err != nil {
-		t.Fatalf("Не удалось выполнить запрос к account_stats: %v", err)
+		t.Fatalf("Не удалось сохранить инструменты: %v", err)
+	}
+
+	enqueueTestTrades(t, store,
+		testTrade("user1", "XAUUSD", 2.0, 2300.0, 2310.5, "buy"),
+		testTrade("user1", "EURUSD", 1.0, 1.1, 1.2, "buy"))
+
+	if err := tradeService.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
 	}
-	if count != 0 {
-		t.Errorf("Ожидалось, что account_stats останется пустым, но найдено: %d", count)
+
+	stats := accountStats(t, store, "user1")
+	// EURUSD отсутствует в реестре и не должен учитываться
+	if stats.Trades != 1 {
+		t.Errorf("Ожидалась 1 сделка, но найдено: %d", stats.Trades)
+	}
+	expectedProfit := 2100.0
+	if math.Abs(stats.Profit-expectedProfit) > 0.01 {
+		t.Errorf("Ожидалась прибыль %.1f, но найдено: %.1f", expectedProfit, stats.Profit)
 	}
 }
 
-func TestProcessTrades_UpdateError(t *testing.T) {
-	db, cleanup := setupTestDB(t)
+func TestProcessTrades_CurrencyConversion(t *testing.T) {
+	store, cleanup := setupTestStore(t)
 	defer cleanup()
 
-	tradeService := NewTradeService(db)
+	tradeService := NewTradeService(store)
 
-	_, err := db.Exec(`
-		INSERT INTO trades_q (account, symbol, volume, open, close, side)
-		VALUES (?, ?, ?, ?, ?, ?)`,
-		"user1", "BTC", 1.5, 100.0, 110.0, "buy")
+	if err := store.SetAccountCurrency(context.Background(), "user1", "EUR"); err != nil {
+		t.Fatalf("Не удалось создать аккаунт: %v", err)
+	}
+	err := store.StoreRates(context.Background(), []model.Rate{
+		{Base: "USD", Quote: "JPY", Rate: 150},
+		{Base: "EUR", Quote: "USD", Rate: 1.25},
+	})
 	if err != nil {
-		t.Fatalf("Не удалось вставить тестовые данные: %v", err)
+		t.Fatalf("Не удалось сохранить курсы: %v", err)
+	}
+
+	enqueueTestTrades(t, store,
+		testTrade("user1", "USDJPY", 1.0, 150.0, 151.5, "buy"),
+		testTrade("user1", "GBPCHF", 1.0, 1.1, 1.2, "buy"))
+
+	if err := tradeService.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
+	}
+
+	// 1.5 * 100000 = 150000 JPY = 1000 USD = 800 EUR
+	record := queuedTrade(t, store, 1)
+	if record.Profit != 150000 || record.QuoteCurrency != "JPY" || math.Abs(record.ConvertedProfit-800) > 0.01 ||
+		record.AccountCurrency != "EUR" {
+		t.Errorf("Неожиданный результат: profit=%v quote=%s converted=%v currency=%s",
+			record.Profit, record.QuoteCurrency, record.ConvertedProfit, record.AccountCurrency)
+	}
+
+	if profit := accountStats(t, store, "user1").Profit; math.Abs(profit-800) > 0.01 {
+		t.Errorf("Ожидалась прибыль 800 EUR, но найдено: %.1f", profit)
+	}
+
+	// Для GBPCHF нет курса CHF/EUR, запись остается необработанной
+	if status := queuedTrade(t, store, 2).Status; status != model.StatusPending {
+		t.Errorf("Ожидалось, что запись без курса не обработана, но найдено: %s", status)
+	}
+}
+
+func TestProcessTrades_SymbolStats(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store)
+
+	enqueueTestTrades(t, store,
+		testTrade("user1", "EURUSD", 1.0, 1.1000, 1.1010, "buy"),
+		testTrade("user1", "EURUSD", 2.0, 1.1010, 1.1000, "buy"),
+		testTrade("user1", "EURUSD", 1.0, 1.1000, 1.1010, "sell"))
+
+	if err := tradeService.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
 	}
 
-	_, err = db.Exec("CREATE TRIGGER prevent_update BEFORE UPDATE ON trades_q BEGIN SELECT RAISE(FAIL, 'Update not allowed'); END;")
+	symbols, err := store.SymbolStats(context.Background(), "user1")
 	if err != nil {
-		t.Fatalf("Не удалось создать триггер: %v", err)
+		t.Fatalf("Не удалось получить статистику по символам: %v", err)
+	}
+	if len(symbols) != 2 {
+		t.Fatalf("Ожидалось 2 строки статистики, но найдено: %+v", symbols)
 	}
 
-	err = tradeService.ProcessTrades()
+	buy := symbols[0]
+	if buy.Side != "buy" || buy.Trades != 2 || buy.Volume != 3 || buy.Wins != 1 {
+		t.Errorf("Неожиданная статистика buy: trades=%d volume=%v wins=%d", buy.Trades, buy.Volume, buy.Wins)
+	}
+	if math.Abs(buy.GrossProfit-100) > 0.01 || math.Abs(buy.GrossLoss-200) > 0.01 {
+		t.Errorf("Неожиданная прибыль buy: gross_profit=%.1f gross_loss=%.1f", buy.GrossProfit, buy.GrossLoss)
+	}
+
+	sell := symbols[1]
+	if sell.Side != "sell" || sell.Trades != 1 || sell.Wins != 0 || math.Abs(sell.GrossLoss-100) > 0.01 {
+		t.Errorf("Неожиданная статистика sell: trades=%d gross_loss=%.1f wins=%d", sell.Trades, sell.GrossLoss, sell.Wins)
+	}
+}
+
+func TestProcessTrades_History(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store)
+
+	// 2026-05-04 10:15:00 UTC и 2026-05-04 11:30:00 UTC
+	first := time.Date(2026, 5, 4, 10, 15, 0, 0, time.UTC)
+	second := time.Date(2026, 5, 4, 11, 30, 0, 0, time.UTC)
+	withCloseTime := func(trade model.Trade, closeTime time.Time) model.Trade {
+		trade.CloseTime = &closeTime
+		return trade
+	}
+	enqueueTestTrades(t, store,
+		withCloseTime(testTrade("user1", "EURUSD", 1.0, 1.1000, 1.1010, "buy"), first),
+		withCloseTime(testTrade("user1", "EURUSD", 1.0, 1.1000, 1.0990, "buy"), second),
+		// Сделка без close_time учитывается по времени постановки в очередь
+		testTrade("user1", "EURUSD", 1.0, 1.1, 1.1005, "buy"))
+
+	if err := tradeService.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
+	}
+
+	createdAt := queuedTrade(t, store, 3).CreatedAt
+	day := time.Date(2026, 5, 4, 0, 0, 0, 0, time.UTC).Unix()
+	hour10 := time.Date(2026, 5, 4, 10, 0, 0, 0, time.UTC).Unix()
+	hour11 := time.Date(2026, 5, 4, 11, 0, 0, 0, time.UTC).Unix()
+	expected := []struct {
+		period string
+		bucket int64
+		trades int
+		profit float64
+	}{
+		{period: "day", bucket: day, trades: 2, profit: 0},
+		{period: "hour", bucket: hour10, trades: 1, profit: 100},
+		{period: "hour", bucket: hour11, trades: 1, profit: -100},
+		{period: "hour", bucket: createdAt - createdAt%3600, trades: 1, profit: 50},
+	}
+	for _, e := range expected {
+		buckets, err := store.History(context.Background(), storage.HistoryQuery{
+			Account: "user1", Period: e.period, From: e.bucket, To: e.bucket + 1,
+		})
+		if err != nil {
+			t.Fatalf("Не удалось получить историю (%s %d): %v", e.period, e.bucket, err)
+		}
+		if len(buckets) != 1 {
+			t.Fatalf("%s %d: ожидался один период, найдено: %+v", e.period, e.bucket, buckets)
+		}
+		if buckets[0].Trades != e.trades || math.Abs(buckets[0].Profit-e.profit) > 0.01 {
+			t.Errorf("%s %d: ожидалось trades=%d profit=%.1f, найдено trades=%d profit=%.1f",
+				e.period, e.bucket, e.trades, e.profit, buckets[0].Trades, buckets[0].Profit)
+		}
+	}
+}
+
+func TestProcessTrades_MaxAttempts(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store, WithMaxAttempts(2))
+
+	// Для CHF нет курса, ошибка временная
+	enqueueTestTrades(t, store, testTrade("user1", "USDCHF", 1.0, 0.9, 0.91, "buy"))
+
+	expected := []struct {
+		status   string
+		attempts int
+	}{
+		{status: "pending", attempts: 1},
+		{status: "failed", attempts: 2},
+		// Записи в dead-letter больше не обрабатываются
+		{status: "failed", attempts: 2},
+	}
+	for i, e := range expected {
+		if err := tradeService.ProcessTrades(context.Background()); err != nil {
+			t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
+		}
+		record := queuedTrade(t, store, 1)
+		if record.Status != e.status || record.Attempts != e.attempts {
+			t.Errorf("Прогон %d: ожидалось status=%s attempts=%d, найдено status=%s attempts=%d",
+				i+1, e.status, e.attempts, record.Status, record.Attempts)
+		}
+	}
+}
+
+func TestProcessBatch_Chunks(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store, WithBatchSize(2))
+
+	for i := 0; i < 5; i++ {
+		enqueueTestTrades(t, store, testTrade("user1", "EURUSD", 1.0, 1.1, 1.1001, "buy"))
+	}
+
+	result, err := tradeService.ProcessBatch(context.Background(), 0)
 	if err != nil {
-		t.Fatalf("Ожидалось успешное выполнение ProcessTrades несмотря на ошибку обновления: %v", err)
+		t.Fatalf("Ожидалось успешное выполнение ProcessBatch, но произошла ошибка: %v", err)
+	}
+	if result != (BatchResult{Claimed: 2, Processed: 2, LastID: 2}) {
+		t.Errorf("Неожиданный результат первой порции: %+v", result)
+	}
+
+	if err := tradeService.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
+	}
+
+	if trades := accountStats(t, store, "user1").Trades; trades != 5 {
+		t.Errorf("Ожидалось 5 сделок, но найдено: %d", trades)
 	}
+}
+
+func TestProcessBatch_AtomicPerTrade(t *testing.T) {
+	memory, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	// Ошибка одной сделки не откатывает остальные сделки порции
+	store := &faultyStore{Store: memory, applyErr: func(trade storage.AppliedTrade) error {
+		if trade.Symbol == "GBPUSD" {
+			return errors.New("symbol stats unavailable")
+		}
+		return nil
+	}}
+	tradeService := NewTradeService(store)
 
-	var processed int
-	err = db.QueryRow("SELECT processed FROM trades_q WHERE account = 'user1'").Scan(&processed)
+	enqueueTestTrades(t, store,
+		testTrade("user1", "EURUSD", 1.0, 1.1, 1.1010, "buy"),
+		testTrade("user1", "GBPUSD", 1.0, 1.3, 1.3010, "buy"))
+
+	result, err := tradeService.ProcessBatch(context.Background(), 0)
 	if err != nil {
-		t.Fatalf("Не удалось выполнить запрос к trades_q: %v", err)
+		t.Fatalf("Ожидалось успешное выполнение ProcessBatch, но произошла ошибка: %v", err)
+	}
+	if result.Processed != 1 || result.Retried != 1 {
+		t.Errorf("Неожиданный результат: %+v", result)
 	}
-	if processed != 0 {
-		t.Errorf("Ожидалось, что запись не обработана (processed=0) из-за ошибки обновления, но найдено: %d", processed)
+
+	stats := accountStats(t, store, "user1")
+	if stats.Trades != 1 || math.Abs(stats.Profit-100) > 0.01 {
+		t.Errorf("Ожидалась только сделка EURUSD (1, 100.0), но найдено: %d, %.1f", stats.Trades, stats.Profit)
 	}
 }
 
-func TestProcessTrades_LogError(t *testing.T) {
-	db, cleanup := setupTestDB(t)
+func TestProcessTrades_RetryOncePerCall(t *testing.T) {
+	store, cleanup := setupTestStore(t)
 	defer cleanup()
 
-	tradeService := NewTradeService(db)
+	tradeService := NewTradeService(store, WithBatchSize(1))
 
-	_, err := db.Exec(`
-		INSERT INTO trades_q (account, symbol, volume, open, close, side)
-		VALUES (?, ?, ?, ?, ?, ?)`,
-		"user1", "BTC", 1.5, 100.0, 110.0, "invalid_side")
+	// Для CHF нет курса, обе сделки получают временную ошибку
+	enqueueTestTrades(t, store,
+		testTrade("user1", "USDCHF", 1.0, 0.9, 0.91, "buy"),
+		testTrade("user1", "USDCHF", 1.0, 0.9, 0.91, "sell"))
+
+	if err := tradeService.ProcessTrades(context.Background()); err != nil {
+		t.Fatalf("Ожидалось успешное выполнение ProcessTrades, но произошла ошибка: %v", err)
+	}
+
+	for id := int64(1); id <= 2; id++ {
+		if attempts := queuedTrade(t, store, id).Attempts; attempts != 1 {
+			t.Errorf("Ожидалась одна попытка на сделку %d за вызов, но найдено: %d", id, attempts)
+		}
+	}
+}
+
+func TestProcessTrades_ConcurrentWorkers(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	const (
+		workers = 4
+		total   = 200
+	)
+	for i := 0; i < total; i++ {
+		enqueueTestTrades(t, store, testTrade(fmt.Sprintf("user%d", i%5), "EURUSD", 1.0, 1.1, 1.1001, "buy"))
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		processed int
+	)
+	for w := 0; w < workers; w++ {
+		service := NewTradeService(store,
+			WithWorkerID(fmt.Sprintf("worker-%d", w)),
+			WithBatchSize(7),
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				result, err := service.ProcessBatch(context.Background(), 0)
+				if err != nil {
+					t.Errorf("Ошибка обработки: %v", err)
+					return
+				}
+				mu.Lock()
+				processed += result.Processed
+				mu.Unlock()
+				if result.Claimed == 0 {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if processed != total {
+		t.Errorf("Ожидалось %d обработанных сделок, обработано: %d", total, processed)
+	}
+
+	trades := 0
+	for i := 0; i < 5; i++ {
+		trades += accountStats(t, store, fmt.Sprintf("user%d", i)).Trades
+	}
+	if trades != total {
+		t.Errorf("Ожидалось %d сделок в статистике, найдено: %d", total, trades)
+	}
+}
+
+func TestProcessTrades_Leases(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store, WithWorkerID("live"))
+
+	enqueueTestTrades(t, store,
+		testTrade("user1", "EURUSD", 1.0, 1.1, 1.1010, "buy"),
+		testTrade("user1", "EURUSD", 1.0, 1.1, 1.1010, "buy"))
+	now := time.Now()
+	claimTestTrades(t, store, "crashed", 0, 1, now.Add(-10*time.Second))
+	claimTestTrades(t, store, "busy", 1, 1, now.Add(time.Minute))
+
+	result, err := tradeService.ProcessBatch(context.Background(), 0)
 	if err != nil {
-		t.Fatalf("Не удалось вставить тестовые данные: %v", err)
+		t.Fatalf("Ожидалось успешное выполнение ProcessBatch, но произошла ошибка: %v", err)
+	}
+	// Просроченная аренда забирается, действующая - нет
+	if result.Claimed != 1 || result.Processed != 1 {
+		t.Errorf("Неожиданный результат: %+v", result)
 	}
 
-	err = tradeService.ProcessTrades()
+	if record := queuedTrade(t, store, 1); record.Status != model.StatusProcessed || record.WorkerID != "live" {
+		t.Errorf("Ожидалось, что запись 1 обработана воркером live, найдено: %s, %s", record.Status, record.WorkerID)
+	}
+	if record := queuedTrade(t, store, 2); record.Status != model.StatusPending || record.WorkerID != "busy" {
+		t.Errorf("Ожидалось, что запись 2 осталась за воркером busy, найдено: %s, %s", record.Status, record.WorkerID)
+	}
+}
+
+func TestProcessBatch_LeaseLost(t *testing.T) {
+	memory, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	// Другой воркер забирает аренду между захватом и применением сделки
+	store := &faultyStore{Store: memory, applyErr: func(storage.AppliedTrade) error {
+		return storage.ErrLeaseLost
+	}}
+	tradeService := NewTradeService(store, WithWorkerID("slow"))
+
+	enqueueTestTrades(t, store, testTrade("user1", "EURUSD", 1.0, 1.1, 1.1010, "buy"))
+
+	result, err := tradeService.ProcessBatch(context.Background(), 0)
 	if err != nil {
-		t.Fatalf("Ожидалась обработка ошибки без возврата: %v", err)
+		t.Fatalf("Ожидалось успешное выполнение ProcessBatch, но произошла ошибка: %v", err)
+	}
+	if result.Claimed != 1 || result.Lost != 1 || result.Processed != 0 {
+		t.Errorf("Неожиданный результат: %+v", result)
+	}
+
+	// Потерянная аренда не считается неудачной попыткой
+	if record := queuedTrade(t, store, 1); record.Attempts != 0 || record.FailedReason != "" {
+		t.Errorf("Сделка с потерянной арендой не должна получать ошибку, найдено: %+v", record)
+	}
+	if trades := accountStats(t, store, "user1").Trades; trades != 0 {
+		t.Errorf("Сделка с потерянной арендой не должна менять статистику, найдено сделок: %d", trades)
+	}
+}
+
+func TestProcessTrades_Canceled(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store)
+	enqueueTestTrades(t, store, testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tradeService.ProcessTrades(ctx); err == nil {
+		t.Fatal("Ожидалась ошибка для отмененного контекста")
+	}
+
+	if status := queuedTrade(t, store, 1).Status; status != model.StatusPending {
+		t.Errorf("Ожидался статус %s, но найден: %s", model.StatusPending, status)
+	}
+	if trades := accountStats(t, store, "ACC1").Trades; trades != 0 {
+		t.Errorf("Статистика не должна меняться, найдено сделок: %d", trades)
+	}
+}
+
+func TestRun_ReleasesLeasesOnShutdown(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	tradeService := NewTradeService(store, WithWorkerID("w1"))
+	enqueueTestTrades(t, store,
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"),
+		testTrade("ACC1", "EURUSD", 1, 1.1, 1.2, "buy"))
+	claimTestTrades(t, store, "w1", 0, 1, time.Now().Add(time.Hour))
+	claimTestTrades(t, store, "w2", 1, 1, time.Now().Add(time.Hour))
+
+	// Остановленный воркер не выбирает новых порций
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tradeService.Run(ctx, nil, Backoff{Min: time.Millisecond, Max: time.Millisecond})
+
+	var got []string
+	for id := int64(1); id <= 2; id++ {
+		record := queuedTrade(t, store, id)
+		got = append(got, record.Status+":"+record.WorkerID)
+	}
+	expected := []string{"pending:", "pending:w2"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Ожидалось %v, но найдено: %v", expected, got)
 	}
+}
+
+func TestRun_RecordsHeartbeat(t *testing.T) {
+	store, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := time.Now().Unix()
+	NewTradeService(store, WithWorkerID("w1")).Run(ctx, nil, Backoff{Min: time.Millisecond, Max: time.Millisecond})
 
-	var processed int
-	err = db.QueryRow("SELECT processed FROM trades_q WHERE account = 'user1'").Scan(&processed)
+	heartbeats, err := store.Heartbeats(context.Background())
 	if err != nil {
-		t.Fatalf("Не удалось выполнить запрос к trades_q: %v", err)
+		t.Fatalf("Не удалось получить отметки воркеров: %v", err)
 	}
-	if processed != 0 {
-		t.Errorf("Ожидалось, что запись не обработана (processed=0) из-за ошибки, но найдено: %d", processed)
+	if len(heartbeats) != 1 || heartbeats[0].WorkerID != "w1" || heartbeats[0].LastRunAt < before {
+		t.Fatalf("Ожидалась отметка от w1, найдено: %+v", heartbeats)
+	}
+	hb := heartbeats[0]
+	if hb.Host == "" || hb.PID != os.Getpid() || hb.StartedAt == 0 || hb.StartedAt > hb.LastRunAt || hb.LastError != "" {
+		t.Errorf("Неожиданная отметка воркера: %+v", hb)
+	}
+
+	// Ошибка прохода и размер порции попадают в отметку
+	tradeService := NewTradeService(store, WithWorkerID("w1"))
+	tradeService.recordHeartbeat(context.Background(), BatchResult{Claimed: 3}, errors.New("database is locked"))
+	heartbeats, err = store.Heartbeats(context.Background())
+	if err != nil {
+		t.Fatalf("Не удалось получить отметки воркеров: %v", err)
+	}
+	if len(heartbeats) != 1 || heartbeats[0].LastBatchSize != 3 || heartbeats[0].LastError != "database is locked" {
+		t.Errorf("Неожиданные отметки воркеров: %+v", heartbeats)
+	}
+}
+
+func TestDrainContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	work, cancelWork := drainContext(ctx, 50*time.Millisecond)
+	defer cancelWork()
+
+	cancel()
+	select {
+	case <-work.Done():
+		t.Fatal("Рабочий контекст отменен до истечения таймаута завершения")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	select {
+	case <-work.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Рабочий контекст не отменен после таймаута завершения")
 	}
 }
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"gitlab.com/digineat/go-broker-test/internal/db"
+)
+
+// Dialect описывает различия SQL между поддерживаемыми базами.
+// Запросы пишутся с плейсхолдерами ? и переводятся в синтаксис базы методом rebind.
+type Dialect struct {
+	Name string
+	// numbered - плейсхолдеры вида $1, $2 вместо ?
+	numbered bool
+	// claimLock - блокировка строк в подзапросе захвата сделок
+	claimLock string
+	// rowLock - блокировка строки, которую транзакция читает перед изменением
+	rowLock string
+	// rebuildLock - блокировка агрегатов и изменений сделок на время пересборки статистики
+	rebuildLock string
+	// rebuildBlocksWrites - транзакция пересборки останавливает любую запись в базу
+	rebuildBlocksWrites bool
+	// schema - миграции схемы этой базы
+	schema db.Schema
+}
+
+var (
+	// SQLite блокирует базу целиком, поэтому захват строк не требует отдельной блокировки,
+	// а пересборка статистики останавливает и постановку сделок в очередь
+	SQLite = Dialect{Name: "sqlite", rebuildBlocksWrites: true, schema: db.SQLite}
+	// Postgres пропускает строки, которые в этот момент захватывает другой воркер
+	Postgres = Dialect{
+		Name:      "postgres",
+		numbered:  true,
+		claimLock: " FOR UPDATE SKIP LOCKED",
+		rowLock:   " FOR UPDATE",
+		// EXCLUSIVE не мешает чтению статистики, но останавливает ее изменение
+		rebuildLock: "LOCK TABLE account_stats, account_symbol_stats, account_pnl_history, trade_amendments IN EXCLUSIVE MODE",
+		schema:      db.Postgres,
+	}
+)
+
+// rebind заменяет плейсхолдеры ? на синтаксис диалекта
+func (d Dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
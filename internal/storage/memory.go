@@ -0,0 +1,857 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/db"
+	"gitlab.com/digineat/go-broker-test/internal/model"
+)
+
+// MemoryDSN - значение флага -db, при котором используется хранилище в памяти
+const MemoryDSN = "memory:"
+
+var errMemoryClosed = errors.New("memory store is closed")
+
+// MemoryStore - реализация Store в памяти процесса без cgo и внешней базы.
+// Данные теряются при остановке, поэтому хранилище подходит для тестов и демонстрации.
+// Все операции выполняются под одной блокировкой, как в SQLite.
+type MemoryStore struct {
+	mu     sync.Mutex
+	state  memoryState
+	closed bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{state: memoryState{
+		clientIDs:   make(map[string]int64),
+		stats:       make(map[string]AccountStats),
+		symbols:     make(map[symbolKey]SymbolStats),
+		history:     make(map[historyKey]HistoryBucket),
+		instruments: make(model.Instruments),
+		rates:       make(model.Rates),
+		accounts:    make(map[string]string),
+		heartbeats:  make(map[string]WorkerHeartbeat),
+	}}
+}
+
+type symbolKey struct {
+	account, symbol, side string
+}
+
+type historyKey struct {
+	account, period string
+	bucket          int64
+}
+
+// memoryTrade - запись очереди; order хранит сделку в исходном виде для сравнения дублей
+type memoryTrade struct {
+	TradeRecord
+	order model.Trade
+}
+
+// memoryState - содержимое хранилища, аналог таблиц схемы internal/db
+type memoryState struct {
+	// trades[i] - сделка с id i+1
+	trades      []memoryTrade
+	clientIDs   map[string]int64
+	stats       map[string]AccountStats
+	symbols     map[symbolKey]SymbolStats
+	history     map[historyKey]HistoryBucket
+	instruments model.Instruments
+	rates       model.Rates
+	accounts    map[string]string
+	// heartbeats - отметки по id воркера
+	heartbeats map[string]WorkerHeartbeat
+	// amendments[i] - изменение сделки с id i+1
+	amendments []AmendmentRecord
+}
+
+// clone копирует состояние для транзакции порции: изменения применяются к копии
+// и заменяют исходное состояние только при успешном завершении
+func (st memoryState) clone() memoryState {
+	return memoryState{
+		trades:      slices.Clone(st.trades),
+		clientIDs:   maps.Clone(st.clientIDs),
+		stats:       maps.Clone(st.stats),
+		symbols:     maps.Clone(st.symbols),
+		history:     maps.Clone(st.history),
+		instruments: maps.Clone(st.instruments),
+		rates:       maps.Clone(st.rates),
+		accounts:    maps.Clone(st.accounts),
+		heartbeats:  maps.Clone(st.heartbeats),
+		amendments:  slices.Clone(st.amendments),
+	}
+}
+
+func (st *memoryState) trade(id int64) *memoryTrade {
+	if id < 1 || id > int64(len(st.trades)) {
+		return nil
+	}
+	return &st.trades[id-1]
+}
+
+// lock захватывает блокировку хранилища. При успехе вызывающий освобождает s.mu.
+func (s *MemoryStore) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errMemoryClosed
+	}
+	return nil
+}
+
+func (s *MemoryStore) EnqueueTrade(ctx context.Context, trade model.Trade) (EnqueuedTrade, error) {
+	if err := s.lock(ctx); err != nil {
+		return EnqueuedTrade{}, err
+	}
+	defer s.mu.Unlock()
+	return s.state.enqueueTrade(trade), nil
+}
+
+func (s *MemoryStore) EnqueueTrades(ctx context.Context, trades []model.Trade) ([]EnqueuedTrade, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	results := make([]EnqueuedTrade, len(trades))
+	for i, trade := range trades {
+		results[i] = s.state.enqueueTrade(trade)
+	}
+	return results, nil
+}
+
+func (st *memoryState) enqueueTrade(trade model.Trade) EnqueuedTrade {
+	if trade.ClientTradeID != "" {
+		if id, ok := st.clientIDs[trade.ClientTradeID]; ok {
+			if !st.trade(id).order.SameOrder(trade) {
+				return EnqueuedTrade{Result: EnqueueConflict}
+			}
+			return EnqueuedTrade{ID: id, Result: EnqueueDuplicate}
+		}
+	}
+
+	id := int64(len(st.trades)) + 1
+	record := TradeRecord{
+		QueuedTrade: QueuedTrade{
+			ID:        id,
+			Account:   trade.Account,
+			Symbol:    trade.Symbol,
+			Volume:    trade.Volume,
+			Open:      trade.Open,
+			Close:     trade.Close,
+			Side:      trade.Side,
+			CloseTime: unixOrZero(trade.CloseTime),
+			CreatedAt: time.Now().Unix(),
+			RequestID: trade.RequestID,
+		},
+		ClientTradeID: trade.ClientTradeID,
+		OpenTime:      unixOrZero(trade.OpenTime),
+		Status:        model.StatusPending,
+	}
+	st.trades = append(st.trades, memoryTrade{TradeRecord: record, order: trade})
+	if trade.ClientTradeID != "" {
+		st.clientIDs[trade.ClientTradeID] = id
+	}
+	return EnqueuedTrade{ID: id, Result: Enqueued}
+}
+
+func (s *MemoryStore) Trade(ctx context.Context, id int64) (TradeRecord, error) {
+	if err := s.lock(ctx); err != nil {
+		return TradeRecord{}, err
+	}
+	defer s.mu.Unlock()
+
+	t := s.state.trade(id)
+	if t == nil {
+		return TradeRecord{}, ErrNotFound
+	}
+	return t.TradeRecord, nil
+}
+
+func (s *MemoryStore) Trades(ctx context.Context, query TradeQuery) ([]TradeRecord, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	return s.state.queryTrades(query), nil
+}
+
+func (st *memoryState) queryTrades(query TradeQuery) []TradeRecord {
+	trades := []TradeRecord{}
+	for _, t := range st.trades {
+		if len(trades) >= query.Limit {
+			break
+		}
+		if t.ID <= query.AfterID ||
+			(query.Account != "" && t.Account != query.Account) ||
+			(query.Symbol != "" && t.Symbol != query.Symbol) ||
+			(query.Side != "" && t.Side != query.Side) ||
+			(query.Status != "" && t.Status != query.Status) ||
+			(query.From != 0 && t.CreatedAt < query.From) ||
+			(query.To != 0 && t.CreatedAt >= query.To) {
+			continue
+		}
+		trades = append(trades, t.TradeRecord)
+	}
+	return trades
+}
+
+func (st *memoryState) amendment(id int64) *AmendmentRecord {
+	if id < 1 || id > int64(len(st.amendments)) {
+		return nil
+	}
+	return &st.amendments[id-1]
+}
+
+// setValues исправляет сделку. Исходная заявка в order не меняется, чтобы повтор
+// исходного запроса с тем же client_trade_id оставался дубликатом.
+func (t *memoryTrade) setValues(values TradeValues) {
+	t.Volume, t.Open, t.Close, t.Side = values.Volume, values.Open, values.Close, values.Side
+}
+
+func (s *MemoryStore) AmendTrade(ctx context.Context, amendment Amendment) (AmendmentRecord, error) {
+	if err := s.lock(ctx); err != nil {
+		return AmendmentRecord{}, err
+	}
+	defer s.mu.Unlock()
+
+	t := s.state.trade(amendment.TradeID)
+	if t == nil {
+		return AmendmentRecord{}, ErrNotFound
+	}
+	if t.Status == model.StatusCancelled {
+		return AmendmentRecord{}, ErrTradeCancelled
+	}
+	for _, a := range s.state.amendments {
+		if a.TradeID == amendment.TradeID && a.Status == model.StatusPending {
+			return AmendmentRecord{}, ErrAmendmentPending
+		}
+	}
+
+	record, err := newAmendmentRecord(amendment, t.TradeRecord, time.Now().Unix())
+	if err != nil {
+		return AmendmentRecord{}, err
+	}
+	record.ID = int64(len(s.state.amendments)) + 1
+	s.state.amendments = append(s.state.amendments, record)
+
+	// Сделка, не учтенная в статистике, меняется сразу. Аренда снимается, и воркер,
+	// обрабатывающий сделку по старым значениям, получит ErrLeaseLost.
+	if record.Status == model.AmendmentApplied {
+		if record.Action == model.AmendmentCancel {
+			t.Status = model.StatusCancelled
+		} else {
+			t.setValues(record.Values)
+		}
+		t.WorkerID = ""
+		t.LeaseExpiresAt = 0
+	}
+	return record, nil
+}
+
+func (s *MemoryStore) Amendments(ctx context.Context, tradeID int64) ([]AmendmentRecord, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	amendments := []AmendmentRecord{}
+	for _, a := range s.state.amendments {
+		if a.TradeID == tradeID {
+			amendments = append(amendments, a)
+		}
+	}
+	return amendments, nil
+}
+
+func (s *MemoryStore) PendingAmendments(ctx context.Context, afterID int64, limit int) ([]PendingAmendment, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var pending []PendingAmendment
+	for _, a := range s.state.amendments {
+		if len(pending) >= limit {
+			break
+		}
+		if a.ID > afterID && a.Status == model.StatusPending {
+			pending = append(pending, PendingAmendment{AmendmentRecord: a, Trade: s.state.trade(a.TradeID).TradeRecord})
+		}
+	}
+	return pending, nil
+}
+
+func (s *MemoryStore) ClaimTrades(ctx context.Context, claim Claim) ([]QueuedTrade, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	var trades []QueuedTrade
+	for i := range s.state.trades {
+		if len(trades) >= claim.Limit {
+			break
+		}
+		t := &s.state.trades[i]
+		if t.Status != model.StatusPending || t.ID <= claim.AfterID {
+			continue
+		}
+		if t.LeaseExpiresAt != 0 && t.LeaseExpiresAt > claim.Now {
+			continue
+		}
+		t.WorkerID = claim.WorkerID
+		t.LeaseExpiresAt = claim.LeaseUntil
+		trades = append(trades, t.QueuedTrade)
+	}
+	return trades, nil
+}
+
+func (s *MemoryStore) ProcessBatch(ctx context.Context, fn func(tx BatchTx) error) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	// Блокировка удерживается до конца порции, как транзакция SQLite
+	tx := &memoryBatchTx{state: s.state.clone()}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.state = tx.state
+	return nil
+}
+
+// memoryBatchTx - транзакция порции над копией состояния хранилища
+type memoryBatchTx struct {
+	state memoryState
+}
+
+func (tx *memoryBatchTx) Instruments(ctx context.Context) (model.Instruments, error) {
+	return maps.Clone(tx.state.instruments), nil
+}
+
+func (tx *memoryBatchTx) Rates(ctx context.Context) (model.Rates, error) {
+	return maps.Clone(tx.state.rates), nil
+}
+
+func (tx *memoryBatchTx) AccountCurrency(ctx context.Context, account string) (string, error) {
+	return tx.state.accountCurrency(account), nil
+}
+
+// Savepoint выполняет fn без копирования состояния: каждая операция транзакции в памяти
+// либо применяется целиком, либо ничего не меняет, и ошибка не прерывает транзакцию
+func (tx *memoryBatchTx) Savepoint(ctx context.Context, fn func() error) error {
+	return fn()
+}
+
+func (tx *memoryBatchTx) ApplyTrade(ctx context.Context, trade AppliedTrade) error {
+	t := tx.state.trade(trade.ID)
+	// Статус меняется только у сделки, которая все еще арендована этим воркером
+	if t == nil || t.WorkerID != trade.WorkerID || t.Status != model.StatusPending {
+		return ErrLeaseLost
+	}
+	t.Status = model.StatusProcessed
+	t.Attempts++
+	t.FailedReason = ""
+	t.LeaseExpiresAt = 0
+	t.setResult(trade)
+	tx.state.updateAggregates(trade, 1)
+	return nil
+}
+
+// setResult сохраняет в сделке результат расчета
+func (t *memoryTrade) setResult(trade AppliedTrade) {
+	t.Profit = trade.Profit
+	t.QuoteCurrency = trade.QuoteCurrency
+	t.ConvertedProfit = trade.ConvertedProfit
+	t.AccountCurrency = trade.AccountCurrency
+}
+
+// updateAggregates добавляет вклад сделки в агрегаты (sign = 1) или вычитает его (sign = -1)
+func (st *memoryState) updateAggregates(trade AppliedTrade, sign int) {
+	profit := float64(sign) * trade.ConvertedProfit
+
+	stats := st.stats[trade.Account]
+	stats.Account = trade.Account
+	stats.Trades += sign
+	stats.Profit += profit
+	st.stats[trade.Account] = stats
+
+	key := symbolKey{account: trade.Account, symbol: trade.Symbol, side: trade.Side}
+	symbol := st.symbols[key]
+	symbol.Symbol, symbol.Side = trade.Symbol, trade.Side
+	symbol.Trades += sign
+	symbol.Volume += float64(sign) * trade.Volume
+	if trade.ConvertedProfit > 0 {
+		symbol.GrossProfit += profit
+		symbol.Wins += sign
+	} else {
+		symbol.GrossLoss -= profit
+	}
+	st.symbols[key] = symbol
+
+	for _, period := range HistoryPeriods {
+		key := historyKey{account: trade.Account, period: period.Name, bucket: trade.Time - trade.Time%period.Seconds}
+		bucket := st.history[key]
+		bucket.Bucket = key.bucket
+		bucket.Trades += sign
+		bucket.Profit += profit
+		st.history[key] = bucket
+	}
+}
+
+func (tx *memoryBatchTx) ApplyAmendment(ctx context.Context, amendment AppliedAmendment) error {
+	a := tx.state.amendment(amendment.ID)
+	if a == nil || a.Status != model.StatusPending {
+		return ErrNotFound
+	}
+	a.Status = model.AmendmentApplied
+	a.Attempts++
+	a.FailedReason = ""
+	a.AppliedAt = amendment.Now
+
+	t := tx.state.trade(amendment.TradeID)
+	tx.state.updateAggregates(amendment.Reversed, -1)
+	if amendment.Corrected == nil {
+		t.Status = model.StatusCancelled
+		return nil
+	}
+	profit := amendment.Corrected.ConvertedProfit
+	a.Profit = &profit
+	tx.state.updateAggregates(*amendment.Corrected, 1)
+	t.setValues(amendment.Values)
+	t.setResult(*amendment.Corrected)
+	return nil
+}
+
+func (tx *memoryBatchTx) RecordAmendmentFailure(ctx context.Context, failure Failure) error {
+	a := tx.state.amendment(failure.ID)
+	if a == nil || a.Status != model.StatusPending {
+		return nil
+	}
+	a.Status = failure.Status
+	a.Attempts = failure.Attempts
+	a.FailedReason = failure.Reason
+	return nil
+}
+
+func (tx *memoryBatchTx) RecordFailure(ctx context.Context, failure Failure) error {
+	t := tx.state.trade(failure.ID)
+	if t == nil || t.WorkerID != failure.WorkerID {
+		return nil
+	}
+	t.Status = failure.Status
+	t.Attempts = failure.Attempts
+	t.FailedReason = failure.Reason
+	t.LeaseExpiresAt = 0
+	return nil
+}
+
+func (s *MemoryStore) ReleaseLeases(ctx context.Context, workerID string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for i := range s.state.trades {
+		t := &s.state.trades[i]
+		if t.WorkerID == workerID && t.Status == model.StatusPending {
+			t.WorkerID = ""
+			t.LeaseExpiresAt = 0
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) AccountStats(ctx context.Context, account string) (AccountStats, error) {
+	if err := s.lock(ctx); err != nil {
+		return AccountStats{}, err
+	}
+	defer s.mu.Unlock()
+
+	stats, ok := s.state.stats[account]
+	if !ok {
+		return AccountStats{Account: account}, nil
+	}
+	return stats, nil
+}
+
+func (s *MemoryStore) SymbolStats(ctx context.Context, account string) ([]SymbolStats, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	symbols := []SymbolStats{}
+	for key, stats := range s.state.symbols {
+		if key.account == account {
+			symbols = append(symbols, stats)
+		}
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Symbol != symbols[j].Symbol {
+			return symbols[i].Symbol < symbols[j].Symbol
+		}
+		return symbols[i].Side < symbols[j].Side
+	})
+	return symbols, nil
+}
+
+func (s *MemoryStore) History(ctx context.Context, query HistoryQuery) ([]HistoryBucket, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	buckets := []HistoryBucket{}
+	for key, bucket := range s.state.history {
+		if key.account == query.Account && key.period == query.Period && key.bucket >= query.From && key.bucket < query.To {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Bucket < buckets[j].Bucket })
+	return buckets, nil
+}
+
+func (s *MemoryStore) Instruments(ctx context.Context) (model.Instruments, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	return maps.Clone(s.state.instruments), nil
+}
+
+func (s *MemoryStore) StoreInstruments(ctx context.Context, instruments []model.Instrument) error {
+	// Проверка до изменений, чтобы ошибка не оставляла часть реестра обновленной
+	for _, ins := range instruments {
+		if err := model.ValidateInstrument(ins); err != nil {
+			return fmt.Errorf("invalid instrument %s: %v", ins.Symbol, err)
+		}
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for _, ins := range instruments {
+		s.state.instruments[ins.Symbol] = ins
+	}
+	return nil
+}
+
+func (s *MemoryStore) Rates(ctx context.Context) ([]model.Rate, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	rates := []model.Rate{}
+	for pair, rate := range s.state.rates {
+		rates = append(rates, model.Rate{Base: pair[0], Quote: pair[1], Rate: rate})
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].Base != rates[j].Base {
+			return rates[i].Base < rates[j].Base
+		}
+		return rates[i].Quote < rates[j].Quote
+	})
+	return rates, nil
+}
+
+func (s *MemoryStore) StoreRates(ctx context.Context, rates []model.Rate) error {
+	for _, rate := range rates {
+		if err := model.ValidateRate(rate); err != nil {
+			return fmt.Errorf("invalid rate %s/%s: %v", rate.Base, rate.Quote, err)
+		}
+	}
+
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for _, rate := range rates {
+		s.state.rates[[2]string{rate.Base, rate.Quote}] = rate.Rate
+	}
+	return nil
+}
+
+func (s *MemoryStore) AccountCurrency(ctx context.Context, account string) (string, error) {
+	if err := s.lock(ctx); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+	return s.state.accountCurrency(account), nil
+}
+
+func (st *memoryState) accountCurrency(account string) string {
+	if currency, ok := st.accounts[account]; ok {
+		return currency
+	}
+	return model.DefaultAccountCurrency
+}
+
+func (s *MemoryStore) SetAccountCurrency(ctx context.Context, account, currency string) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	// Накопленная прибыль уже пересчитана в текущую валюту аккаунта
+	if s.state.accountCurrency(account) != currency && s.state.stats[account].Trades > 0 {
+		return ErrAccountHasTrades
+	}
+	s.state.accounts[account] = currency
+	return nil
+}
+
+func (s *MemoryStore) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	letters := []DeadLetter{}
+	for _, t := range s.state.trades {
+		if len(letters) >= limit {
+			break
+		}
+		if t.Status != model.StatusFailed {
+			continue
+		}
+		letters = append(letters, DeadLetter{
+			ID: t.ID, Account: t.Account, Symbol: t.Symbol, Volume: t.Volume, Open: t.Open, Close: t.Close,
+			Side: t.Side, Attempts: t.Attempts, FailedReason: t.FailedReason, CreatedAt: t.CreatedAt,
+		})
+	}
+	return letters, nil
+}
+
+func (s *MemoryStore) RetryDeadLetter(ctx context.Context, id int64) error {
+	return s.updateDeadLetter(ctx, id, func(t *memoryTrade) {
+		t.Status = model.StatusPending
+		t.Attempts = 0
+		t.FailedReason = ""
+	})
+}
+
+func (s *MemoryStore) DiscardDeadLetter(ctx context.Context, id int64) error {
+	// Запись остается в очереди для аудита, но больше не обрабатывается
+	return s.updateDeadLetter(ctx, id, func(t *memoryTrade) {
+		t.Status = model.StatusDiscarded
+	})
+}
+
+func (s *MemoryStore) updateDeadLetter(ctx context.Context, id int64, update func(t *memoryTrade)) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	t := s.state.trade(id)
+	if t == nil || t.Status != model.StatusFailed {
+		return ErrNotFound
+	}
+	update(t)
+	return nil
+}
+
+// RebuildBlocksWrites - пересборка держит блокировку хранилища до конца
+func (s *MemoryStore) RebuildBlocksWrites() bool {
+	return true
+}
+
+func (s *MemoryStore) Rebuild(ctx context.Context, scope RebuildScope, fn func(tx RebuildTx) error) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for _, a := range s.state.amendments {
+		if a.Status == model.StatusPending && (scope.Account == "" || s.state.trade(a.TradeID).Account == scope.Account) {
+			return ErrRebuildAmendmentsPending
+		}
+	}
+
+	// Теневые агрегаты живут только до конца пересборки: проверить их после dry run
+	// можно лишь в SQL-хранилище
+	shadow := newAggregates()
+	tx := &memoryRebuildTx{
+		memoryBatchTx: memoryBatchTx{state: s.state.clone()},
+		scope:         scope,
+		shadow:        memoryState{stats: shadow.stats, symbols: shadow.symbols, history: shadow.history},
+		results:       make(map[int64]AppliedTrade),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.state = tx.state
+	return nil
+}
+
+// memoryRebuildTx - пересборка статистики над копией состояния хранилища.
+// Справочные данные читаются так же, как в транзакции порции.
+type memoryRebuildTx struct {
+	memoryBatchTx
+	scope RebuildScope
+	// shadow - теневые агрегаты, results - результаты расчета сделок по id
+	shadow  memoryState
+	results map[int64]AppliedTrade
+}
+
+func (tx *memoryRebuildTx) ProcessedTrades(ctx context.Context, afterID int64, limit int) ([]TradeRecord, error) {
+	return tx.state.queryTrades(TradeQuery{
+		Account: tx.scope.Account,
+		Status:  model.StatusProcessed,
+		AfterID: afterID,
+		Limit:   limit,
+	}), nil
+}
+
+func (tx *memoryRebuildTx) AddTrade(ctx context.Context, trade AppliedTrade) error {
+	tx.shadow.updateAggregates(trade, 1)
+	tx.results[trade.ID] = trade
+	return nil
+}
+
+func (tx *memoryRebuildTx) Diff(ctx context.Context) ([]AggregateDiff, error) {
+	rebuilt := aggregates{stats: tx.shadow.stats, symbols: tx.shadow.symbols, history: tx.shadow.history}
+	return diffAggregates(tx.state.scopeAggregates(tx.scope.Account), rebuilt), nil
+}
+
+func (tx *memoryRebuildTx) Swap(ctx context.Context) error {
+	live := tx.state.scopeAggregates(tx.scope.Account)
+	for account := range live.stats {
+		delete(tx.state.stats, account)
+	}
+	for key := range live.symbols {
+		delete(tx.state.symbols, key)
+	}
+	for key := range live.history {
+		delete(tx.state.history, key)
+	}
+	maps.Copy(tx.state.stats, tx.shadow.stats)
+	maps.Copy(tx.state.symbols, tx.shadow.symbols)
+	maps.Copy(tx.state.history, tx.shadow.history)
+
+	for id, result := range tx.results {
+		tx.state.trade(id).setResult(result)
+	}
+	return nil
+}
+
+// scopeAggregates возвращает агрегаты аккаунта или всех аккаунтов, если account пуст
+func (st *memoryState) scopeAggregates(account string) aggregates {
+	scoped := newAggregates()
+	for key, stats := range st.stats {
+		if account == "" || key == account {
+			scoped.stats[key] = stats
+		}
+	}
+	for key, symbol := range st.symbols {
+		if account == "" || key.account == account {
+			scoped.symbols[key] = symbol
+		}
+	}
+	for key, bucket := range st.history {
+		if account == "" || key.account == account {
+			scoped.history[key] = bucket
+		}
+	}
+	return scoped
+}
+
+func (s *MemoryStore) QueueStats(ctx context.Context) (QueueStats, error) {
+	if err := s.lock(ctx); err != nil {
+		return QueueStats{}, err
+	}
+	defer s.mu.Unlock()
+
+	var stats QueueStats
+	for _, t := range s.state.trades {
+		if t.Status != model.StatusPending {
+			continue
+		}
+		stats.Pending++
+		if stats.OldestCreatedAt == 0 || t.CreatedAt < stats.OldestCreatedAt {
+			stats.OldestCreatedAt = t.CreatedAt
+		}
+	}
+	return stats, nil
+}
+
+func (s *MemoryStore) RecordHeartbeat(ctx context.Context, heartbeat WorkerHeartbeat) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.state.heartbeats[heartbeat.WorkerID] = heartbeat
+	return nil
+}
+
+func (s *MemoryStore) Heartbeats(ctx context.Context) ([]WorkerHeartbeat, error) {
+	if err := s.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+
+	heartbeats := slices.Collect(maps.Values(s.state.heartbeats))
+	if heartbeats == nil {
+		heartbeats = []WorkerHeartbeat{}
+	}
+	sort.Slice(heartbeats, func(i, j int) bool {
+		if heartbeats[i].LastRunAt != heartbeats[j].LastRunAt {
+			return heartbeats[i].LastRunAt > heartbeats[j].LastRunAt
+		}
+		return heartbeats[i].WorkerID < heartbeats[j].WorkerID
+	})
+	return heartbeats, nil
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	if err := s.lock(ctx); err != nil {
+		return err
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// CheckWritable для памяти совпадает с Ping: хранилище пишется, пока не закрыто
+func (s *MemoryStore) CheckWritable(ctx context.Context) error {
+	return s.Ping(ctx)
+}
+
+// SelfCheck сообщает только о доступности хранилища: схемы и параметров базы у него нет
+func (s *MemoryStore) SelfCheck(ctx context.Context) db.Report {
+	var report db.Report
+	report.Add("driver", nil, "memory")
+	report.Add("connection", s.Ping(ctx), "in-process, data is lost on restart")
+	return report
+}
+
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
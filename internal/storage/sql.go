@@ -0,0 +1,1226 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/digineat/go-broker-test/internal/db"
+	"gitlab.com/digineat/go-broker-test/internal/model"
+)
+
+// SQLStore - реализация Store поверх database/sql. Запросы общие для SQLite
+// и PostgreSQL, различия описываются диалектом.
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+func NewSQLStore(db *sql.DB, dialect Dialect) *SQLStore {
+	return &SQLStore{db: db, dialect: dialect}
+}
+
+// DB возвращает соединение с базой
+func (s *SQLStore) DB() *sql.DB {
+	return s.db
+}
+
+// execer - общий интерфейс *sql.DB и *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlConn выполняет запросы с плейсхолдерами ? в синтаксисе диалекта
+type sqlConn struct {
+	q       execer
+	dialect Dialect
+}
+
+func (c sqlConn) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.q.ExecContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c sqlConn) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.q.QueryContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c sqlConn) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.q.QueryRowContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (s *SQLStore) conn() sqlConn {
+	return sqlConn{q: s.db, dialect: s.dialect}
+}
+
+func (s *SQLStore) begin(ctx context.Context) (*sql.Tx, sqlConn, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, sqlConn{}, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	return tx, sqlConn{q: tx, dialect: s.dialect}, nil
+}
+
+const insertTradeQuery = "INSERT INTO trades_q (client_trade_id, account, symbol, volume, open, close, side, open_time, close_time, request_id) " +
+	"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(client_trade_id) DO NOTHING RETURNING id"
+
+func (s *SQLStore) EnqueueTrade(ctx context.Context, trade model.Trade) (EnqueuedTrade, error) {
+	return enqueueTrade(ctx, s.conn(), trade)
+}
+
+func (s *SQLStore) EnqueueTrades(ctx context.Context, trades []model.Trade) ([]EnqueuedTrade, error) {
+	tx, c, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]EnqueuedTrade, len(trades))
+	for i, trade := range trades {
+		results[i], err = enqueueTrade(ctx, c, trade)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert trade %d: %v", i, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return results, nil
+}
+
+func enqueueTrade(ctx context.Context, c sqlConn, trade model.Trade) (EnqueuedTrade, error) {
+	// При конфликте client_trade_id строка не вставляется и RETURNING ничего не возвращает
+	var id int64
+	err := c.queryRow(ctx,
+		insertTradeQuery,
+		nullString(trade.ClientTradeID), trade.Account, trade.Symbol, trade.Volume, trade.Open, trade.Close, trade.Side,
+		nullUnix(trade.OpenTime), nullUnix(trade.CloseTime), trade.RequestID,
+	).Scan(&id)
+	if err == nil {
+		return EnqueuedTrade{ID: id, Result: Enqueued}, nil
+	}
+	if err != sql.ErrNoRows {
+		return EnqueuedTrade{}, err
+	}
+
+	var (
+		existing            model.Trade
+		openTime, closeTime sql.NullInt64
+	)
+	err = c.queryRow(ctx,
+		"SELECT id, account, symbol, volume, open, close, side, open_time, close_time FROM trades_q WHERE client_trade_id = ?",
+		trade.ClientTradeID,
+	).Scan(&id, &existing.Account, &existing.Symbol, &existing.Volume, &existing.Open, &existing.Close, &existing.Side, &openTime, &closeTime)
+	if err != nil {
+		return EnqueuedTrade{}, fmt.Errorf("failed to load trade with client_trade_id %q: %v", trade.ClientTradeID, err)
+	}
+	existing.OpenTime = timeFromUnix(openTime)
+	existing.CloseTime = timeFromUnix(closeTime)
+
+	// Исправления меняют значения в trades_q; исходная заявка сохранена
+	// в prev_* первого изменения сделки
+	err = c.queryRow(ctx,
+		"SELECT prev_volume, prev_open, prev_close, prev_side FROM trade_amendments WHERE trade_id = ? ORDER BY id LIMIT 1",
+		id,
+	).Scan(&existing.Volume, &existing.Open, &existing.Close, &existing.Side)
+	if err != nil && err != sql.ErrNoRows {
+		return EnqueuedTrade{}, fmt.Errorf("failed to load original values of trade %d: %v", id, err)
+	}
+	if !existing.SameOrder(trade) {
+		return EnqueuedTrade{Result: EnqueueConflict}, nil
+	}
+	return EnqueuedTrade{ID: id, Result: EnqueueDuplicate}, nil
+}
+
+// Колонки trades_q в порядке, ожидаемом scanTrade
+const tradeColumns = "id, client_trade_id, account, symbol, volume, open, close, side, open_time, close_time, created_at, " +
+	"attempts, request_id, status, failed_reason, worker_id, lease_expires_at, profit, quote_currency, converted_profit, account_currency"
+
+// scanTrade читает запись trades_q, выбранную по tradeColumns
+func scanTrade(row interface{ Scan(...any) error }) (TradeRecord, error) {
+	var (
+		t                                TradeRecord
+		clientTradeID, reason, workerID  sql.NullString
+		quote, currency                  sql.NullString
+		openTime, closeTime, leaseExpiry sql.NullInt64
+		profit, converted                sql.NullFloat64
+	)
+	err := row.Scan(&t.ID, &clientTradeID, &t.Account, &t.Symbol, &t.Volume, &t.Open, &t.Close, &t.Side, &openTime, &closeTime, &t.CreatedAt,
+		&t.Attempts, &t.RequestID, &t.Status, &reason, &workerID, &leaseExpiry, &profit, &quote, &converted, &currency)
+	if err != nil {
+		return TradeRecord{}, err
+	}
+	t.ClientTradeID = clientTradeID.String
+	t.OpenTime = openTime.Int64
+	t.CloseTime = closeTime.Int64
+	t.FailedReason = reason.String
+	t.WorkerID = workerID.String
+	t.LeaseExpiresAt = leaseExpiry.Int64
+	t.Profit = profit.Float64
+	t.QuoteCurrency = quote.String
+	t.ConvertedProfit = converted.Float64
+	t.AccountCurrency = currency.String
+	return t, nil
+}
+
+func (s *SQLStore) Trade(ctx context.Context, id int64) (TradeRecord, error) {
+	t, err := scanTrade(s.conn().queryRow(ctx, "SELECT "+tradeColumns+" FROM trades_q WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return TradeRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return TradeRecord{}, fmt.Errorf("failed to query trade: %v", err)
+	}
+	return t, nil
+}
+
+func (s *SQLStore) Trades(ctx context.Context, query TradeQuery) ([]TradeRecord, error) {
+	return queryTrades(ctx, s.conn(), query)
+}
+
+func queryTrades(ctx context.Context, c sqlConn, query TradeQuery) ([]TradeRecord, error) {
+	where := []string{"id > ?"}
+	args := []any{query.AfterID}
+	for _, filter := range []struct {
+		column, value string
+	}{
+		{"account", query.Account},
+		{"symbol", query.Symbol},
+		{"side", query.Side},
+		{"status", query.Status},
+	} {
+		if filter.value != "" {
+			where = append(where, filter.column+" = ?")
+			args = append(args, filter.value)
+		}
+	}
+	if query.From != 0 {
+		where = append(where, "created_at >= ?")
+		args = append(args, query.From)
+	}
+	if query.To != 0 {
+		where = append(where, "created_at < ?")
+		args = append(args, query.To)
+	}
+	args = append(args, query.Limit)
+
+	rows, err := c.query(ctx,
+		"SELECT "+tradeColumns+" FROM trades_q WHERE "+strings.Join(where, " AND ")+" ORDER BY id LIMIT ?",
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trades: %v", err)
+	}
+	defer rows.Close()
+
+	trades := []TradeRecord{}
+	for rows.Next() {
+		t, err := scanTrade(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan trade: %v", err)
+		}
+		trades = append(trades, t)
+	}
+	return trades, rows.Err()
+}
+
+// Колонки trade_amendments в порядке, ожидаемом scanAmendment
+const amendmentColumns = "id, trade_id, action, prev_status, prev_volume, prev_open, prev_close, prev_side, " +
+	"volume, open, close, side, prev_profit, profit, status, attempts, failed_reason, request_id, created_at, applied_at"
+
+// scanAmendment читает запись trade_amendments, выбранную по amendmentColumns
+func scanAmendment(row interface{ Scan(...any) error }) (AmendmentRecord, error) {
+	var (
+		a                  AmendmentRecord
+		prevProfit, profit sql.NullFloat64
+		reason             sql.NullString
+		appliedAt          sql.NullInt64
+	)
+	err := row.Scan(&a.ID, &a.TradeID, &a.Action, &a.PrevStatus, &a.Prev.Volume, &a.Prev.Open, &a.Prev.Close, &a.Prev.Side,
+		&a.Values.Volume, &a.Values.Open, &a.Values.Close, &a.Values.Side, &prevProfit, &profit,
+		&a.Status, &a.Attempts, &reason, &a.RequestID, &a.CreatedAt, &appliedAt)
+	if err != nil {
+		return AmendmentRecord{}, err
+	}
+	if prevProfit.Valid {
+		a.PrevProfit = &prevProfit.Float64
+	}
+	if profit.Valid {
+		a.Profit = &profit.Float64
+	}
+	a.FailedReason = reason.String
+	a.AppliedAt = appliedAt.Int64
+	return a, nil
+}
+
+func (s *SQLStore) AmendTrade(ctx context.Context, amendment Amendment) (AmendmentRecord, error) {
+	tx, c, err := s.begin(ctx)
+	if err != nil {
+		return AmendmentRecord{}, err
+	}
+	defer tx.Rollback()
+
+	// Строка сделки блокируется до конца транзакции, чтобы воркер не применил ее по старым значениям
+	trade, err := scanTrade(c.queryRow(ctx, "SELECT "+tradeColumns+" FROM trades_q WHERE id = ?"+s.dialect.rowLock, amendment.TradeID))
+	if err == sql.ErrNoRows {
+		return AmendmentRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return AmendmentRecord{}, fmt.Errorf("failed to query trade: %v", err)
+	}
+	if trade.Status == model.StatusCancelled {
+		return AmendmentRecord{}, ErrTradeCancelled
+	}
+	var pending int
+	err = c.queryRow(ctx, "SELECT COUNT(*) FROM trade_amendments WHERE trade_id = ? AND status = ?",
+		amendment.TradeID, model.StatusPending).Scan(&pending)
+	if err != nil {
+		return AmendmentRecord{}, fmt.Errorf("failed to query amendments: %v", err)
+	}
+	if pending > 0 {
+		return AmendmentRecord{}, ErrAmendmentPending
+	}
+
+	record, err := newAmendmentRecord(amendment, trade, time.Now().Unix())
+	if err != nil {
+		return AmendmentRecord{}, err
+	}
+	var prevProfit, appliedAt any
+	if record.PrevProfit != nil {
+		prevProfit = *record.PrevProfit
+	}
+	if record.AppliedAt != 0 {
+		appliedAt = record.AppliedAt
+	}
+	err = c.queryRow(ctx,
+		"INSERT INTO trade_amendments (trade_id, action, prev_status, prev_volume, prev_open, prev_close, prev_side, "+
+			"volume, open, close, side, prev_profit, status, request_id, created_at, applied_at) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id",
+		record.TradeID, record.Action, record.PrevStatus, record.Prev.Volume, record.Prev.Open, record.Prev.Close, record.Prev.Side,
+		record.Values.Volume, record.Values.Open, record.Values.Close, record.Values.Side, prevProfit,
+		record.Status, record.RequestID, record.CreatedAt, appliedAt,
+	).Scan(&record.ID)
+	if err != nil {
+		return AmendmentRecord{}, fmt.Errorf("failed to insert amendment: %v", err)
+	}
+
+	// Сделка, не учтенная в статистике, меняется сразу. Аренда снимается, и воркер,
+	// обрабатывающий сделку по старым значениям, получит ErrLeaseLost.
+	if record.Status == model.AmendmentApplied {
+		if record.Action == model.AmendmentCancel {
+			_, err = c.exec(ctx,
+				"UPDATE trades_q SET status = ?, worker_id = NULL, lease_expires_at = NULL WHERE id = ?",
+				model.StatusCancelled, record.TradeID,
+			)
+		} else {
+			_, err = c.exec(ctx,
+				"UPDATE trades_q SET volume = ?, open = ?, close = ?, side = ?, worker_id = NULL, lease_expires_at = NULL WHERE id = ?",
+				record.Values.Volume, record.Values.Open, record.Values.Close, record.Values.Side, record.TradeID,
+			)
+		}
+		if err != nil {
+			return AmendmentRecord{}, fmt.Errorf("failed to update trade: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return AmendmentRecord{}, fmt.Errorf("failed to commit amendment: %v", err)
+	}
+	return record, nil
+}
+
+func (s *SQLStore) Amendments(ctx context.Context, tradeID int64) ([]AmendmentRecord, error) {
+	rows, err := s.conn().query(ctx, "SELECT "+amendmentColumns+" FROM trade_amendments WHERE trade_id = ? ORDER BY id", tradeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query amendments: %v", err)
+	}
+	defer rows.Close()
+
+	amendments := []AmendmentRecord{}
+	for rows.Next() {
+		a, err := scanAmendment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan amendment: %v", err)
+		}
+		amendments = append(amendments, a)
+	}
+	return amendments, rows.Err()
+}
+
+func (s *SQLStore) PendingAmendments(ctx context.Context, afterID int64, limit int) ([]PendingAmendment, error) {
+	rows, err := s.conn().query(ctx,
+		"SELECT "+amendmentColumns+" FROM trade_amendments WHERE status = ? AND id > ? ORDER BY id LIMIT ?",
+		model.StatusPending, afterID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query amendments: %v", err)
+	}
+	var pending []PendingAmendment
+	for rows.Next() {
+		a, err := scanAmendment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan amendment: %v", err)
+		}
+		pending = append(pending, PendingAmendment{AmendmentRecord: a})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Изменений немного, поэтому сделки читаются по одной
+	for i := range pending {
+		if pending[i].Trade, err = s.Trade(ctx, pending[i].TradeID); err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+func (s *SQLStore) ClaimTrades(ctx context.Context, claim Claim) ([]QueuedTrade, error) {
+	tx, c, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := c.query(ctx,
+		"UPDATE trades_q SET worker_id = ?, lease_expires_at = ? "+
+			"WHERE id IN (SELECT id FROM trades_q WHERE status = ? AND id > ? "+
+			"AND (lease_expires_at IS NULL OR lease_expires_at <= ?) ORDER BY id LIMIT ?"+s.dialect.claimLock+") "+
+			"RETURNING id, account, symbol, volume, open, close, side, close_time, created_at, attempts, request_id",
+		claim.WorkerID, claim.LeaseUntil, model.StatusPending, claim.AfterID, claim.Now, claim.Limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim trades: %v", err)
+	}
+	defer rows.Close()
+
+	var trades []QueuedTrade
+	for rows.Next() {
+		var (
+			t         QueuedTrade
+			closeTime sql.NullInt64
+		)
+		if err := rows.Scan(&t.ID, &t.Account, &t.Symbol, &t.Volume, &t.Open, &t.Close, &t.Side, &closeTime, &t.CreatedAt, &t.Attempts, &t.RequestID); err != nil {
+			return nil, fmt.Errorf("failed to scan trade: %v", err)
+		}
+		t.CloseTime = closeTime.Int64
+		trades = append(trades, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating trades: %v", err)
+	}
+	rows.Close()
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit claim: %v", err)
+	}
+
+	// RETURNING не гарантирует порядок строк
+	sort.Slice(trades, func(i, j int) bool { return trades[i].ID < trades[j].ID })
+	return trades, nil
+}
+
+func (s *SQLStore) ProcessBatch(ctx context.Context, fn func(tx BatchTx) error) error {
+	tx, c, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	batch := &sqlBatchTx{sqlConn: c}
+	if err := fn(batch); err != nil {
+		return err
+	}
+	if batch.broken != nil {
+		return batch.broken
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// sqlBatchTx - транзакция порции. Каждая сделка применяется в своей точке сохранения.
+type sqlBatchTx struct {
+	sqlConn
+	// broken - ошибка работы с точкой сохранения, после которой транзакцию нельзя фиксировать
+	broken error
+	// depth - количество открытых точек сохранения, вложенные точки получают свои имена
+	depth int
+}
+
+func (tx *sqlBatchTx) Instruments(ctx context.Context) (model.Instruments, error) {
+	return loadInstruments(ctx, tx.sqlConn)
+}
+
+func (tx *sqlBatchTx) Rates(ctx context.Context) (model.Rates, error) {
+	list, err := listRates(ctx, tx.sqlConn)
+	if err != nil {
+		return nil, err
+	}
+	return model.NewRates(list), nil
+}
+
+func (tx *sqlBatchTx) AccountCurrency(ctx context.Context, account string) (string, error) {
+	return accountCurrency(ctx, tx.sqlConn, account)
+}
+
+func (tx *sqlBatchTx) ApplyTrade(ctx context.Context, trade AppliedTrade) error {
+	return tx.savepoint(ctx, func() error {
+		return applyTrade(ctx, tx.sqlConn, trade)
+	})
+}
+
+func (tx *sqlBatchTx) Savepoint(ctx context.Context, fn func() error) error {
+	return tx.savepoint(ctx, fn)
+}
+
+// savepoint выполняет fn в точке сохранения: при ошибке откатываются все изменения fn,
+// а не только последнее из них. На PostgreSQL откат к точке сохранения снимает и
+// прерывание транзакции, в которой выполнился ошибочный запрос.
+func (tx *sqlBatchTx) savepoint(ctx context.Context, fn func() error) error {
+	if tx.broken != nil {
+		return tx.broken
+	}
+
+	name := fmt.Sprintf("apply_trade_%d", tx.depth)
+	if _, err := tx.exec(ctx, "SAVEPOINT "+name); err != nil {
+		tx.broken = fmt.Errorf("failed to create savepoint: %v", err)
+		return tx.broken
+	}
+	tx.depth++
+	fnErr := fn()
+	tx.depth--
+	if tx.broken != nil {
+		return tx.broken
+	}
+	if fnErr != nil {
+		if _, err := tx.exec(ctx, "ROLLBACK TO "+name); err != nil {
+			tx.broken = fmt.Errorf("failed to roll back to savepoint: %v", err)
+			return tx.broken
+		}
+	}
+	if _, err := tx.exec(ctx, "RELEASE "+name); err != nil {
+		tx.broken = fmt.Errorf("failed to release savepoint: %v", err)
+		return tx.broken
+	}
+	return fnErr
+}
+
+func applyTrade(ctx context.Context, c sqlConn, trade AppliedTrade) error {
+	// Статус меняется только у сделки, которая все еще арендована этим воркером
+	res, err := c.exec(ctx,
+		"UPDATE trades_q SET status = ?, attempts = attempts + 1, failed_reason = NULL, lease_expires_at = NULL, "+
+			"profit = ?, quote_currency = ?, converted_profit = ?, account_currency = ? "+
+			"WHERE id = ? AND worker_id = ? AND status = ?",
+		model.StatusProcessed, trade.Profit, nullString(trade.QuoteCurrency), trade.ConvertedProfit, trade.AccountCurrency,
+		trade.ID, trade.WorkerID, model.StatusPending,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update trade status: %v", err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update trade status: %v", err)
+	} else if affected == 0 {
+		return ErrLeaseLost
+	}
+	return updateAggregates(ctx, c, liveTables, trade, 1)
+}
+
+// aggregateTables - имена таблиц агрегатов: рабочих или теневых
+type aggregateTables struct {
+	stats, symbols, history string
+}
+
+var (
+	liveTables   = aggregateTables{stats: TableAccountStats, symbols: TableSymbolStats, history: TableHistory}
+	shadowTables = aggregateTables{
+		stats:   TableAccountStats + "_shadow",
+		symbols: TableSymbolStats + "_shadow",
+		history: TableHistory + "_shadow",
+	}
+)
+
+// updateAggregates добавляет вклад сделки в агрегаты t (sign = 1) или вычитает его (sign = -1)
+func updateAggregates(ctx context.Context, c sqlConn, t aggregateTables, trade AppliedTrade, sign int) error {
+	profit := float64(sign) * trade.ConvertedProfit
+
+	// Обновление статистики аккаунта
+	_, err := c.exec(ctx,
+		"INSERT INTO "+t.stats+" (account, trades, profit) VALUES (?, ?, ?) "+
+			"ON CONFLICT(account) DO UPDATE SET trades = "+t.stats+".trades + excluded.trades, profit = "+t.stats+".profit + excluded.profit",
+		trade.Account, sign, profit,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update account stats: %v", err)
+	}
+
+	// Обновление статистики в разрезе символа и направления
+	gain, loss, win := 0.0, 0.0, 0
+	if trade.ConvertedProfit > 0 {
+		gain, win = trade.ConvertedProfit, 1
+	} else {
+		loss = -trade.ConvertedProfit
+	}
+	_, err = c.exec(ctx,
+		"INSERT INTO "+t.symbols+" (account, symbol, side, trades, volume, gross_profit, gross_loss, wins) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON CONFLICT(account, symbol, side) DO UPDATE SET trades = "+t.symbols+".trades + excluded.trades, "+
+			"volume = "+t.symbols+".volume + excluded.volume, "+
+			"gross_profit = "+t.symbols+".gross_profit + excluded.gross_profit, "+
+			"gross_loss = "+t.symbols+".gross_loss + excluded.gross_loss, "+
+			"wins = "+t.symbols+".wins + excluded.wins",
+		trade.Account, trade.Symbol, trade.Side, sign, float64(sign)*trade.Volume,
+		float64(sign)*gain, float64(sign)*loss, sign*win,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update symbol stats: %v", err)
+	}
+
+	for _, period := range HistoryPeriods {
+		_, err = c.exec(ctx,
+			"INSERT INTO "+t.history+" (account, period, bucket, trades, profit) VALUES (?, ?, ?, ?, ?) "+
+				"ON CONFLICT(account, period, bucket) DO UPDATE SET trades = "+t.history+".trades + excluded.trades, "+
+				"profit = "+t.history+".profit + excluded.profit",
+			trade.Account, period.Name, trade.Time-trade.Time%period.Seconds, sign, profit,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update profit history: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (tx *sqlBatchTx) ApplyAmendment(ctx context.Context, amendment AppliedAmendment) error {
+	return tx.savepoint(ctx, func() error {
+		return applyAmendment(ctx, tx.sqlConn, amendment)
+	})
+}
+
+func applyAmendment(ctx context.Context, c sqlConn, amendment AppliedAmendment) error {
+	var profit sql.NullFloat64
+	if amendment.Corrected != nil {
+		profit = sql.NullFloat64{Float64: amendment.Corrected.ConvertedProfit, Valid: true}
+	}
+	res, err := c.exec(ctx,
+		"UPDATE trade_amendments SET status = ?, attempts = attempts + 1, failed_reason = NULL, profit = ?, applied_at = ? "+
+			"WHERE id = ? AND status = ?",
+		model.AmendmentApplied, profit, amendment.Now, amendment.ID, model.StatusPending,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update amendment status: %v", err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update amendment status: %v", err)
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+
+	if err := updateAggregates(ctx, c, liveTables, amendment.Reversed, -1); err != nil {
+		return err
+	}
+	if amendment.Corrected == nil {
+		_, err = c.exec(ctx, "UPDATE trades_q SET status = ? WHERE id = ?", model.StatusCancelled, amendment.TradeID)
+		if err != nil {
+			return fmt.Errorf("failed to cancel trade: %v", err)
+		}
+		return nil
+	}
+
+	if err := updateAggregates(ctx, c, liveTables, *amendment.Corrected, 1); err != nil {
+		return err
+	}
+	corrected := amendment.Corrected
+	_, err = c.exec(ctx,
+		"UPDATE trades_q SET volume = ?, open = ?, close = ?, side = ?, "+
+			"profit = ?, quote_currency = ?, converted_profit = ?, account_currency = ? WHERE id = ?",
+		amendment.Values.Volume, amendment.Values.Open, amendment.Values.Close, amendment.Values.Side,
+		corrected.Profit, nullString(corrected.QuoteCurrency), corrected.ConvertedProfit, corrected.AccountCurrency,
+		amendment.TradeID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to correct trade: %v", err)
+	}
+	return nil
+}
+
+func (tx *sqlBatchTx) RecordAmendmentFailure(ctx context.Context, failure Failure) error {
+	_, err := tx.exec(ctx,
+		"UPDATE trade_amendments SET status = ?, attempts = ?, failed_reason = ? WHERE id = ? AND status = ?",
+		failure.Status, failure.Attempts, failure.Reason, failure.ID, model.StatusPending,
+	)
+	return err
+}
+
+func (tx *sqlBatchTx) RecordFailure(ctx context.Context, failure Failure) error {
+	_, err := tx.exec(ctx,
+		"UPDATE trades_q SET status = ?, attempts = ?, failed_reason = ?, lease_expires_at = NULL "+
+			"WHERE id = ? AND worker_id = ?",
+		failure.Status, failure.Attempts, failure.Reason, failure.ID, failure.WorkerID,
+	)
+	return err
+}
+
+func (s *SQLStore) ReleaseLeases(ctx context.Context, workerID string) error {
+	_, err := s.conn().exec(ctx,
+		"UPDATE trades_q SET worker_id = NULL, lease_expires_at = NULL WHERE worker_id = ? AND status = ?",
+		workerID, model.StatusPending,
+	)
+	return err
+}
+
+func (s *SQLStore) AccountStats(ctx context.Context, account string) (AccountStats, error) {
+	stats := AccountStats{Account: account}
+	err := s.conn().queryRow(ctx, "SELECT trades, profit FROM account_stats WHERE account = ?", account).
+		Scan(&stats.Trades, &stats.Profit)
+	if err != nil && err != sql.ErrNoRows {
+		return AccountStats{}, err
+	}
+	return stats, nil
+}
+
+func (s *SQLStore) SymbolStats(ctx context.Context, account string) ([]SymbolStats, error) {
+	rows, err := s.conn().query(ctx,
+		"SELECT symbol, side, trades, volume, gross_profit, gross_loss, wins FROM account_symbol_stats "+
+			"WHERE account = ? ORDER BY symbol, side",
+		account,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	symbols := []SymbolStats{}
+	for rows.Next() {
+		var stats SymbolStats
+		if err := rows.Scan(&stats.Symbol, &stats.Side, &stats.Trades, &stats.Volume, &stats.GrossProfit, &stats.GrossLoss, &stats.Wins); err != nil {
+			return nil, err
+		}
+		symbols = append(symbols, stats)
+	}
+	return symbols, rows.Err()
+}
+
+func (s *SQLStore) History(ctx context.Context, query HistoryQuery) ([]HistoryBucket, error) {
+	rows, err := s.conn().query(ctx,
+		"SELECT bucket, trades, profit FROM account_pnl_history "+
+			"WHERE account = ? AND period = ? AND bucket >= ? AND bucket < ? ORDER BY bucket",
+		query.Account, query.Period, query.From, query.To,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []HistoryBucket{}
+	for rows.Next() {
+		var bucket HistoryBucket
+		if err := rows.Scan(&bucket.Bucket, &bucket.Trades, &bucket.Profit); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, rows.Err()
+}
+
+func (s *SQLStore) Instruments(ctx context.Context) (model.Instruments, error) {
+	return loadInstruments(ctx, s.conn())
+}
+
+// loadInstruments читает реестр инструментов из таблицы instruments
+func loadInstruments(ctx context.Context, c sqlConn) (model.Instruments, error) {
+	rows, err := c.query(ctx, "SELECT symbol, contract_size, pip_size, quote_currency, precision FROM instruments")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query instruments: %v", err)
+	}
+	defer rows.Close()
+
+	instruments := make(model.Instruments)
+	for rows.Next() {
+		var ins model.Instrument
+		if err := rows.Scan(&ins.Symbol, &ins.ContractSize, &ins.PipSize, &ins.QuoteCurrency, &ins.Precision); err != nil {
+			return nil, fmt.Errorf("failed to scan instrument: %v", err)
+		}
+		instruments[ins.Symbol] = ins
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating instruments: %v", err)
+	}
+	return instruments, nil
+}
+
+func (s *SQLStore) StoreInstruments(ctx context.Context, instruments []model.Instrument) error {
+	tx, c, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, ins := range instruments {
+		if err := model.ValidateInstrument(ins); err != nil {
+			return fmt.Errorf("invalid instrument %s: %v", ins.Symbol, err)
+		}
+		_, err := c.exec(ctx,
+			"INSERT INTO instruments (symbol, contract_size, pip_size, quote_currency, precision) VALUES (?, ?, ?, ?, ?) "+
+				"ON CONFLICT(symbol) DO UPDATE SET contract_size = excluded.contract_size, pip_size = excluded.pip_size, "+
+				"quote_currency = excluded.quote_currency, precision = excluded.precision",
+			ins.Symbol, ins.ContractSize, ins.PipSize, ins.QuoteCurrency, ins.Precision,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to store instrument %s: %v", ins.Symbol, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) Rates(ctx context.Context) ([]model.Rate, error) {
+	return listRates(ctx, s.conn())
+}
+
+func listRates(ctx context.Context, c sqlConn) ([]model.Rate, error) {
+	rows, err := c.query(ctx, "SELECT base, quote, rate FROM fx_rates ORDER BY base, quote")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rates: %v", err)
+	}
+	defer rows.Close()
+
+	rates := []model.Rate{}
+	for rows.Next() {
+		var rate model.Rate
+		if err := rows.Scan(&rate.Base, &rate.Quote, &rate.Rate); err != nil {
+			return nil, fmt.Errorf("failed to scan rate: %v", err)
+		}
+		rates = append(rates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rates: %v", err)
+	}
+	return rates, nil
+}
+
+func (s *SQLStore) StoreRates(ctx context.Context, rates []model.Rate) error {
+	tx, c, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, rate := range rates {
+		if err := model.ValidateRate(rate); err != nil {
+			return fmt.Errorf("invalid rate %s/%s: %v", rate.Base, rate.Quote, err)
+		}
+		_, err := c.exec(ctx,
+			"INSERT INTO fx_rates (base, quote, rate) VALUES (?, ?, ?) "+
+				"ON CONFLICT(base, quote) DO UPDATE SET rate = excluded.rate",
+			rate.Base, rate.Quote, rate.Rate,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to store rate %s/%s: %v", rate.Base, rate.Quote, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) AccountCurrency(ctx context.Context, account string) (string, error) {
+	return accountCurrency(ctx, s.conn(), account)
+}
+
+func accountCurrency(ctx context.Context, c sqlConn, account string) (string, error) {
+	var currency string
+	err := c.queryRow(ctx, "SELECT currency FROM accounts WHERE account = ?", account).Scan(&currency)
+	if err == sql.ErrNoRows {
+		return model.DefaultAccountCurrency, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query account currency: %v", err)
+	}
+	return currency, nil
+}
+
+func (s *SQLStore) SetAccountCurrency(ctx context.Context, account, currency string) error {
+	tx, c, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := accountCurrency(ctx, c, account)
+	if err != nil {
+		return err
+	}
+	if current != currency {
+		// Накопленная прибыль уже пересчитана в текущую валюту аккаунта
+		var trades int
+		err := c.queryRow(ctx, "SELECT trades FROM account_stats WHERE account = ?", account).Scan(&trades)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to query account stats: %v", err)
+		}
+		if trades > 0 {
+			return ErrAccountHasTrades
+		}
+	}
+
+	_, err = c.exec(ctx,
+		"INSERT INTO accounts (account, currency) VALUES (?, ?) "+
+			"ON CONFLICT(account) DO UPDATE SET currency = excluded.currency",
+		account, currency,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store account: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	rows, err := s.conn().query(ctx,
+		"SELECT id, account, symbol, volume, open, close, side, attempts, COALESCE(failed_reason, ''), created_at "+
+			"FROM trades_q WHERE status = ? ORDER BY id LIMIT ?",
+		model.StatusFailed, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var letter DeadLetter
+		err := rows.Scan(&letter.ID, &letter.Account, &letter.Symbol, &letter.Volume, &letter.Open, &letter.Close,
+			&letter.Side, &letter.Attempts, &letter.FailedReason, &letter.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+func (s *SQLStore) RetryDeadLetter(ctx context.Context, id int64) error {
+	return s.updateDeadLetter(ctx,
+		"UPDATE trades_q SET status = ?, attempts = 0, failed_reason = NULL WHERE id = ? AND status = ?",
+		model.StatusPending, id, model.StatusFailed,
+	)
+}
+
+func (s *SQLStore) DiscardDeadLetter(ctx context.Context, id int64) error {
+	// Запись остается в trades_q для аудита, но больше не обрабатывается
+	return s.updateDeadLetter(ctx,
+		"UPDATE trades_q SET status = ? WHERE id = ? AND status = ?",
+		model.StatusDiscarded, id, model.StatusFailed,
+	)
+}
+
+func (s *SQLStore) updateDeadLetter(ctx context.Context, query string, args ...any) error {
+	res, err := s.conn().exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *SQLStore) RebuildBlocksWrites() bool {
+	return s.dialect.rebuildBlocksWrites
+}
+
+func (s *SQLStore) Rebuild(ctx context.Context, scope RebuildScope, fn func(tx RebuildTx) error) error {
+	tx, c, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Воркеры, применяющие сделки и изменения, ждут окончания пересборки.
+	// Изменения сделок блокируются, чтобы воркер не вычел прибыль, посчитанную до пересборки.
+	if s.dialect.rebuildLock != "" {
+		if _, err := c.exec(ctx, s.dialect.rebuildLock); err != nil {
+			return fmt.Errorf("failed to lock aggregates: %v", err)
+		}
+	}
+
+	query := "SELECT COUNT(*) FROM trade_amendments a JOIN trades_q t ON t.id = a.trade_id WHERE a.status = ?"
+	args := []any{model.StatusPending}
+	if scope.Account != "" {
+		query += " AND t.account = ?"
+		args = append(args, scope.Account)
+	}
+	var pending int
+	if err := c.queryRow(ctx, query, args...).Scan(&pending); err != nil {
+		return fmt.Errorf("failed to count pending amendments: %v", err)
+	}
+	if pending > 0 {
+		return ErrRebuildAmendmentsPending
+	}
+
+	for _, table := range []string{shadowTables.stats, shadowTables.symbols, shadowTables.history, "trade_profits_shadow"} {
+		if _, err := c.exec(ctx, "DELETE FROM "+table); err != nil {
+			return fmt.Errorf("failed to clear %s: %v", table, err)
+		}
+	}
+
+	if err := fn(&sqlRebuildTx{sqlBatchTx: sqlBatchTx{sqlConn: c}, scope: scope}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit rebuild: %v", err)
+	}
+	return nil
+}
+
+// sqlRebuildTx - пересборка статистики в теневые таблицы.
+// Справочные данные читаются так же, как в транзакции порции.
+type sqlRebuildTx struct {
+	sqlBatchTx
+	scope RebuildScope
+}
+
+func (tx *sqlRebuildTx) ProcessedTrades(ctx context.Context, afterID int64, limit int) ([]TradeRecord, error) {
+	return queryTrades(ctx, tx.sqlConn, TradeQuery{
+		Account: tx.scope.Account,
+		Status:  model.StatusProcessed,
+		AfterID: afterID,
+		Limit:   limit,
+	})
+}
+
+func (tx *sqlRebuildTx) AddTrade(ctx context.Context, trade AppliedTrade) error {
+	if err := updateAggregates(ctx, tx.sqlConn, shadowTables, trade, 1); err != nil {
+		return err
+	}
+	_, err := tx.exec(ctx,
+		"INSERT INTO trade_profits_shadow (trade_id, profit, quote_currency, converted_profit, account_currency) "+
+			"VALUES (?, ?, ?, ?, ?)",
+		trade.ID, trade.Profit, nullString(trade.QuoteCurrency), trade.ConvertedProfit, trade.AccountCurrency,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store trade profit: %v", err)
+	}
+	return nil
+}
+
+func (tx *sqlRebuildTx) Diff(ctx context.Context) ([]AggregateDiff, error) {
+	live, err := loadAggregates(ctx, tx.sqlConn, liveTables, tx.scope.Account)
+	if err != nil {
+		return nil, err
+	}
+	rebuilt, err := loadAggregates(ctx, tx.sqlConn, shadowTables, tx.scope.Account)
+	if err != nil {
+		return nil, err
+	}
+	return diffAggregates(live, rebuilt), nil
+}
+
+func (tx *sqlRebuildTx) Swap(ctx context.Context) error {
+	where, args := "", []any{}
+	if tx.scope.Account != "" {
+		where, args = " WHERE account = ?", []any{tx.scope.Account}
+	}
+	for _, table := range []struct {
+		live, shadow, columns string
+	}{
+		{liveTables.stats, shadowTables.stats, "account, trades, profit"},
+		{liveTables.symbols, shadowTables.symbols, "account, symbol, side, trades, volume, gross_profit, gross_loss, wins"},
+		{liveTables.history, shadowTables.history, "account, period, bucket, trades, profit"},
+	} {
+		if _, err := tx.exec(ctx, "DELETE FROM "+table.live+where, args...); err != nil {
+			return fmt.Errorf("failed to clear %s: %v", table.live, err)
+		}
+		_, err := tx.exec(ctx,
+			"INSERT INTO "+table.live+" ("+table.columns+") SELECT "+table.columns+" FROM "+table.shadow+where, args...)
+		if err != nil {
+			return fmt.Errorf("failed to fill %s: %v", table.live, err)
+		}
+	}
+
+	_, err := tx.exec(ctx,
+		"UPDATE trades_q SET profit = s.profit, quote_currency = s.quote_currency, "+
+			"converted_profit = s.converted_profit, account_currency = s.account_currency "+
+			"FROM trade_profits_shadow AS s WHERE trades_q.id = s.trade_id",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update trade profits: %v", err)
+	}
+	return nil
+}
+
+// loadAggregates читает агрегаты t аккаунта или всех аккаунтов, если account пуст
+func loadAggregates(ctx context.Context, c sqlConn, t aggregateTables, account string) (aggregates, error) {
+	result := newAggregates()
+	where, args := "", []any{}
+	if account != "" {
+		where, args = " WHERE account = ?", []any{account}
+	}
+
+	rows, err := c.query(ctx, "SELECT account, trades, profit FROM "+t.stats+where, args...)
+	if err != nil {
+		return result, fmt.Errorf("failed to query %s: %v", t.stats, err)
+	}
+	for rows.Next() {
+		var stats AccountStats
+		if err := rows.Scan(&stats.Account, &stats.Trades, &stats.Profit); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan %s: %v", t.stats, err)
+		}
+		result.stats[stats.Account] = stats
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	rows, err = c.query(ctx,
+		"SELECT account, symbol, side, trades, volume, gross_profit, gross_loss, wins FROM "+t.symbols+where, args...)
+	if err != nil {
+		return result, fmt.Errorf("failed to query %s: %v", t.symbols, err)
+	}
+	for rows.Next() {
+		var key symbolKey
+		var stats SymbolStats
+		if err := rows.Scan(&key.account, &stats.Symbol, &stats.Side, &stats.Trades, &stats.Volume,
+			&stats.GrossProfit, &stats.GrossLoss, &stats.Wins); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan %s: %v", t.symbols, err)
+		}
+		key.symbol, key.side = stats.Symbol, stats.Side
+		result.symbols[key] = stats
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	rows, err = c.query(ctx, "SELECT account, period, bucket, trades, profit FROM "+t.history+where, args...)
+	if err != nil {
+		return result, fmt.Errorf("failed to query %s: %v", t.history, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key historyKey
+		var bucket HistoryBucket
+		if err := rows.Scan(&key.account, &key.period, &bucket.Bucket, &bucket.Trades, &bucket.Profit); err != nil {
+			return result, fmt.Errorf("failed to scan %s: %v", t.history, err)
+		}
+		key.bucket = bucket.Bucket
+		result.history[key] = bucket
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLStore) QueueStats(ctx context.Context) (QueueStats, error) {
+	var stats QueueStats
+	var oldest sql.NullInt64
+	err := s.conn().queryRow(ctx, "SELECT COUNT(*), MIN(created_at) FROM trades_q WHERE status = ?", model.StatusPending).
+		Scan(&stats.Pending, &oldest)
+	if err != nil {
+		return QueueStats{}, err
+	}
+	stats.OldestCreatedAt = oldest.Int64
+	return stats, nil
+}
+
+func (s *SQLStore) RecordHeartbeat(ctx context.Context, heartbeat WorkerHeartbeat) error {
+	_, err := s.conn().exec(ctx,
+		"INSERT INTO worker_heartbeats (worker_id, host, pid, started_at, last_run_at, last_batch_size, last_error) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT(worker_id) DO UPDATE SET host = excluded.host, pid = excluded.pid, "+
+			"started_at = excluded.started_at, last_run_at = excluded.last_run_at, "+
+			"last_batch_size = excluded.last_batch_size, last_error = excluded.last_error",
+		heartbeat.WorkerID, heartbeat.Host, heartbeat.PID, heartbeat.StartedAt, heartbeat.LastRunAt,
+		heartbeat.LastBatchSize, nullString(heartbeat.LastError),
+	)
+	return err
+}
+
+func (s *SQLStore) Heartbeats(ctx context.Context) ([]WorkerHeartbeat, error) {
+	rows, err := s.conn().query(ctx,
+		"SELECT worker_id, host, pid, started_at, last_run_at, last_batch_size, COALESCE(last_error, '') "+
+			"FROM worker_heartbeats ORDER BY last_run_at DESC, worker_id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	heartbeats := []WorkerHeartbeat{}
+	for rows.Next() {
+		var hb WorkerHeartbeat
+		err := rows.Scan(&hb.WorkerID, &hb.Host, &hb.PID, &hb.StartedAt, &hb.LastRunAt, &hb.LastBatchSize, &hb.LastError)
+		if err != nil {
+			return nil, err
+		}
+		heartbeats = append(heartbeats, hb)
+	}
+	return heartbeats, rows.Err()
+}
+
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// CheckWritable выполняет пустое обновление в откатываемой транзакции. База,
+// открытая только для чтения, или реплика PostgreSQL отклоняют его независимо от числа строк.
+func (s *SQLStore) CheckWritable(ctx context.Context) error {
+	tx, conn, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := conn.exec(ctx, "UPDATE schema_migrations SET version = version WHERE version < 0"); err != nil {
+		return fmt.Errorf("database is not writable: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) SelfCheck(ctx context.Context) db.Report {
+	return db.SelfCheck(ctx, s.db, s.dialect.schema)
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullUnix(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+func timeFromUnix(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.Unix(v.Int64, 0).UTC()
+	return &t
+}
@@ -0,0 +1,224 @@
+//go:build cgo
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"gitlab.com/digineat/go-broker-test/internal/db"
+	"gitlab.com/digineat/go-broker-test/internal/model"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		conn, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("Не удалось открыть базу данных в памяти: %v", err)
+		}
+		conn.SetMaxOpenConns(1)
+		if err := db.InitDB(conn); err != nil {
+			t.Fatalf("Не удалось создать схему: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return NewSQLStore(conn, SQLite)
+	})
+}
+
+func TestSQLiteStore_FileConcurrency(t *testing.T) {
+	// Каждый воркер открывает собственное подключение к файлу, как cmd/worker
+	path := filepath.Join(t.TempDir(), "broker.db")
+	store, err := Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Не удалось открыть базу данных: %v", err)
+	}
+	defer store.Close()
+	testConcurrentClaims(t, store)
+}
+
+func TestSQLiteStore_ApplyTradeAtomic(t *testing.T) {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Не удалось открыть базу данных в памяти: %v", err)
+	}
+	conn.SetMaxOpenConns(1)
+	if err := db.InitDB(conn); err != nil {
+		t.Fatalf("Не удалось создать схему: %v", err)
+	}
+	defer conn.Close()
+	store := NewSQLStore(conn, SQLite)
+	ctx := context.Background()
+
+	if _, err := store.EnqueueTrade(ctx, model.Trade{Account: "ACC1", Symbol: "GBPUSD", Volume: 1, Open: 1.3, Close: 1.31, Side: "buy"}); err != nil {
+		t.Fatalf("Не удалось поставить сделку в очередь: %v", err)
+	}
+	now := time.Now().Unix()
+	trades, err := store.ClaimTrades(ctx, Claim{WorkerID: "w1", Limit: 1, Now: now, LeaseUntil: now + 60})
+	if err != nil || len(trades) != 1 {
+		t.Fatalf("Не удалось захватить сделку: %v", err)
+	}
+
+	// Статистика аккаунта обновится, а статистика по символу - нет
+	_, err = conn.Exec(`CREATE TRIGGER fail_symbol_stats BEFORE INSERT ON account_symbol_stats
+		WHEN NEW.symbol = 'GBPUSD' BEGIN SELECT RAISE(FAIL, 'symbol stats unavailable'); END;`)
+	if err != nil {
+		t.Fatalf("Не удалось создать триггер: %v", err)
+	}
+
+	err = store.ProcessBatch(ctx, func(tx BatchTx) error {
+		q := trades[0]
+		applyErr := tx.ApplyTrade(ctx, AppliedTrade{
+			ID: q.ID, WorkerID: "w1", Account: q.Account, Symbol: q.Symbol, Side: q.Side, Volume: q.Volume,
+			Profit: 100, ConvertedProfit: 100, AccountCurrency: "USD", Time: q.CreatedAt,
+		})
+		if applyErr == nil {
+			t.Error("Ожидалась ошибка применения сделки")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Не удалось обработать порцию: %v", err)
+	}
+
+	// Частично примененная сделка не должна попасть в account_stats
+	stats, err := store.AccountStats(ctx, "ACC1")
+	if err != nil {
+		t.Fatalf("Не удалось получить статистику: %v", err)
+	}
+	if stats.Trades != 0 {
+		t.Errorf("Ожидалось, что сделка откатится целиком, найдено: %+v", stats)
+	}
+	record, err := store.Trade(ctx, trades[0].ID)
+	if err != nil {
+		t.Fatalf("Не удалось получить сделку: %v", err)
+	}
+	if record.Status != model.StatusPending {
+		t.Errorf("Ожидалось, что сделка останется в очереди, найдено: %s", record.Status)
+	}
+}
+
+func TestSQLiteStore_NestedSavepoint(t *testing.T) {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Не удалось открыть базу данных в памяти: %v", err)
+	}
+	conn.SetMaxOpenConns(1)
+	if err := db.InitDB(conn); err != nil {
+		t.Fatalf("Не удалось создать схему: %v", err)
+	}
+	defer conn.Close()
+	store := NewSQLStore(conn, SQLite)
+	ctx := context.Background()
+
+	if _, err := store.EnqueueTrade(ctx, model.Trade{Account: "ACC1", Symbol: "EURUSD", Volume: 1, Open: 1.1, Close: 1.2, Side: "buy"}); err != nil {
+		t.Fatalf("Не удалось поставить сделку в очередь: %v", err)
+	}
+	now := time.Now().Unix()
+	trades, err := store.ClaimTrades(ctx, Claim{WorkerID: "w1", Limit: 1, Now: now, LeaseUntil: now + 60})
+	if err != nil || len(trades) != 1 {
+		t.Fatalf("Не удалось захватить сделку: %v", err)
+	}
+
+	// Вложенная точка откатывает примененную сделку, а запись ошибки во внешней точке остается
+	errRejected := errors.New("rejected")
+	err = store.ProcessBatch(ctx, func(tx BatchTx) error {
+		q := trades[0]
+		return tx.Savepoint(ctx, func() error {
+			innerErr := tx.Savepoint(ctx, func() error {
+				if err := tx.ApplyTrade(ctx, AppliedTrade{
+					ID: q.ID, WorkerID: "w1", Account: q.Account, Symbol: q.Symbol, Side: q.Side, Volume: q.Volume,
+					Profit: 100, ConvertedProfit: 100, AccountCurrency: "USD", Time: q.CreatedAt,
+				}); err != nil {
+					return err
+				}
+				return errRejected
+			})
+			if innerErr != errRejected {
+				t.Errorf("Ожидалась ошибка вложенной точки, получено: %v", innerErr)
+			}
+			return tx.RecordFailure(ctx, Failure{ID: q.ID, WorkerID: "w1", Status: model.StatusPending, Attempts: 1, Reason: innerErr.Error()})
+		})
+	})
+	if err != nil {
+		t.Fatalf("Не удалось обработать порцию: %v", err)
+	}
+
+	stats, err := store.AccountStats(ctx, "ACC1")
+	if err != nil {
+		t.Fatalf("Не удалось получить статистику: %v", err)
+	}
+	if stats.Trades != 0 {
+		t.Errorf("Ожидалось, что сделка откатится, найдено: %+v", stats)
+	}
+	record, err := store.Trade(ctx, trades[0].ID)
+	if err != nil {
+		t.Fatalf("Не удалось получить сделку: %v", err)
+	}
+	if record.Status != model.StatusPending || record.Attempts != 1 || record.FailedReason != "rejected" {
+		t.Errorf("Ожидалась записанная ошибка, найдено: status=%s attempts=%d reason=%q", record.Status, record.Attempts, record.FailedReason)
+	}
+}
+
+func TestOpen_SchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "broker.db")
+
+	store, err := Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Не удалось создать базу данных: %v", err)
+	}
+	store.Close()
+
+	conn, schema, err := Connect("sqlite", path)
+	if err != nil {
+		t.Fatalf("Не удалось подключиться к базе данных: %v", err)
+	}
+	if _, err := db.NewMigrator(conn, schema).Down(ctx); err != nil {
+		t.Fatalf("Не удалось откатить миграцию: %v", err)
+	}
+	conn.Close()
+
+	if store, err := Open("sqlite", path); err == nil {
+		store.Close()
+		t.Fatal("Ожидалась ошибка при открытии базы с устаревшей схемой")
+	}
+
+	conn, schema, err = Connect("sqlite", path)
+	if err != nil {
+		t.Fatalf("Не удалось подключиться к базе данных: %v", err)
+	}
+	if _, err := db.NewMigrator(conn, schema).Up(ctx); err != nil {
+		t.Fatalf("Не удалось применить миграции: %v", err)
+	}
+	conn.Close()
+
+	store, err = Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Не удалось открыть обновленную базу данных: %v", err)
+	}
+	store.Close()
+}
+
+func TestSQLiteStore_ReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.db")
+	store, err := Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Не удалось создать базу данных: %v", err)
+	}
+	store.Close()
+
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatalf("Не удалось открыть базу данных: %v", err)
+	}
+	defer conn.Close()
+	readOnly := NewSQLStore(conn, SQLite)
+	if err := readOnly.CheckWritable(context.Background()); err == nil {
+		t.Error("Ожидалась ошибка записи в базу, открытую только для чтения")
+	}
+}
@@ -0,0 +1,585 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+
+	"gitlab.com/digineat/go-broker-test/internal/db"
+	"gitlab.com/digineat/go-broker-test/internal/model"
+)
+
+var (
+	// ErrNotFound - запись не найдена
+	ErrNotFound = errors.New("not found")
+	// ErrLeaseLost - аренда сделки перешла к другому воркеру
+	ErrLeaseLost = errors.New("lease lost")
+	// ErrAccountHasTrades - валюту аккаунта нельзя сменить, по нему уже есть сделки
+	ErrAccountHasTrades = errors.New("account already has trades")
+	// ErrTradeCancelled - сделка уже отменена и не может быть изменена
+	ErrTradeCancelled = errors.New("trade is cancelled")
+	// ErrAmendmentPending - предыдущее изменение сделки еще не учтено в статистике
+	ErrAmendmentPending = errors.New("previous amendment is not applied yet")
+	// ErrRebuildAmendmentsPending - статистику нельзя пересобрать, пока воркер не применил
+	// изменения сделок: они вычитают из агрегатов прибыль, посчитанную до пересборки
+	ErrRebuildAmendmentsPending = errors.New("trade amendments are pending")
+)
+
+// Результат постановки сделки в очередь
+type EnqueueResult int
+
+const (
+	Enqueued EnqueueResult = iota
+	// Сделка с таким client_trade_id уже в очереди и совпадает с переданной
+	EnqueueDuplicate
+	// client_trade_id уже использован для другой сделки
+	EnqueueConflict
+)
+
+// EnqueuedTrade - итог постановки одной сделки. ID - запись trades_q: новая для Enqueued,
+// поставленная ранее для EnqueueDuplicate; для EnqueueConflict ID равен 0.
+type EnqueuedTrade struct {
+	ID     int64
+	Result EnqueueResult
+}
+
+// Периоды, по которым агрегируется история прибыли
+var HistoryPeriods = []struct {
+	Name    string
+	Seconds int64
+}{
+	{Name: "day", Seconds: 24 * 60 * 60},
+	{Name: "hour", Seconds: 60 * 60},
+}
+
+// PeriodSeconds возвращает длительность периода истории в секундах
+func PeriodSeconds(name string) (int64, bool) {
+	for _, period := range HistoryPeriods {
+		if period.Name == name {
+			return period.Seconds, true
+		}
+	}
+	return 0, false
+}
+
+// QueuedTrade - запись trades_q, захваченная воркером
+type QueuedTrade struct {
+	ID      int64
+	Account string
+	Symbol  string
+	Volume  float64
+	Open    float64
+	Close   float64
+	Side    string
+	// CloseTime - время закрытия в секундах Unix, 0 если не передано
+	CloseTime int64
+	CreatedAt int64
+	Attempts  int
+	// RequestID - идентификатор запроса, поставившего сделку в очередь
+	RequestID string
+}
+
+// TradeRecord - запись trades_q вместе с состоянием обработки
+type TradeRecord struct {
+	QueuedTrade
+	ClientTradeID string
+	// OpenTime - время открытия в секундах Unix, 0 если не передано
+	OpenTime     int64
+	Status       string
+	FailedReason string
+	// WorkerID и LeaseExpiresAt - текущая аренда, пустые если сделка не арендована
+	WorkerID       string
+	LeaseExpiresAt int64
+	// Результат расчета, заполняется после обработки
+	Profit          float64
+	QuoteCurrency   string
+	ConvertedProfit float64
+	AccountCurrency string
+}
+
+// TradeQuery - выборка записей trades_q в порядке возрастания id.
+// Пустые поля не ограничивают выборку.
+type TradeQuery struct {
+	Account string
+	Symbol  string
+	Side    string
+	Status  string
+	// From и To - время постановки в очередь в [From, To) в секундах Unix, 0 - без ограничения
+	From int64
+	To   int64
+	// AfterID - выбираются только сделки с id больше AfterID
+	AfterID int64
+	Limit   int
+}
+
+// TradeValues - поля сделки, которые можно исправить
+type TradeValues struct {
+	Volume float64
+	Open   float64
+	Close  float64
+	Side   string
+}
+
+// Amendment - отмена (model.AmendmentCancel) или исправление (model.AmendmentCorrect) сделки.
+// Для исправления AmendTrade вызывает Correct со сделкой, прочитанной под блокировкой ее строки,
+// и сохраняет возвращенные значения. Ошибка Correct отменяет изменение и возвращается из AmendTrade.
+type Amendment struct {
+	TradeID   int64
+	Action    string
+	Correct   func(trade TradeRecord) (TradeValues, error)
+	RequestID string
+}
+
+// AmendmentRecord - запись trade_amendments
+type AmendmentRecord struct {
+	ID      int64
+	TradeID int64
+	Action  string
+	// PrevStatus и Prev - статус и значения сделки до изменения, Values - после
+	PrevStatus string
+	Prev       TradeValues
+	Values     TradeValues
+	// PrevProfit и Profit - прибыль в валюте аккаунта до и после изменения. Заполняются,
+	// если сделка уже учтена в статистике; Profit - после применения исправления.
+	PrevProfit   *float64
+	Profit       *float64
+	Status       string
+	Attempts     int
+	FailedReason string
+	RequestID    string
+	CreatedAt    int64
+	// AppliedAt - время применения в секундах Unix, 0 пока изменение не применено
+	AppliedAt int64
+}
+
+// newAmendmentRecord строит запись изменения сделки trade. Изменение сделки, еще не учтенной
+// в статистике, применяется сразу; для обработанной сделки оно ждет воркера.
+func newAmendmentRecord(amendment Amendment, trade TradeRecord, now int64) (AmendmentRecord, error) {
+	prev := TradeValues{Volume: trade.Volume, Open: trade.Open, Close: trade.Close, Side: trade.Side}
+	record := AmendmentRecord{
+		TradeID:    amendment.TradeID,
+		Action:     amendment.Action,
+		PrevStatus: trade.Status,
+		Prev:       prev,
+		Values:     prev,
+		Status:     model.AmendmentApplied,
+		RequestID:  amendment.RequestID,
+		CreatedAt:  now,
+		AppliedAt:  now,
+	}
+	if amendment.Action == model.AmendmentCorrect {
+		values, err := amendment.Correct(trade)
+		if err != nil {
+			return AmendmentRecord{}, err
+		}
+		record.Values = values
+	}
+	if trade.Status == model.StatusProcessed {
+		profit := trade.ConvertedProfit
+		record.PrevProfit = &profit
+		record.Status = model.StatusPending
+		record.AppliedAt = 0
+	}
+	return record, nil
+}
+
+// PendingAmendment - изменение обработанной сделки, ожидающее воркера,
+// вместе с текущим состоянием сделки
+type PendingAmendment struct {
+	AmendmentRecord
+	Trade TradeRecord
+}
+
+// AppliedAmendment - пересчет сделки, который воркер применяет к агрегатам
+type AppliedAmendment struct {
+	ID      int64
+	TradeID int64
+	// Values - значения исправленной сделки
+	Values TradeValues
+	// Reversed - вклад сделки до изменения, вычитается из агрегатов
+	Reversed AppliedTrade
+	// Corrected - вклад исправленной сделки, nil для отмены
+	Corrected *AppliedTrade
+	// Now - время применения в секундах Unix
+	Now int64
+}
+
+// Claim - параметры захвата сделок в аренду
+type Claim struct {
+	WorkerID string
+	// AfterID - захватываются только сделки с id больше AfterID
+	AfterID int64
+	Limit   int
+	// Now и LeaseUntil - текущее время и время окончания аренды в секундах Unix
+	Now        int64
+	LeaseUntil int64
+}
+
+// AppliedTrade - результат расчета сделки, который применяется к агрегатам
+type AppliedTrade struct {
+	ID       int64
+	WorkerID string
+	Account  string
+	Symbol   string
+	Side     string
+	Volume   float64
+	// Profit - прибыль в валюте котировки, ConvertedProfit - в валюте аккаунта
+	Profit          float64
+	QuoteCurrency   string
+	ConvertedProfit float64
+	AccountCurrency string
+	// Time - время сделки для истории прибыли в секундах Unix
+	Time int64
+}
+
+// Failure - неудачная попытка обработки сделки
+type Failure struct {
+	ID       int64
+	WorkerID string
+	Status   string
+	Attempts int
+	Reason   string
+}
+
+// AccountStats - общая статистика аккаунта
+type AccountStats struct {
+	Account string
+	Trades  int
+	Profit  float64
+}
+
+// SymbolStats - статистика аккаунта по символу и направлению сделок
+type SymbolStats struct {
+	Symbol      string
+	Side        string
+	Trades      int
+	Volume      float64
+	GrossProfit float64
+	GrossLoss   float64
+	Wins        int
+}
+
+// HistoryQuery - выборка истории прибыли: периоды с началом в [From, To)
+type HistoryQuery struct {
+	Account string
+	Period  string
+	From    int64
+	To      int64
+}
+
+// HistoryBucket - прибыль аккаунта за один период
+type HistoryBucket struct {
+	Bucket int64
+	Trades int
+	Profit float64
+}
+
+// DeadLetter - сделка, которую воркер не смог обработать
+type DeadLetter struct {
+	ID           int64
+	Account      string
+	Symbol       string
+	Volume       float64
+	Open         float64
+	Close        float64
+	Side         string
+	Attempts     int
+	FailedReason string
+	CreatedAt    int64
+}
+
+// QueueStats - состояние очереди необработанных сделок
+type QueueStats struct {
+	// Pending - количество сделок со статусом pending
+	Pending int64
+	// OldestCreatedAt - время постановки в очередь самой старой из них в секундах Unix, 0 если очередь пуста
+	OldestCreatedAt int64
+}
+
+// WorkerHeartbeat - отметка воркера о последнем проходе по очереди
+type WorkerHeartbeat struct {
+	WorkerID string
+	Host     string
+	PID      int
+	// StartedAt - время запуска воркера в секундах Unix
+	StartedAt int64
+	// LastRunAt - время последнего прохода в секундах Unix
+	LastRunAt int64
+	// LastBatchSize - количество сделок, выбранных за последний проход
+	LastBatchSize int
+	// LastError - ошибка последнего прохода, пустая строка при успехе
+	LastError string
+}
+
+// RebuildScope - часть статистики, которая пересобирается из истории сделок
+type RebuildScope struct {
+	// Account - пересобирается статистика одного аккаунта, пустая строка - всех аккаунтов
+	Account string
+	// From и To - прибыль пересчитывается только у сделок со временем в [From, To)
+	// в секундах Unix, 0 - без ограничения. Время сделки - как в истории прибыли:
+	// время закрытия или постановки в очередь. Остальные сделки учитываются
+	// с сохраненной прибылью.
+	From int64
+	To   int64
+}
+
+// Recalculates сообщает, пересчитывается ли прибыль сделки со временем t
+func (s RebuildScope) Recalculates(t int64) bool {
+	return (s.From == 0 || t >= s.From) && (s.To == 0 || t < s.To)
+}
+
+// Таблицы агрегатов в AggregateDiff
+const (
+	TableAccountStats = "account_stats"
+	TableSymbolStats  = "account_symbol_stats"
+	TableHistory      = "account_pnl_history"
+)
+
+// AggregateValues - значения строки агрегатов. Для account_symbol_stats Profit - разность
+// GrossProfit и GrossLoss; Volume, GrossProfit, GrossLoss и Wins есть только у этой таблицы.
+type AggregateValues struct {
+	Trades      int
+	Profit      float64
+	Volume      float64
+	GrossProfit float64
+	GrossLoss   float64
+	Wins        int
+}
+
+// AggregateDiff - строка агрегатов, отличающаяся в рабочей и пересобранной статистике.
+// Отсутствующая строка сравнивается как строка с нулевыми значениями.
+type AggregateDiff struct {
+	Table   string
+	Account string
+	// Symbol и Side - ключ account_symbol_stats
+	Symbol string
+	Side   string
+	// Period и Bucket - ключ account_pnl_history
+	Period  string
+	Bucket  int64
+	Live    AggregateValues
+	Rebuilt AggregateValues
+}
+
+// Допустимое расхождение сумм: порядок сложения в рабочих и пересобранных агрегатах разный
+const aggregateTolerance = 1e-6
+
+func (v AggregateValues) equal(other AggregateValues) bool {
+	near := func(a, b float64) bool { return math.Abs(a-b) <= aggregateTolerance }
+	return v.Trades == other.Trades && v.Wins == other.Wins &&
+		near(v.Profit, other.Profit) && near(v.Volume, other.Volume) &&
+		near(v.GrossProfit, other.GrossProfit) && near(v.GrossLoss, other.GrossLoss)
+}
+
+// aggregates - строки account_stats, account_symbol_stats и account_pnl_history
+type aggregates struct {
+	stats   map[string]AccountStats
+	symbols map[symbolKey]SymbolStats
+	history map[historyKey]HistoryBucket
+}
+
+func newAggregates() aggregates {
+	return aggregates{
+		stats:   make(map[string]AccountStats),
+		symbols: make(map[symbolKey]SymbolStats),
+		history: make(map[historyKey]HistoryBucket),
+	}
+}
+
+// diffAggregates возвращает отличающиеся строки live и rebuilt в порядке таблиц и ключей
+func diffAggregates(live, rebuilt aggregates) []AggregateDiff {
+	diff := []AggregateDiff{}
+
+	accounts := unionKeys(live.stats, rebuilt.stats)
+	sort.Strings(accounts)
+	for _, account := range accounts {
+		l, r := live.stats[account], rebuilt.stats[account]
+		lv := AggregateValues{Trades: l.Trades, Profit: l.Profit}
+		rv := AggregateValues{Trades: r.Trades, Profit: r.Profit}
+		if !lv.equal(rv) {
+			diff = append(diff, AggregateDiff{Table: TableAccountStats, Account: account, Live: lv, Rebuilt: rv})
+		}
+	}
+
+	symbolValues := func(s SymbolStats) AggregateValues {
+		return AggregateValues{Trades: s.Trades, Profit: s.GrossProfit - s.GrossLoss, Volume: s.Volume,
+			GrossProfit: s.GrossProfit, GrossLoss: s.GrossLoss, Wins: s.Wins}
+	}
+	symbolKeys := unionKeys(live.symbols, rebuilt.symbols)
+	sort.Slice(symbolKeys, func(i, j int) bool {
+		a, b := symbolKeys[i], symbolKeys[j]
+		if a.account != b.account {
+			return a.account < b.account
+		}
+		if a.symbol != b.symbol {
+			return a.symbol < b.symbol
+		}
+		return a.side < b.side
+	})
+	for _, key := range symbolKeys {
+		lv, rv := symbolValues(live.symbols[key]), symbolValues(rebuilt.symbols[key])
+		if !lv.equal(rv) {
+			diff = append(diff, AggregateDiff{Table: TableSymbolStats, Account: key.account,
+				Symbol: key.symbol, Side: key.side, Live: lv, Rebuilt: rv})
+		}
+	}
+
+	historyKeys := unionKeys(live.history, rebuilt.history)
+	sort.Slice(historyKeys, func(i, j int) bool {
+		a, b := historyKeys[i], historyKeys[j]
+		if a.account != b.account {
+			return a.account < b.account
+		}
+		if a.period != b.period {
+			return a.period < b.period
+		}
+		return a.bucket < b.bucket
+	})
+	for _, key := range historyKeys {
+		l, r := live.history[key], rebuilt.history[key]
+		lv := AggregateValues{Trades: l.Trades, Profit: l.Profit}
+		rv := AggregateValues{Trades: r.Trades, Profit: r.Profit}
+		if !lv.equal(rv) {
+			diff = append(diff, AggregateDiff{Table: TableHistory, Account: key.account,
+				Period: key.period, Bucket: key.bucket, Live: lv, Rebuilt: rv})
+		}
+	}
+	return diff
+}
+
+// unionKeys возвращает ключи обеих карт без повторов
+func unionKeys[K comparable, V any](a, b map[K]V) []K {
+	keys := make([]K, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Store - хранилище очереди сделок, статистики и справочников.
+// Реализации должны быть безопасны для одновременного использования.
+type Store interface {
+	// EnqueueTrade ставит сделку в очередь. Если client_trade_id уже встречался,
+	// новая запись не создается, а сделка сравнивается с ранее поставленной.
+	EnqueueTrade(ctx context.Context, trade model.Trade) (EnqueuedTrade, error)
+	// EnqueueTrades ставит сделки в очередь одной транзакцией в переданном порядке
+	EnqueueTrades(ctx context.Context, trades []model.Trade) ([]EnqueuedTrade, error)
+	// Trade возвращает запись очереди по id или ErrNotFound
+	Trade(ctx context.Context, id int64) (TradeRecord, error)
+	// Trades возвращает до query.Limit записей очереди, подходящих под фильтры
+	Trades(ctx context.Context, query TradeQuery) ([]TradeRecord, error)
+
+	// AmendTrade отменяет или исправляет сделку. Сделка, еще не учтенная в статистике,
+	// изменяется сразу, а ее аренда снимается; изменение обработанной сделки ждет воркера
+	// в статусе pending. Возвращает ErrNotFound, ErrTradeCancelled или ErrAmendmentPending.
+	AmendTrade(ctx context.Context, amendment Amendment) (AmendmentRecord, error)
+	// Amendments возвращает историю изменений сделки в порядке id
+	Amendments(ctx context.Context, tradeID int64) ([]AmendmentRecord, error)
+	// PendingAmendments возвращает до limit изменений, ожидающих воркера, с id больше afterID
+	PendingAmendments(ctx context.Context, afterID int64, limit int) ([]PendingAmendment, error)
+
+	// ClaimTrades захватывает в аренду до claim.Limit ожидающих сделок, не арендованных
+	// другим воркером (или с истекшей арендой), в порядке возрастания id
+	ClaimTrades(ctx context.Context, claim Claim) ([]QueuedTrade, error)
+	// ProcessBatch выполняет fn в одной транзакции. Если fn вернула ошибку
+	// или транзакцию не удалось зафиксировать, изменения не применяются.
+	ProcessBatch(ctx context.Context, fn func(tx BatchTx) error) error
+	// ReleaseLeases снимает аренду воркера с сделок, которые еще ожидают обработки
+	ReleaseLeases(ctx context.Context, workerID string) error
+
+	AccountStats(ctx context.Context, account string) (AccountStats, error)
+	SymbolStats(ctx context.Context, account string) ([]SymbolStats, error)
+	History(ctx context.Context, query HistoryQuery) ([]HistoryBucket, error)
+
+	Instruments(ctx context.Context) (model.Instruments, error)
+	// StoreInstruments добавляет или обновляет инструменты одной транзакцией
+	StoreInstruments(ctx context.Context, instruments []model.Instrument) error
+	Rates(ctx context.Context) ([]model.Rate, error)
+	// StoreRates добавляет или обновляет курсы одной транзакцией
+	StoreRates(ctx context.Context, rates []model.Rate) error
+	// AccountCurrency возвращает валюту аккаунта или валюту по умолчанию
+	AccountCurrency(ctx context.Context, account string) (string, error)
+	// SetAccountCurrency задает валюту аккаунта. Если валюта меняется,
+	// а по аккаунту уже есть сделки, возвращает ErrAccountHasTrades.
+	SetAccountCurrency(ctx context.Context, account, currency string) error
+
+	DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error)
+	// RetryDeadLetter возвращает сделку из dead-letter в очередь с обнуленным счетчиком попыток
+	RetryDeadLetter(ctx context.Context, id int64) error
+	// DiscardDeadLetter помечает сделку из dead-letter как отброшенную
+	DiscardDeadLetter(ctx context.Context, id int64) error
+
+	// Rebuild выполняет fn в одной транзакции, в которой агрегаты не меняются другими
+	// транзакциями. Перед вызовом fn теневые таблицы очищаются. Если fn вернула ошибку,
+	// изменения не применяются; без вызова RebuildTx.Swap рабочая статистика не меняется,
+	// а теневые таблицы остаются заполненными для проверки. Если в scope есть изменения
+	// сделок, ожидающие воркера, возвращает ErrRebuildAmendmentsPending.
+	Rebuild(ctx context.Context, scope RebuildScope, fn func(tx RebuildTx) error) error
+	// RebuildBlocksWrites сообщает, что на время Rebuild останавливается любая запись
+	// в хранилище, в том числе постановка сделок в очередь, а не только изменение агрегатов
+	RebuildBlocksWrites() bool
+
+	// QueueStats возвращает количество и возраст необработанных сделок
+	QueueStats(ctx context.Context) (QueueStats, error)
+	// RecordHeartbeat добавляет или обновляет отметку воркера
+	RecordHeartbeat(ctx context.Context, heartbeat WorkerHeartbeat) error
+	// Heartbeats возвращает отметки всех воркеров, начиная с самой свежей
+	Heartbeats(ctx context.Context) ([]WorkerHeartbeat, error)
+
+	Ping(ctx context.Context) error
+	// CheckWritable проверяет, что хранилище принимает запись, не изменяя данных
+	CheckWritable(ctx context.Context) error
+	// SelfCheck проверяет подключение, параметры базы и версию схемы
+	SelfCheck(ctx context.Context) db.Report
+	Close() error
+}
+
+// ReferenceTx - справочные данные для расчета прибыли внутри транзакции
+type ReferenceTx interface {
+	Instruments(ctx context.Context) (model.Instruments, error)
+	Rates(ctx context.Context) (model.Rates, error)
+	AccountCurrency(ctx context.Context, account string) (string, error)
+}
+
+// BatchTx - операции воркера внутри транзакции порции
+type BatchTx interface {
+	ReferenceTx
+	// Savepoint выполняет fn в точке сохранения: ошибка fn откатывает изменения fn,
+	// а транзакция порции остается пригодной для следующих операций (на PostgreSQL
+	// ошибочный запрос иначе прерывает всю транзакцию). Точки сохранения могут быть вложенными.
+	// Операции транзакции в памяти атомарны, поэтому там откатывается только неудачная операция.
+	Savepoint(ctx context.Context, fn func() error) error
+	// ApplyTrade помечает сделку обработанной и обновляет агрегаты атомарно:
+	// при ошибке не остается ни одного изменения. Если сделка больше не арендована
+	// воркером trade.WorkerID, возвращает ErrLeaseLost.
+	ApplyTrade(ctx context.Context, trade AppliedTrade) error
+	// RecordFailure сохраняет статус, счетчик попыток и причину ошибки и снимает аренду
+	RecordFailure(ctx context.Context, failure Failure) error
+	// ApplyAmendment вычитает из агрегатов вклад сделки до изменения, добавляет вклад
+	// исправленной сделки и обновляет сделку атомарно. Если изменение уже применено
+	// другим воркером, возвращает ErrNotFound.
+	ApplyAmendment(ctx context.Context, amendment AppliedAmendment) error
+	// RecordAmendmentFailure сохраняет статус, счетчик попыток и причину ошибки изменения
+	RecordAmendmentFailure(ctx context.Context, failure Failure) error
+}
+
+// RebuildTx - операции пересборки статистики внутри транзакции Store.Rebuild
+type RebuildTx interface {
+	ReferenceTx
+	// ProcessedTrades возвращает до limit обработанных сделок области пересборки
+	// с id больше afterID в порядке id
+	ProcessedTrades(ctx context.Context, afterID int64, limit int) ([]TradeRecord, error)
+	// AddTrade добавляет вклад сделки в теневые агрегаты и запоминает ее результат расчета
+	AddTrade(ctx context.Context, trade AppliedTrade) error
+	// Diff сравнивает теневые агрегаты с рабочими в области пересборки
+	Diff(ctx context.Context) ([]AggregateDiff, error)
+	// Swap заменяет рабочие агрегаты области пересборки теневыми и сохраняет в сделках
+	// пересчитанную прибыль. Изменения видны другим транзакциям только вместе.
+	Swap(ctx context.Context) error
+}